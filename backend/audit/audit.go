@@ -0,0 +1,260 @@
+// Package audit writes the append-only audit log of administrative and
+// security events.
+//
+// Each event is chained to the previous one by its hash, so an event that was
+// edited or removed directly in the database shows up in Verify. Database
+// triggers created on migration reject updates and deletes of the table.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionLogin          = "auth.login"
+	ActionLoginFailed    = "auth.login_failed"
+	ActionLogout         = "auth.logout"
+	ActionPasswordReset  = "auth.password_reset"
+	ActionPasswordChange = "auth.password_change"
+
+	ActionUserCreate           = "user.create"
+	ActionUserUpdate           = "user.update"
+	ActionUserDelete           = "user.delete"
+	ActionUserRestore          = "user.restore"
+	ActionUserPurge            = "user.purge"
+	ActionUserStatus           = "user.status"
+	ActionUserTwoFactorReset   = "user.2fa_reset"
+	ActionUserUnlock           = "user.unlock"
+	ActionUserSessionsRevoke   = "user.sessions_revoke"
+	ActionUserExport           = "user.export"
+	ActionUserDataExport       = "user.data_export"
+	ActionUserDeletionSchedule = "user.deletion_schedule"
+	ActionUserDeletionCancel   = "user.deletion_cancel"
+
+	ActionRoleCreate = "role.create"
+	ActionRoleUpdate = "role.update"
+	ActionRoleDelete = "role.delete"
+
+	ActionGroupPermissions  = "group.permissions"
+	ActionGroupMemberAdd    = "group.member_add"
+	ActionGroupMemberRemove = "group.member_remove"
+
+	ActionOrganizationMemberAdd    = "organization.member_add"
+	ActionOrganizationMemberUpdate = "organization.member_update"
+	ActionOrganizationMemberRemove = "organization.member_remove"
+
+	ActionInvitationCreate = "invitation.create"
+	ActionInvitationResend = "invitation.resend"
+	ActionInvitationRevoke = "invitation.revoke"
+	ActionInvitationAccept = "invitation.accept"
+
+	ActionAttributeCreate = "attribute.create"
+	ActionAttributeUpdate = "attribute.update"
+	ActionAttributeDelete = "attribute.delete"
+)
+
+// Change is the value of a field before and after an event.
+type Change struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// Event is what a handler knows about something that happened. Record adds
+// who did it and where the request came from.
+type Event struct {
+	Action     string
+	TargetType string
+	TargetID   any
+	Changes    map[string]Change
+	// ActorID is taken from the authenticated user of the request when it is
+	// not set, set it for events like logins that happen before Authen.
+	ActorID *uint
+}
+
+// Redacted stands for the value of a personal field in the changes.
+const Redacted = "[redacted]"
+
+// personalFields are the fields of a user or an invitation that identify a
+// person. The log is append-only and couldn't forget them once the person is
+// deleted, so only the fact that they changed is recorded.
+var personalFields = []string{"name", "email", "attributes"}
+
+// personalTargets are the target types whose changes have personalFields.
+var personalTargets = map[string]bool{"user": true, "invitation": true}
+
+// redact returns the changes with the values of the personal fields
+// replaced. Empty values are kept, they show a field being set or cleared.
+func redact(changes map[string]Change) map[string]Change {
+	redacted := make(map[string]Change, len(changes))
+	for name, change := range changes {
+		if slices.Contains(personalFields, name) {
+			change = Change{Before: redactValue(change.Before), After: redactValue(change.After)}
+		}
+		redacted[name] = change
+	}
+	return redacted
+}
+
+func redactValue(value any) any {
+	if value == nil || value == "" {
+		return value
+	}
+	return Redacted
+}
+
+// Record appends the event to the audit log. A failure is logged rather than
+// returned, the change it describes has already happened. The values of
+// personal fields of users and invitations are redacted.
+func Record(db *gorm.DB, c *fiber.Ctx, event Event) {
+	entry := &models.AuditEvent{
+		ActorID:    event.ActorID,
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		IPAddress:  c.IP(),
+	}
+	if event.TargetID != nil {
+		entry.TargetID = fmt.Sprint(event.TargetID)
+	}
+	if entry.ActorID == nil {
+		if userID, ok := c.Locals("userID").(uint); ok {
+			entry.ActorID = &userID
+		}
+	}
+	if organizationID, ok := c.Locals("organizationID").(*uint); ok {
+		entry.OrganizationID = organizationID
+	}
+	if requestID, ok := c.Locals("requestid").(string); ok {
+		entry.RequestID = requestID
+	}
+	if len(event.Changes) > 0 {
+		if personalTargets[event.TargetType] {
+			event.Changes = redact(event.Changes)
+		}
+		changes, err := json.Marshal(event.Changes)
+		if err != nil {
+			log.Printf("Error encoding audit event changes: %v", err)
+		}
+		entry.Changes = string(changes)
+	}
+	if err := Append(db, entry); err != nil {
+		log.Printf("Error writing audit event %s: %v", event.Action, err)
+	}
+}
+
+// Append chains the event to the last one and stores it. The table is locked
+// for the insert so concurrent events can't both claim the same predecessor.
+func Append(db *gorm.DB, event *models.AuditEvent) error {
+	// the chain runs through every organization, the last event mustn't be
+	// looked up in the one of the request
+	db = db.WithContext(context.Background())
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE audit_events IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var last models.AuditEvent
+		err := tx.Select("hash").Order("id DESC").Take(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		event.PrevHash = last.Hash
+		// postgres keeps microseconds, the hash has to match what is read back
+		event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		event.Hash = Hash(event)
+		return tx.Create(event).Error
+	})
+}
+
+// Hash is the hash of the event and the hash of the event before it.
+func Hash(event *models.AuditEvent) string {
+	fields, _ := json.Marshal([]any{
+		event.PrevHash,
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		event.ActorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.Changes,
+		event.IPAddress,
+		event.RequestID,
+		event.OrganizationID,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify walks the whole chain. It returns how many events were checked and
+// the id of the first event that doesn't match, or 0 when the chain is intact.
+func Verify(db *gorm.DB) (int, uint, error) {
+	var (
+		checked  int
+		brokenAt uint
+		prevHash string
+		batch    []models.AuditEvent
+	)
+	result := db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			event := &batch[i]
+			checked++
+			if event.PrevHash != prevHash || Hash(event) != event.Hash {
+				brokenAt = event.ID
+				return errBroken
+			}
+			prevHash = event.Hash
+		}
+		return nil
+	})
+	if result.Error != nil && !errors.Is(result.Error, errBroken) {
+		return checked, 0, result.Error
+	}
+	return checked, brokenAt, nil
+}
+
+var errBroken = errors.New("audit chain is broken")
+
+// Diff returns the fields whose JSON value differs between before and after,
+// which are usually the same struct at two points in time. Fields hidden from
+// JSON, like password hashes, are never part of it.
+func Diff(before, after any) map[string]Change {
+	beforeFields, afterFields := jsonFields(before), jsonFields(after)
+	changes := map[string]Change{}
+	for name, value := range afterFields {
+		if previous, ok := beforeFields[name]; !ok || !reflect.DeepEqual(previous, value) {
+			changes[name] = Change{Before: beforeFields[name], After: value}
+		}
+	}
+	for name, value := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			changes[name] = Change{Before: value}
+		}
+	}
+	// timestamps change on every save and say nothing about the event
+	delete(changes, "updated_at")
+	return changes
+}
+
+func jsonFields(value any) map[string]any {
+	fields := map[string]any{}
+	if value == nil {
+		return fields
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fields
+	}
+	_ = json.Unmarshal(data, &fields)
+	return fields
+}
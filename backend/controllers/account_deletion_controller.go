@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/storage"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ScheduleAccountDeletion godoc
+// @Summary Delete my account
+// @Description Schedule the deletion of the logged in user, confirmed with their password. The account keeps working for ACCOUNT_DELETION_GRACE_PERIOD so the deletion can be cancelled, then it is deleted and anonymized like a purge with the anonymize message policy.
+// @Tags me
+// @Accept json
+// @Produce json
+// @Param request body dto.AccountDeletionRequest true "Password"
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 400 {object} object{error=string} "Invalid request body or wrong password"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 409 {object} object{error=string} "Deletion already scheduled"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/deletion [post]
+func ScheduleAccountDeletion(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.AccountDeletionRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Password can't be empty"})
+		}
+
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Password is incorrect"})
+			}
+			log.Printf("Error comparing hash password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if user.DeletionScheduledAt != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Deletion already scheduled"})
+		}
+
+		scheduledAt := time.Now().Add(utils.GetEnvDuration("ACCOUNT_DELETION_GRACE_PERIOD", 14*24*time.Hour))
+		if err := db.Model(&user).Update("deletion_scheduled_at", scheduledAt).Error; err != nil {
+			log.Printf("Error updating user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		user.DeletionScheduledAt = &scheduledAt
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserDeletionSchedule,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    map[string]audit.Change{"deletion_scheduled_at": {After: scheduledAt}},
+		})
+		if err := mail.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Your account will be deleted",
+			Body: "Hi " + user.Name + ",\n\n" +
+				"Your account will be deleted on " + scheduledAt.UTC().Format(time.RFC1123) + ". Until then you can log in and cancel the deletion.\n\n" +
+				"Your profile, avatar, sessions, data exports and the rest of your personal data are erased then. Messages you sent stay in the conversations of the people you wrote to, without your name, and the audit log keeps a record of what happened to your account, without your name or email.\n\n" +
+				"If you didn't ask for this, log in, cancel the deletion and change your password right away.",
+		}); err != nil {
+			log.Printf("Error sending account deletion notice: %v", err)
+		}
+
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// CancelAccountDeletion godoc
+// @Summary Cancel the deletion of my account
+// @Description Keep the account of the logged in user, whose deletion was scheduled and didn't happen yet
+// @Tags me
+// @Produce json
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 404 {object} object{error=string} "No deletion scheduled"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/deletion [delete]
+func CancelAccountDeletion(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if user.DeletionScheduledAt == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No deletion scheduled"})
+		}
+
+		scheduledAt := *user.DeletionScheduledAt
+		if err := db.Model(&user).Update("deletion_scheduled_at", nil).Error; err != nil {
+			log.Printf("Error updating user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		user.DeletionScheduledAt = nil
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserDeletionCancel,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    map[string]audit.Change{"deletion_scheduled_at": {Before: scheduledAt}},
+		})
+
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// RunAccountDeletions deletes and anonymizes the users whose grace period
+// after asking to delete their account is over, once an hour until ctx is
+// done.
+func RunAccountDeletions(ctx context.Context, db *gorm.DB, store storage.Storage) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		deleteScheduledAccounts(db, store)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func deleteScheduledAccounts(db *gorm.DB, store storage.Storage) {
+	var userIDs []uint
+	err := db.Unscoped().Model(&models.User{}).
+		Where("deletion_scheduled_at <= ? AND purged_at IS NULL", time.Now()).
+		Pluck("id", &userIDs).Error
+	if err != nil {
+		log.Printf("Error finding users to delete: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		err := db.Unscoped().Model(&models.User{}).
+			Where("id = ? AND deleted_at IS NULL", userID).
+			Update("deleted_at", time.Now()).Error
+		if err != nil {
+			log.Printf("Error deleting user %d: %v", userID, err)
+			continue
+		}
+		// messages are always anonymized here, deleting them would also take
+		// them out of the conversations of the other users, who didn't ask
+		if err := purgeUser(db, store, userID, PurgeMessagesAnonymize); err != nil {
+			log.Printf("Error purging user %d: %v", userID, err)
+			continue
+		}
+		disconnectUser(userID, "account deleted")
+		actorID := userID
+		if err := audit.Append(db, &models.AuditEvent{
+			ActorID:    &actorID,
+			Action:     audit.ActionUserPurge,
+			TargetType: "user",
+			TargetID:   strconv.FormatUint(uint64(userID), 10),
+		}); err != nil {
+			log.Printf("Error writing audit event %s: %v", audit.ActionUserPurge, err)
+		}
+		log.Printf("Deleted user %d at their request", userID)
+	}
+}
@@ -0,0 +1,540 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const maxAttributeStringLength = 1000
+
+// attributeNamePattern keeps attribute names usable as JSON keys, query
+// parameters and in the name of their unique index.
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,47}$`)
+
+// attributeError is a custom attribute value that was rejected, the message
+// is shown to the client. Conflict is set when another user has the value.
+type attributeError struct {
+	message  string
+	conflict bool
+}
+
+func (e attributeError) Error() string {
+	return e.message
+}
+
+var errDuplicateAttributeValues = errors.New("users share values of the attribute")
+
+func validAttributeType(attributeType string) bool {
+	switch attributeType {
+	case models.AttributeTypeString, models.AttributeTypeNumber, models.AttributeTypeBoolean, models.AttributeTypeDate, models.AttributeTypeEnum:
+		return true
+	}
+	return false
+}
+
+func validAttributeVisibility(visibility string) bool {
+	switch visibility {
+	case models.AttributeVisibilityPublic, models.AttributeVisibilityPrivate, models.AttributeVisibilityAdmin:
+		return true
+	}
+	return false
+}
+
+// attributeView decides which custom attributes a caller sees and can set.
+type attributeView struct {
+	definitions []models.AttributeDefinition
+	admin       bool
+	viewerID    uint
+}
+
+// newAttributeView loads the definitions for the caller of c. Users with
+// users:write see every attribute.
+func newAttributeView(db *gorm.DB, c *fiber.Ctx) (*attributeView, error) {
+	view := &attributeView{viewerID: c.Locals("userID").(uint)}
+	if err := db.Order("name").Find(&view.definitions).Error; err != nil {
+		return nil, err
+	}
+	admin, err := middleware.HasPermission(db, c, models.PermissionUsersWrite)
+	view.admin = admin
+	return view, err
+}
+
+// selfAttributeView is what users see of their own profile, their public and
+// private attributes, even when they are admins.
+func selfAttributeView(db *gorm.DB, userID uint) (*attributeView, error) {
+	view := &attributeView{viewerID: userID}
+	err := db.Order("name").Find(&view.definitions).Error
+	return view, err
+}
+
+func (v *attributeView) definition(name string) *models.AttributeDefinition {
+	for i := range v.definitions {
+		if v.definitions[i].Name == name {
+			return &v.definitions[i]
+		}
+	}
+	return nil
+}
+
+// canSee reports whether the attribute of the user with id userID is visible,
+// pass 0 for attributes of any user, like in filters.
+func (v *attributeView) canSee(definition *models.AttributeDefinition, userID uint) bool {
+	switch definition.Visibility {
+	case models.AttributeVisibilityPublic:
+		return true
+	case models.AttributeVisibilityPrivate:
+		return v.admin || v.viewerID == userID
+	default:
+		return v.admin
+	}
+}
+
+// userResponse is toUserResponse with the attributes the caller may see.
+func (v *attributeView) userResponse(user models.User) dto.UserResponse {
+	response := toUserResponse(user)
+	for i := range v.definitions {
+		definition := &v.definitions[i]
+		value, ok := user.Attributes[definition.Name]
+		if !ok || !v.canSee(definition, user.ID) {
+			continue
+		}
+		if response.Attributes == nil {
+			response.Attributes = map[string]any{}
+		}
+		response.Attributes[definition.Name] = value
+	}
+	return response
+}
+
+// merge applies changes to the attributes of the user with id userID and
+// returns the result, current is left untouched. A nil value removes the
+// attribute. Creating checks that every required attribute is set.
+func (v *attributeView) merge(current models.Attributes, changes map[string]any, userID uint, creating bool) (models.Attributes, error) {
+	merged := maps.Clone(current)
+	if merged == nil {
+		merged = models.Attributes{}
+	}
+	for name, value := range changes {
+		definition := v.definition(name)
+		if definition == nil || !v.canSee(definition, userID) {
+			return nil, attributeError{message: "Unknown attribute " + name}
+		}
+		if value == nil {
+			if definition.Required {
+				return nil, attributeError{message: "Attribute " + name + " is required"}
+			}
+			delete(merged, name)
+			continue
+		}
+		normalized, err := normalizeAttribute(definition, value)
+		if err != nil {
+			return nil, err
+		}
+		merged[name] = normalized
+	}
+	if creating {
+		for _, definition := range v.definitions {
+			if _, ok := merged[definition.Name]; definition.Required && !ok {
+				return nil, attributeError{message: "Attribute " + definition.Name + " is required"}
+			}
+		}
+	}
+	return merged, nil
+}
+
+// normalizeAttribute checks that a value decoded from JSON fits the type of
+// the attribute.
+func normalizeAttribute(definition *models.AttributeDefinition, value any) (any, error) {
+	switch definition.Type {
+	case models.AttributeTypeNumber:
+		if number, ok := value.(float64); ok {
+			return number, nil
+		}
+		return nil, attributeError{message: "Attribute " + definition.Name + " must be a number"}
+	case models.AttributeTypeBoolean:
+		if boolean, ok := value.(bool); ok {
+			return boolean, nil
+		}
+		return nil, attributeError{message: "Attribute " + definition.Name + " must be true or false"}
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return nil, attributeError{message: "Attribute " + definition.Name + " must be a string"}
+	}
+	switch definition.Type {
+	case models.AttributeTypeDate:
+		if _, err := time.Parse(time.DateOnly, text); err != nil {
+			return nil, attributeError{message: "Attribute " + definition.Name + " must be a YYYY-MM-DD date"}
+		}
+	case models.AttributeTypeEnum:
+		if !slices.Contains(definition.Options, text) {
+			return nil, attributeError{message: "Attribute " + definition.Name + " must be one of " + strings.Join(definition.Options, ", ")}
+		}
+	default:
+		text = strings.TrimSpace(text)
+		if len(text) > maxAttributeStringLength {
+			return nil, attributeError{message: "Attribute " + definition.Name + " can't be longer than " + strconv.Itoa(maxAttributeStringLength) + " characters"}
+		}
+	}
+	return text, nil
+}
+
+// parseAttributeFilter converts the value of an attr.<name> query parameter
+// to the type of the attribute.
+func (v *attributeView) parseAttributeFilter(name string, value string) (any, error) {
+	definition := v.definition(name)
+	if definition == nil || !v.canSee(definition, 0) {
+		return nil, attributeError{message: "Can't filter by unknown attribute " + name}
+	}
+	var parsed any = value
+	switch definition.Type {
+	case models.AttributeTypeNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, attributeError{message: "Attribute " + name + " must be a number"}
+		}
+		parsed = number
+	case models.AttributeTypeBoolean:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, attributeError{message: "Attribute " + name + " must be true or false"}
+		}
+		parsed = boolean
+	}
+	return normalizeAttribute(definition, parsed)
+}
+
+// checkUniqueAttributes fails with a conflict when another user already has
+// the value of a unique attribute that is being set. The unique index of
+// the attribute catches requests racing each other.
+func (v *attributeView) checkUniqueAttributes(db *gorm.DB, attributes models.Attributes, changes map[string]any, userID uint) error {
+	for name := range changes {
+		definition := v.definition(name)
+		value, ok := attributes[name]
+		if definition == nil || !definition.Unique || !ok {
+			continue
+		}
+		containing, err := json.Marshal(map[string]any{name: value})
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := db.Model(&models.User{}).
+			Where("attributes @> ?::jsonb AND id <> ?", string(containing), userID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return attributeError{message: "Attribute " + name + " is already taken by another user", conflict: true}
+		}
+	}
+	return nil
+}
+
+// attributeRequestError answers an error of merge or checkUniqueAttributes.
+func attributeRequestError(c *fiber.Ctx, err error) error {
+	var rejected attributeError
+	if errors.As(err, &rejected) {
+		status := fiber.StatusBadRequest
+		if rejected.conflict {
+			status = fiber.StatusConflict
+		}
+		return c.Status(status).JSON(fiber.Map{"error": rejected.message})
+	}
+	log.Printf("Error validating attributes: %v", err)
+	return c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// syncAttributeIndex creates or drops the unique index on the values of an
+// attribute, so the database rejects duplicates even between concurrent
+// requests. Deleted users don't hold on to their values.
+func syncAttributeIndex(tx *gorm.DB, definition *models.AttributeDefinition) error {
+	index := "idx_users_attribute_" + definition.Name
+	if !definition.Unique {
+		return tx.Exec("DROP INDEX IF EXISTS " + index).Error
+	}
+	var duplicates int64
+	if err := tx.Raw(`SELECT count(*) FROM (
+		SELECT 1 FROM users WHERE deleted_at IS NULL AND attributes->>? IS NOT NULL
+		GROUP BY attributes->>? HAVING count(*) > 1
+	) AS duplicates`, definition.Name, definition.Name).Scan(&duplicates).Error; err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		return errDuplicateAttributeValues
+	}
+	return tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + index + " ON users ((attributes->>'" + definition.Name + "')) WHERE deleted_at IS NULL").Error
+}
+
+// validateAttributeDefinition checks the settings shared by creating and
+// updating a definition.
+func validateAttributeDefinition(definition *models.AttributeDefinition) string {
+	if !validAttributeVisibility(definition.Visibility) {
+		return "Visibility must be public, private or admin"
+	}
+	if definition.Type == models.AttributeTypeEnum {
+		if len(definition.Options) == 0 {
+			return "Enum attributes need options"
+		}
+		for _, option := range definition.Options {
+			if option == "" {
+				return "Options can't be empty"
+			}
+		}
+	} else if len(definition.Options) > 0 {
+		return "Only enum attributes have options"
+	}
+	if definition.Unique && definition.Type == models.AttributeTypeBoolean {
+		return "Boolean attributes can't be unique"
+	}
+	return ""
+}
+
+func findAttributeDefinition(db *gorm.DB, name string) (*models.AttributeDefinition, error) {
+	var definition models.AttributeDefinition
+	if err := db.Where("name = ?", name).First(&definition).Error; err != nil {
+		return nil, err
+	}
+	return &definition, nil
+}
+
+// GetAttributeDefinitions godoc
+// @Summary List custom attributes
+// @Description List the custom attributes users can have
+// @Tags attributes
+// @Produce json
+// @Success 200 {array} models.AttributeDefinition
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/attributes [get]
+func GetAttributeDefinitions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var definitions []models.AttributeDefinition
+		if err := db.Order("name").Find(&definitions).Error; err != nil {
+			log.Printf("Error getting attribute definitions from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(definitions)
+	}
+}
+
+// CreateAttributeDefinition godoc
+// @Summary Define a custom attribute
+// @Description Add a custom attribute to users. The type is string, number, boolean, date (YYYY-MM-DD) or enum with options. Visibility is public (everyone who can see the user), private (the user and users:write) or admin (users:write only). Users can set their own public and private attributes.
+// @Tags attributes
+// @Accept json
+// @Produce json
+// @Param attribute body dto.AttributeDefinitionCreateRequest true "Attribute definition"
+// @Success 201 {object} models.AttributeDefinition
+// @Failure 400 {object} object{error=string} "Invalid request body, name, type, visibility or options"
+// @Failure 409 {object} object{error=string} "Attribute already exists"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/attributes [post]
+func CreateAttributeDefinition(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.AttributeDefinitionCreateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if !attributeNamePattern.MatchString(input.Name) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name must start with a lowercase letter and contain only lowercase letters, digits and underscores, up to 48 characters"})
+		}
+		if !validAttributeType(input.Type) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Type must be string, number, boolean, date or enum"})
+		}
+		if input.Visibility == "" {
+			input.Visibility = models.AttributeVisibilityPublic
+		}
+		definition := &models.AttributeDefinition{
+			Name:        input.Name,
+			Label:       strings.TrimSpace(input.Label),
+			Description: input.Description,
+			Type:        input.Type,
+			Options:     input.Options,
+			Required:    input.Required,
+			Unique:      input.Unique,
+			Visibility:  input.Visibility,
+		}
+		if definition.Label == "" {
+			definition.Label = definition.Name
+		}
+		if message := validateAttributeDefinition(definition); message != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": message})
+		}
+
+		if _, err := findAttributeDefinition(db, definition.Name); err == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Attribute already exists"})
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error finding attribute definition in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(definition).Error; err != nil {
+				return err
+			}
+			return syncAttributeIndex(tx, definition)
+		})
+		if err != nil {
+			log.Printf("Error creating attribute definition: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionAttributeCreate,
+			TargetType: "attribute",
+			TargetID:   definition.ID,
+			Changes:    audit.Diff(nil, definition),
+		})
+		return c.Status(fiber.StatusCreated).JSON(definition)
+	}
+}
+
+// UpdateAttributeDefinition godoc
+// @Summary Update a custom attribute
+// @Description Replace the label, description, options, required, unique and visibility of a custom attribute. Making it unique fails while users share a value, and enum options still in use can't be removed.
+// @Tags attributes
+// @Accept json
+// @Produce json
+// @param name path string true "Attribute name"
+// @Param attribute body dto.AttributeDefinitionUpdateRequest true "Attribute settings"
+// @Success 200 {object} models.AttributeDefinition
+// @Failure 400 {object} object{error=string} "Invalid request body, visibility or options"
+// @Failure 404 {object} object{error=string} "Attribute not found"
+// @Failure 409 {object} object{error=string} "Users share a value or use a removed option"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/attributes/:name [put]
+func UpdateAttributeDefinition(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.AttributeDefinitionUpdateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		definition, err := findAttributeDefinition(db, c.Params("name"))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Attribute not found"})
+			}
+			log.Printf("Error finding attribute definition in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		before := *definition
+		removedOptions := slices.DeleteFunc(slices.Clone(definition.Options), func(option string) bool {
+			return slices.Contains(input.Options, option)
+		})
+
+		if input.Visibility == "" {
+			input.Visibility = models.AttributeVisibilityPublic
+		}
+		definition.Label = strings.TrimSpace(input.Label)
+		if definition.Label == "" {
+			definition.Label = definition.Name
+		}
+		definition.Description = input.Description
+		definition.Options = input.Options
+		definition.Required = input.Required
+		definition.Unique = input.Unique
+		definition.Visibility = input.Visibility
+		if message := validateAttributeDefinition(definition); message != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": message})
+		}
+
+		errOptionInUse := errors.New("option in use")
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, option := range removedOptions {
+				containing, err := json.Marshal(map[string]string{definition.Name: option})
+				if err != nil {
+					return err
+				}
+				var count int64
+				if err := tx.Unscoped().Model(&models.User{}).Where("attributes @> ?::jsonb", string(containing)).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					return errOptionInUse
+				}
+			}
+			if err := tx.Save(definition).Error; err != nil {
+				return err
+			}
+			return syncAttributeIndex(tx, definition)
+		})
+		switch {
+		case errors.Is(err, errOptionInUse):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Removed options are still set on users"})
+		case errors.Is(err, errDuplicateAttributeValues):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Users share values of the attribute, it can't be unique"})
+		case err != nil:
+			log.Printf("Error updating attribute definition: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionAttributeUpdate,
+			TargetType: "attribute",
+			TargetID:   definition.ID,
+			Changes:    audit.Diff(before, definition),
+		})
+		return c.JSON(definition)
+	}
+}
+
+// DeleteAttributeDefinition godoc
+// @Summary Delete a custom attribute
+// @Description Delete a custom attribute together with its values on every user
+// @Tags attributes
+// @Produce json
+// @param name path string true "Attribute name"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Attribute not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/attributes/:name [delete]
+func DeleteAttributeDefinition(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		definition, err := findAttributeDefinition(db, c.Params("name"))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Attribute not found"})
+			}
+			log.Printf("Error finding attribute definition in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(definition).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DROP INDEX IF EXISTS idx_users_attribute_" + definition.Name).Error; err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE users SET attributes = attributes - ? WHERE attributes->? IS NOT NULL", definition.Name, definition.Name).Error
+		})
+		if err != nil {
+			log.Printf("Error deleting attribute definition: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionAttributeDelete,
+			TargetType: "attribute",
+			TargetID:   definition.ID,
+			Changes:    audit.Diff(definition, nil),
+		})
+		return c.JSON(fiber.Map{"message": "Attribute deleted successfully"})
+	}
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+func toAuditEventResponse(event models.AuditEvent) dto.AuditEventResponse {
+	response := dto.AuditEventResponse{
+		ID:             event.ID,
+		CreatedAt:      event.CreatedAt,
+		ActorID:        event.ActorID,
+		Action:         event.Action,
+		TargetType:     event.TargetType,
+		TargetID:       event.TargetID,
+		IPAddress:      event.IPAddress,
+		RequestID:      event.RequestID,
+		OrganizationID: event.OrganizationID,
+		PrevHash:       event.PrevHash,
+		Hash:           event.Hash,
+	}
+	if event.Changes != "" {
+		response.Changes = json.RawMessage(event.Changes)
+	}
+	return response
+}
+
+// filterAuditEvents applies the filters of the query string shared by the
+// list and the export, within the organization of the request.
+func filterAuditEvents(db *gorm.DB, c *fiber.Ctx) (*gorm.DB, error) {
+	db = db.WithContext(c.UserContext()).Model(&models.AuditEvent{})
+	if actor := c.Query("actor"); actor != "" {
+		actorID, err := strconv.ParseUint(actor, 10, 64)
+		if err != nil {
+			return nil, errors.New("actor must be a user id")
+		}
+		db = db.Where("actor_id = ?", actorID)
+	}
+	if action := c.Query("action"); action != "" {
+		db = db.Where("action = ?", action)
+	}
+	if targetType := c.Query("target_type"); targetType != "" {
+		db = db.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("target_id"); targetID != "" {
+		db = db.Where("target_id = ?", targetID)
+	}
+	for param, condition := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+		if value := c.Query(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", param)
+			}
+			db = db.Where(condition, at)
+		}
+	}
+	return db, nil
+}
+
+// GetAuditEvents godoc
+// @Summary List audit events
+// @Description List the audit log of the current organization, newest first (requires audit:read). Events outside of any organization, like logins, are listed when their actor or target user is a member.
+// @Tags audit
+// @Produce json
+// @Param actor query int false "Only events of this user"
+// @Param action query string false "Only this action, like user.update"
+// @Param target_type query string false "Only events about this kind of target, like user"
+// @Param target_id query string false "Only events about this target"
+// @Param from query string false "At or after this RFC 3339 time"
+// @Param to query string false "Before this RFC 3339 time"
+// @Param limit query int false "Page size, at most 1000" default(100)
+// @Param offset query int false "Events to skip" default(0)
+// @Success 200 {object} dto.AuditEventListResponse
+// @Failure 400 {object} object{error=string} "Invalid query parameter"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/audit-events [get]
+func GetAuditEvents(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", defaultAuditPageSize)
+		offset := c.QueryInt("offset", 0)
+		if limit < 1 || limit > maxAuditPageSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize)})
+		}
+		if offset < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "offset can't be negative"})
+		}
+		filtered, err := filterAuditEvents(db, c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var total int64
+		if err := filtered.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			log.Printf("Error counting audit events in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		var events []models.AuditEvent
+		if err := filtered.Session(&gorm.Session{}).Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+			log.Printf("Error getting audit events from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		response := dto.AuditEventListResponse{
+			Data:   make([]dto.AuditEventResponse, 0, len(events)),
+			Total:  total,
+			Limit:  limit,
+			Offset: offset,
+		}
+		for _, event := range events {
+			response.Data = append(response.Data, toAuditEventResponse(event))
+		}
+		return c.JSON(response)
+	}
+}
+
+// ExportAuditEvents godoc
+// @Summary Export audit events
+// @Description Download every audit event of the current organization matching the filters, oldest first, as CSV or JSON (requires audit:read). Events outside of any organization, like logins, are included when their actor or target user is a member.
+// @Tags audit
+// @Produce text/csv,json
+// @Param format query string false "csv or json" default(csv)
+// @Param actor query int false "Only events of this user"
+// @Param action query string false "Only this action, like user.update"
+// @Param target_type query string false "Only events about this kind of target, like user"
+// @Param target_id query string false "Only events about this target"
+// @Param from query string false "At or after this RFC 3339 time"
+// @Param to query string false "Before this RFC 3339 time"
+// @Success 200 {array} dto.AuditEventResponse
+// @Failure 400 {object} object{error=string} "Invalid query parameter"
+// @Security ApiKeyAuth
+// @Router /api/v1/audit-events/export [get]
+func ExportAuditEvents(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		format := c.Query("format", "csv")
+		if format != "csv" && format != "json" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be csv or json"})
+		}
+		filtered, err := filterAuditEvents(db, c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		filename := "audit-events-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+		if format == "csv" {
+			c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		} else {
+			c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+		}
+
+		// the log can be large, so it is streamed in batches instead of
+		// being loaded at once
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := writeAuditEvents(w, filtered, format); err != nil {
+				log.Printf("Error exporting audit events: %v", err)
+			}
+		})
+		return nil
+	}
+}
+
+func writeAuditEvents(w *bufio.Writer, db *gorm.DB, format string) error {
+	csvWriter := csv.NewWriter(w)
+	first := true
+	if format == "csv" {
+		if err := csvWriter.Write([]string{"id", "created_at", "actor_id", "action", "target_type", "target_id", "changes", "ip_address", "request_id", "organization_id", "prev_hash", "hash"}); err != nil {
+			return err
+		}
+	} else {
+		w.WriteString("[")
+	}
+
+	var batch []models.AuditEvent
+	result := db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			if format == "csv" {
+				if err := csvWriter.Write([]string{
+					strconv.FormatUint(uint64(event.ID), 10),
+					event.CreatedAt.UTC().Format(time.RFC3339Nano),
+					optionalID(event.ActorID),
+					event.Action,
+					event.TargetType,
+					event.TargetID,
+					event.Changes,
+					event.IPAddress,
+					event.RequestID,
+					optionalID(event.OrganizationID),
+					event.PrevHash,
+					event.Hash,
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := json.Marshal(toAuditEventResponse(event))
+			if err != nil {
+				return err
+			}
+			if !first {
+				w.WriteString(",")
+			}
+			first = false
+			w.Write(data)
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if format == "json" {
+		w.WriteString("]")
+	}
+	csvWriter.Flush()
+	return w.Flush()
+}
+
+func optionalID(id *uint) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*id), 10)
+}
+
+// VerifyAuditEvents godoc
+// @Summary Verify the audit log
+// @Description Recompute the hash chain of the whole audit log to detect events that were changed or removed in the database (requires audit:read). The chain runs through every organization, only whether it is intact is returned.
+// @Tags audit
+// @Produce json
+// @Success 200 {object} dto.AuditVerifyResponse
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/audit-events/verify [get]
+func VerifyAuditEvents(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		checked, brokenAt, err := audit.Verify(db)
+		if err != nil {
+			log.Printf("Error verifying audit events: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := dto.AuditVerifyResponse{Valid: brokenAt == 0, Checked: checked}
+		if brokenAt != 0 {
+			response.BrokenAt = &brokenAt
+		}
+		return c.JSON(response)
+	}
+}
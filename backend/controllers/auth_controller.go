@@ -3,10 +3,16 @@ package controllers
 import (
 	"errors"
 	"log"
+	"math"
+	"strconv"
 	"time"
 
+	"github.com/aotsurasak46/user-management/audit"
 	_ "github.com/aotsurasak46/user-management/docs"
 	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/limiter"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/middleware"
 	"github.com/aotsurasak46/user-management/models"
 	"github.com/aotsurasak46/user-management/utils"
 	"github.com/gofiber/fiber/v2"
@@ -16,7 +22,7 @@ import (
 
 // RegisterUser godoc
 // @Summary User Register
-// @Description Create a new user with name, email and password
+// @Description Create a new user with name, email and password. A verification link is sent to the email.
 // @Tags authentication
 // @Accept json
 // @Produce json
@@ -26,7 +32,7 @@ import (
 // @Failure 401 {object} object{error=string} "Email already exists"
 // @Failure 500 {object} object{error=string} "Internal server error"
 // @Router /api/v1/register [post]
-func RegisterUser(db *gorm.DB) fiber.Handler {
+func RegisterUser(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		inputUser := new(dto.RegisterRequest)
 		if err := c.BodyParser(&inputUser); err != nil {
@@ -55,23 +61,33 @@ func RegisterUser(db *gorm.DB) fiber.Handler {
 			}
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
+		if err := joinDefaultOrganization(db, user.ID); err != nil {
+			log.Printf("Error joining default organization: %v", err)
+		}
+		if err := sendVerificationEmail(db, mail, user, user.Email); err != nil {
+			// the user can ask for another email, don't fail the registration
+			log.Printf("Error sending verification email: %v", err)
+		}
 		return c.Status(fiber.StatusCreated).JSON(user)
 	}
 }
 
 // LoginUser godoc
 // @Summary User login
-// @Description Authenticate a user with email and password
+// @Description Authenticate a user with email and password. When the user has two factor authentication enabled, no session is started and a challenge token for /api/v1/login/2fa is returned instead.
 // @Tags authentication
 // @Accept json
 // @Produce json
 // @Param credentials body dto.LoginRequest true "Login Credentials"
 // @Success 200 {object} object{message=string,user=dto.UserResponse} "Login successful"
+// @Success 202 {object} dto.TwoFactorChallengeResponse "Two factor code required"
 // @Failure 400 {object} object{error=string} "Bad request"
 // @Failure 401 {object} object{error=string} "Invalid email or password"
+// @Failure 403 {object} object{error=string} "Email not verified, account suspended or banned"
+// @Failure 429 {object} object{error=string} "Too many failed login attempts, see the Retry-After header"
 // @Failure 500 {object} object{error=string} "Internal server error"
 // @Router /api/v1/login [post]
-func LoginUser(db *gorm.DB) fiber.Handler {
+func LoginUser(db *gorm.DB, guard *limiter.LoginGuard) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		inputUser := new(dto.LoginRequest)
 		dbUser := new(models.User)
@@ -82,55 +98,100 @@ func LoginUser(db *gorm.DB) fiber.Handler {
 		if inputUser.Email == "" || inputUser.Password == "" {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email or password can't be empty"})
 		}
+		wait, err := guard.Reserve(c.Context(), inputUser.Email, c.IP())
+		if err != nil {
+			log.Printf("Error checking login attempts: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if wait > 0 {
+			return tooManyRequests(c, wait, "Too many failed login attempts, try again later")
+		}
 		result := db.Where("email = ?", inputUser.Email).First(&dbUser)
 		if result.Error != nil {
 			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 				log.Printf("User not found: %v", inputUser.Email)
+				recordLoginFailure(c, guard, inputUser.Email)
+				// the email isn't kept, it may be the mistyped address of
+				// somebody and the log can't forget it
+				audit.Record(db, c, audit.Event{Action: audit.ActionLoginFailed, TargetType: "email"})
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid email or password"})
 			}
 			log.Printf("Error finding user in database: %v", result.Error)
+			releaseLoginAttempt(c, guard, inputUser.Email)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
 		if err := bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(inputUser.Password)); err != nil {
 			log.Printf("Error comparing password: %v", err)
 			if err == bcrypt.ErrMismatchedHashAndPassword {
 				log.Printf("Password mismatch: %v", err)
+				recordLoginFailure(c, guard, inputUser.Email)
+				audit.Record(db, c, audit.Event{Action: audit.ActionLoginFailed, TargetType: "user", TargetID: dbUser.ID, ActorID: &dbUser.ID})
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid email or password"})
 			}
 			log.Printf("Error comparing hash password: %v", err)
+			releaseLoginAttempt(c, guard, inputUser.Email)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		tokenString, err := utils.GenerateJWT(dbUser.ID)
+		if err := guard.Succeed(c.Context(), inputUser.Email, c.IP()); err != nil {
+			log.Printf("Error resetting login attempts: %v", err)
+		}
+		if dbUser.Blocked(time.Now()) {
+			return middleware.RejectBlockedUser(c, dbUser)
+		}
+		if utils.GetEnvBool("REQUIRE_EMAIL_VERIFICATION", false) && !dbUser.EmailVerified {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Email not verified"})
+		}
+		if dbUser.TwoFactorEnabled {
+			challengeToken, err := utils.GenerateChallengeJWT(dbUser.ID)
+			if err != nil {
+				log.Printf("Error generate JWT: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			return c.Status(fiber.StatusAccepted).JSON(dto.TwoFactorChallengeResponse{
+				TwoFactorRequired: true,
+				ChallengeToken:    challengeToken,
+			})
+		}
+		session, refreshToken, err := createSession(db, c, dbUser.ID)
 		if err != nil {
+			log.Printf("Error creating session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := setAuthCookies(c, session, refreshToken); err != nil {
 			log.Printf("Error generate JWT: %v", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		c.Cookie(&fiber.Cookie{
-			Name:     "jwt",
-			Value:    tokenString,
-			Expires:  time.Now().Add(time.Hour * 72),
-			HTTPOnly: true,
-			SameSite: "Lax",
-			Path:     "/",
-			Secure:   false,
-		})
+		audit.Record(db, c, audit.Event{Action: audit.ActionLogin, TargetType: "session", TargetID: session.ID, ActorID: &dbUser.ID})
 
-		return c.JSON(dto.UserResponse{
-			ID:    dbUser.ID,
-			Name:  dbUser.Name,
-			Email: dbUser.Email,
-			Role:  dbUser.Role,
-		})
+		return c.JSON(toUserResponse(*dbUser))
+	}
+}
+
+func recordLoginFailure(c *fiber.Ctx, guard *limiter.LoginGuard, email string) {
+	if err := guard.Fail(c.Context(), email, c.IP()); err != nil {
+		log.Printf("Error recording failed login: %v", err)
+	}
+}
+
+func releaseLoginAttempt(c *fiber.Ctx, guard *limiter.LoginGuard, email string) {
+	if err := guard.Release(c.Context(), email, c.IP()); err != nil {
+		log.Printf("Error releasing login attempt: %v", err)
 	}
 }
 
+func tooManyRequests(c *fiber.Ctx, wait time.Duration, message string) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": message})
+}
+
 // CheckAuth godoc
 // @Summary Check Authentication
 // @Description Verify if the user is authenticated and retrieve user details
 // @Tags authentication
 // @Produce json
-// @Success 200 {object} object{authenticated=bool,user=object{id=uint,name=string,email=string,role=string}}
+// @Success 200 {object} object{authenticated=bool,user=object{id=uint,name=string,email=string,role=string,email_verified=bool,permissions=[]string},organization_id=uint}
 // @Failure 401 {object} object{error=string} "User not found or unauthorized"
+// @Security ApiKeyAuth
 // @Router /api/v1/check-auth [get]
 func CheckAuth(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -139,32 +200,222 @@ func CheckAuth(db *gorm.DB) fiber.Handler {
 		if err := db.First(&user, userID).Error; err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
 		}
+		permissions, err := middleware.UserPermissions(db, user.ID, user.Role, c.Locals("organizationID").(*uint))
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
 		return c.JSON(fiber.Map{
 			"authenticated": true,
 			"user": fiber.Map{
-				"id":    user.ID,
-				"name":  user.Name,
-				"email": user.Email,
-				"role":  user.Role,
+				"id":             user.ID,
+				"name":           user.Name,
+				"email":          user.Email,
+				"role":           user.Role,
+				"email_verified": user.EmailVerified,
+				"permissions":    permissions,
 			},
+			"organization_id": c.Locals("organizationID"),
 		})
 	}
 }
 
+// RefreshToken godoc
+// @Summary Refresh access token
+// @Description Exchange the refresh token cookie for a new access token and a new refresh token. Reusing an already exchanged refresh token revokes the whole session, unless it was replaced less than REFRESH_TOKEN_REUSE_GRACE ago by a concurrent refresh, which only gets a new access token.
+// @Tags authentication
+// @Produce json
+// @Success 200 {object} object{message=string} "Token refreshed"
+// @Failure 401 {object} object{error=string} "Missing, invalid, expired or revoked refresh token"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/token/refresh [post]
+func RefreshToken(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		refreshToken := c.Cookies(refreshTokenCookie)
+		if refreshToken == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing refresh token"})
+		}
+		session, newRefreshToken, err := rotateSession(db, c, refreshToken)
+		if err != nil {
+			if errors.Is(err, errInvalidRefreshToken) {
+				clearAuthCookies(c)
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired refresh token"})
+			}
+			log.Printf("Error rotating session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := setAuthCookies(c, session, newRefreshToken); err != nil {
+			log.Printf("Error generate JWT: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Token refreshed"})
+	}
+}
+
 // LogoutUser godoc
 // @Summary User logout
-// @Description Logout a user by clearing the JWT cookie
+// @Description Logout a user by revoking the current session and clearing the auth cookies
 // @Tags authentication
 // @Success 200 {object} object{message=string} "Logout successful"
 // @Router /api/v1/logout [post]
-func LogoutUser() fiber.Handler {
+func LogoutUser(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		c.Cookie(&fiber.Cookie{
-			Name:     "jwt",
-			Value:    "",
-			Expires:  time.Now().Add(-time.Hour),
-			HTTPOnly: true,
-		})
+		if refreshToken := c.Cookies(refreshTokenCookie); refreshToken != "" {
+			if session, err := findSessionByRefreshToken(db, refreshToken); err == nil {
+				if err := revokeSession(db, session, "logout"); err != nil {
+					log.Printf("Error revoking session: %v", err)
+				}
+				audit.Record(db, c, audit.Event{Action: audit.ActionLogout, TargetType: "session", TargetID: session.ID, ActorID: &session.UserID})
+			}
+		}
+		clearAuthCookies(c)
 		return c.JSON(fiber.Map{"message": "Logout successful"})
 	}
 }
+
+// ForgotPassword godoc
+// @Summary Request password reset
+// @Description Email a single use password reset link to the user. The response is the same whether or not the email is registered.
+// @Tags authentication
+// @Accept json
+// @Produce json
+// @Param request body dto.ForgotPasswordRequest true "Account email"
+// @Success 200 {object} object{message=string} "Reset link sent if the account exists"
+// @Failure 400 {object} object{error=string} "Invalid request body"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/password/forgot [post]
+func ForgotPassword(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.ForgotPasswordRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Email == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email can't be empty"})
+		}
+		response := fiber.Map{"message": "If the email is registered, a reset link has been sent"}
+
+		var user models.User
+		if err := db.Where("email = ?", input.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				log.Printf("Password reset requested for unknown email: %v", input.Email)
+				return c.JSON(response)
+			}
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		token, err := utils.GenerateRandomToken(32)
+		if err != nil {
+			log.Printf("Error generating reset token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		ttl := utils.GetEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// only the latest link works
+			if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&models.PasswordResetToken{
+				UserID:    user.ID,
+				TokenHash: utils.HashToken(token),
+				ExpiresAt: time.Now().Add(ttl),
+			}).Error
+		})
+		if err != nil {
+			log.Printf("Error saving reset token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		link := utils.GetEnv("APP_URL", "http://localhost:5173") + "/reset-password?token=" + token
+		if err := mail.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: "Hi " + user.Name + ",\n\n" +
+				"Use the link below to choose a new password. It expires in " + ttl.String() + ".\n\n" +
+				link + "\n\n" +
+				"If you didn't ask for this, you can ignore this email.",
+		}); err != nil {
+			log.Printf("Error sending reset email: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// ResetPassword godoc
+// @Summary Confirm password reset
+// @Description Set a new password using the token from the reset email. The token can only be used once and every existing session of the user is logged out.
+// @Tags authentication
+// @Accept json
+// @Produce json
+// @Param request body dto.ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} object{message=string} "Password reset successful"
+// @Failure 400 {object} object{error=string} "Invalid request body, or invalid or expired token"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/password/reset [post]
+func ResetPassword(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.ResetPasswordRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Token == "" || input.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Token or password can't be empty"})
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		var resetToken models.PasswordResetToken
+		errInvalidToken := errors.New("invalid or expired reset token")
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("token_hash = ?", utils.HashToken(input.Token)).First(&resetToken).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return errInvalidToken
+				}
+				return err
+			}
+			if resetToken.UsedAt != nil || time.Now().After(resetToken.ExpiresAt) {
+				return errInvalidToken
+			}
+			result := tx.Model(&models.PasswordResetToken{}).
+				Where("id = ? AND used_at IS NULL", resetToken.ID).
+				Update("used_at", time.Now())
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errInvalidToken
+			}
+			if err := tx.Model(&models.User{}).Where("id = ?", resetToken.UserID).Update("password", string(hashedPassword)).Error; err != nil {
+				return err
+			}
+			// the link was mailed to the user, which proves they own the
+			// email, invited users finish their signup this way
+			return tx.Model(&models.User{}).
+				Where("id = ? AND email_verified = ?", resetToken.UserID, false).
+				Updates(map[string]any{"email_verified": true, "email_verified_at": time.Now()}).Error
+		})
+		if err != nil {
+			if errors.Is(err, errInvalidToken) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired reset token"})
+			}
+			log.Printf("Error resetting password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if err := revokeUserSessions(db, resetToken.UserID, 0, "password reset"); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionPasswordReset, TargetType: "user", TargetID: resetToken.UserID, ActorID: &resetToken.UserID})
+		clearAuthCookies(c)
+		return c.JSON(fiber.Map{"message": "Password reset successful"})
+	}
+}
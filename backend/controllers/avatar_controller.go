@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/imaging"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/storage"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// avatarSizes are the thumbnail sizes in pixels every avatar is stored in.
+var avatarSizes = []int{64, 128, 256}
+
+// avatarFilePattern matches the thumbnail file names in avatar URLs, see
+// avatarObjectKey.
+var avatarFilePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+-[0-9]+\.(jpg|png)$`)
+
+// avatarObjectKey is the storage key of one size of an avatar. The avatar key
+// is "avatars/<user id>/<random>.<ext>", so each upload gets new URLs and the
+// thumbnails can be cached forever.
+func avatarObjectKey(key string, size int) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "-" + strconv.Itoa(size) + ext
+}
+
+func avatarURLs(key string) map[string]string {
+	if key == "" {
+		return nil
+	}
+	urls := make(map[string]string, len(avatarSizes))
+	for _, size := range avatarSizes {
+		urls[strconv.Itoa(size)] = "/api/v1/" + avatarObjectKey(key, size)
+	}
+	return urls
+}
+
+// deleteAvatar removes every thumbnail of an avatar. Failures only leave
+// unreachable files behind, so they are logged.
+func deleteAvatar(store storage.Storage, key string) {
+	if key == "" {
+		return
+	}
+	for _, size := range avatarSizes {
+		if err := store.Delete(context.Background(), avatarObjectKey(key, size)); err != nil {
+			log.Printf("Error deleting avatar %s: %v", avatarObjectKey(key, size), err)
+		}
+	}
+}
+
+// storeAvatar scales the picture into every avatar size and stores them
+// under a new key, which is returned.
+func storeAvatar(ctx context.Context, store storage.Storage, userID uint, data []byte) (string, error) {
+	img, err := imaging.Decode(data, utils.GetEnvInt("AVATAR_MAX_DIMENSION", 4096))
+	if err != nil {
+		return "", err
+	}
+	square := imaging.Square(img)
+	format := imaging.FormatOf(square)
+	name, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	key := "avatars/" + strconv.FormatUint(uint64(userID), 10) + "/" + name + "." + format.Extension
+
+	for i, size := range avatarSizes {
+		thumbnail, err := imaging.Encode(imaging.Resize(square, size), format)
+		if err == nil {
+			err = store.Put(ctx, avatarObjectKey(key, size), bytes.NewReader(thumbnail), format.ContentType)
+		}
+		if err != nil {
+			for _, stored := range avatarSizes[:i] {
+				if err := store.Delete(ctx, avatarObjectKey(key, stored)); err != nil {
+					log.Printf("Error deleting avatar %s: %v", avatarObjectKey(key, stored), err)
+				}
+			}
+			return "", err
+		}
+	}
+	return key, nil
+}
+
+// UploadAvatar godoc
+// @Summary Upload my avatar
+// @Description Replace the avatar of the logged in user. The file has to be a JPEG, PNG or GIF of at most AVATAR_MAX_BYTES, whatever content type the client sends. The centered square is scaled to every thumbnail size, see avatar_urls in the response.
+// @Tags me
+// @Accept multipart/form-data
+// @Produce json
+// @Param avatar formData file true "Picture"
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 400 {object} object{error=string} "Missing or invalid picture"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 413 {object} object{error=string} "File or picture dimensions too large"
+// @Failure 415 {object} object{error=string} "Not a JPEG, PNG or GIF"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/avatar [put]
+func UploadAvatar(db *gorm.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		maxBytes := int64(utils.GetEnvInt("AVATAR_MAX_BYTES", 2<<20))
+		header, err := c.FormFile("avatar")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing avatar file"})
+		}
+		if header.Size > maxBytes {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Avatar can't be larger than " + strconv.FormatInt(maxBytes, 10) + " bytes"})
+		}
+		file, err := header.Open()
+		if err != nil {
+			log.Printf("Error opening uploaded file: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+		if err != nil {
+			log.Printf("Error reading uploaded file: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if int64(len(data)) > maxBytes {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Avatar can't be larger than " + strconv.FormatInt(maxBytes, 10) + " bytes"})
+		}
+		if _, err := imaging.Sniff(data); err != nil {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": "Avatar has to be a JPEG, PNG or GIF"})
+		}
+
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		before := toUserResponse(user)
+
+		key, err := storeAvatar(c.UserContext(), store, user.ID, data)
+		switch {
+		case errors.Is(err, imaging.ErrTooLarge):
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Avatar can't be wider or taller than " + strconv.Itoa(utils.GetEnvInt("AVATAR_MAX_DIMENSION", 4096)) + " pixels"})
+		case errors.Is(err, imaging.ErrInvalidImage):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid image"})
+		case err != nil:
+			log.Printf("Error storing avatar: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		oldKey := user.AvatarKey
+		if err := db.Model(&user).Update("avatar_key", key).Error; err != nil {
+			log.Printf("Error updating user in database: %v", err)
+			deleteAvatar(store, key)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		user.AvatarKey = key
+		deleteAvatar(store, oldKey)
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserUpdate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    audit.Diff(before, toUserResponse(user)),
+		})
+
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// DeleteAvatar godoc
+// @Summary Remove my avatar
+// @Description Remove the avatar of the logged in user
+// @Tags me
+// @Produce json
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/avatar [delete]
+func DeleteAvatar(db *gorm.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if user.AvatarKey != "" {
+			before := toUserResponse(user)
+			oldKey := user.AvatarKey
+			if err := db.Model(&user).Update("avatar_key", "").Error; err != nil {
+				log.Printf("Error updating user in database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			user.AvatarKey = ""
+			deleteAvatar(store, oldKey)
+			audit.Record(db, c, audit.Event{
+				Action:     audit.ActionUserUpdate,
+				TargetType: "user",
+				TargetID:   user.ID,
+				Changes:    audit.Diff(before, toUserResponse(user)),
+			})
+		}
+
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// GetAvatar godoc
+// @Summary Get an avatar
+// @Description Download an avatar thumbnail from the avatar_urls of a user. The file name is random and changes with every upload, so it can be cached forever and needs no authentication.
+// @Tags users
+// @Produce image/jpeg,image/png
+// @param userId path int true "User id"
+// @param file path string true "Thumbnail file name"
+// @Success 200 {file} binary
+// @Success 304 "Not modified"
+// @Failure 404 {object} object{error=string} "Avatar not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/avatars/:userId/:file [get]
+func GetAvatar(store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := strconv.ParseUint(c.Params("userId"), 10, 64)
+		if err != nil || !avatarFilePattern.MatchString(c.Params("file")) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Avatar not found"})
+		}
+		object, err := store.Get(c.UserContext(), "avatars/"+strconv.FormatUint(userID, 10)+"/"+c.Params("file"))
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Avatar not found"})
+			}
+			log.Printf("Error reading avatar from storage: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		c.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		if object.ETag != "" {
+			c.Set(fiber.HeaderETag, object.ETag)
+			if c.Get(fiber.HeaderIfNoneMatch) == object.ETag {
+				object.Body.Close()
+				return c.SendStatus(fiber.StatusNotModified)
+			}
+		}
+		c.Set(fiber.HeaderContentType, object.ContentType)
+		return c.SendStream(object.Body, int(object.Size))
+	}
+}
@@ -3,7 +3,9 @@ package controllers
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/aotsurasak46/user-management/dto"
 	"github.com/aotsurasak46/user-management/models"
@@ -12,12 +14,49 @@ import (
 	"gorm.io/gorm"
 )
 
-var clients = make(map[uint][]*websocket.Conn)
+// chatClient is one open chat socket, remembered together with the session
+// it was opened from so that revoking the session can close it.
+type chatClient struct {
+	conn      *websocket.Conn
+	sessionID uint
+}
+
+var clients = make(map[uint][]*chatClient)
 var mutex = &sync.Mutex{}
 
+// disconnectSession closes every chat socket opened from the given session.
+func disconnectSession(userID uint, sessionID uint) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, client := range clients[userID] {
+		if client.sessionID == sessionID {
+			closeChatConn(client.conn, "Session revoked")
+		}
+	}
+}
+
+// disconnectUser closes every chat socket of the user.
+func disconnectUser(userID uint, reason string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, client := range clients[userID] {
+		closeChatConn(client.conn, reason)
+	}
+}
+
+// closeChatConn tells the client why it is being disconnected and closes the
+// socket, the read loop of ChatSocketHandler then removes it from clients.
+func closeChatConn(conn *websocket.Conn, reason string) {
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		fmt.Println("Error sending close message:", err)
+	}
+	conn.Close()
+}
+
 // ChatSocketHandler godoc
 // @Summary WebSocket chat connection
-// @Description Upgrades to WebSocket for chat. After connection, let client send JSON messages.
+// @Description Upgrades to WebSocket for chat. After connection, let client send JSON messages. Messages can only be sent to members of a shared organization, others are answered with an "error" message.
 // @Tags chat
 // @Produce json
 // @Failure 401 {object} object{error=string} "Unauthorized"
@@ -32,16 +71,18 @@ func ChatSocketHandler(db *gorm.DB) fiber.Handler {
 			return
 		}
 
+		sessionID, _ := c.Locals("sessionID").(uint)
+
 		mutex.Lock()
-		clients[userID] = append(clients[userID], c)
+		clients[userID] = append(clients[userID], &chatClient{conn: c, sessionID: sessionID})
 		mutex.Unlock()
 		fmt.Printf("User %d connected\n", userID)
 
 		defer func() {
 			mutex.Lock()
 			connections := clients[userID]
-			for i, conn := range connections {
-				if conn == c {
+			for i, client := range connections {
+				if client.conn == c {
 					clients[userID] = append(connections[:i], connections[i+1:]...)
 					break
 				}
@@ -65,6 +106,22 @@ func ChatSocketHandler(db *gorm.DB) fiber.Handler {
 				continue
 			}
 
+			allowed, err := sharesOrganization(db, userID, requestMessage.To)
+			if err != nil {
+				fmt.Printf("Failed to check organizations: %v", err)
+				continue
+			}
+			if !allowed {
+				c.WriteJSON(map[string]any{
+					"type": "error",
+					"data": fiber.Map{
+						"error":  "You can only message members of your organizations",
+						"tempId": requestMessage.TempID,
+					},
+				})
+				continue
+			}
+
 			message := models.Message{
 				ToID:    requestMessage.To,
 				Content: requestMessage.Content,
@@ -95,8 +152,8 @@ func ChatSocketHandler(db *gorm.DB) fiber.Handler {
 			mutex.Lock()
 			if message.FromID != message.ToID {
 				if conns, ok := clients[message.ToID]; ok {
-					for _, conn := range conns {
-						err := conn.WriteJSON(map[string]any{
+					for _, client := range conns {
+						err := client.conn.WriteJSON(map[string]any{
 							"type": "incoming",
 							"data": message,
 						})
@@ -123,7 +180,9 @@ func ChatSocketHandler(db *gorm.DB) fiber.Handler {
 // @Success 200 {array}  dto.MessageResponse
 // @Failure 400 {object} object{error=string} "Bad request, User ID is missing in the request"
 // @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 403 {object} object{error=string} "User isn't a member of a shared organization"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/messages/:userId [get]
 func GetChatHistory(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -139,6 +198,18 @@ func GetChatHistory(db *gorm.DB) fiber.Handler {
 			fmt.Printf("User ID is missing in the request")
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User ID is required"})
 		}
+		otherID, err := strconv.ParseUint(toId, 10, 0)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid user ID"})
+		}
+		allowed, err := sharesOrganization(db, fromID, uint(otherID))
+		if err != nil {
+			log.Printf("Error checking organizations: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can only chat with members of your organizations"})
+		}
 
 		messages := new([]models.Message)
 		if err := db.Where(
@@ -162,6 +233,7 @@ func GetChatHistory(db *gorm.DB) fiber.Handler {
 // @Success 200 {array}  dto.ConversationResponse
 // @Failure 401 {object} object{error=string} "Unauthorized"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/conversations [get]
 func GetConversations(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -204,16 +276,13 @@ func GetConversations(db *gorm.DB) fiber.Handler {
 				log.Printf("Failed to fetch user %d: %v", otherUserID, err)
 				continue
 			}
+			// conversations with users who left every shared organization are hidden
+			if allowed, err := sharesOrganization(db, userId, otherUserID); err != nil || !allowed {
+				continue
+			}
 
 			conversations = append(conversations, dto.ConversationResponse{
-				User: dto.UserResponse{
-					ID:        otherUser.ID,
-					Name:      otherUser.Name,
-					Email:     otherUser.Email,
-					CreatedAt: otherUser.CreatedAt,
-					UpdatedAt: otherUser.UpdatedAt,
-					Role:      otherUser.Role,
-				},
+				User:        toUserResponse(otherUser),
 				LastMessage: msg.Content,
 				Timestamp:   msg.Timestamp,
 			})
@@ -221,4 +290,4 @@ func GetConversations(db *gorm.DB) fiber.Handler {
 
 		return c.JSON(conversations)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,422 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/storage"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dataExportStaleAfter is how long an export can be running before it is
+// taken to have died with its worker and is built again.
+const dataExportStaleAfter = 30 * time.Minute
+
+func toDataExportResponse(export models.DataExport) (dto.DataExportResponse, error) {
+	response := dto.DataExportResponse{
+		ID:          export.ID,
+		CreatedAt:   export.CreatedAt,
+		Status:      export.Status,
+		Size:        export.Size,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+	}
+	if export.Status == models.DataExportStatusReady {
+		token, err := utils.GenerateDataExportJWT(export.ID, utils.GetEnvDuration("DATA_EXPORT_LINK_TTL", 15*time.Minute))
+		if err != nil {
+			return response, err
+		}
+		response.DownloadURL = "/api/v1/exports/" + strconv.FormatUint(uint64(export.ID), 10) + "/download?token=" + token
+	}
+	return response, nil
+}
+
+// RequestDataExport godoc
+// @Summary Request a copy of my data
+// @Description Start building a zip with everything stored about the logged in user: profile.json, sessions.json, audit_events.json and messages.json. audit_events.json has the events about the user and, without their changes, the events the user caused. The export is built in the background, the user is mailed when it is ready and it can then be downloaded from the download_url of GET /api/v1/me/exports until it expires after DATA_EXPORT_TTL.
+// @Tags me
+// @Produce json
+// @Success 202 {object} dto.DataExportResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 409 {object} object{error=string} "An export is already being prepared"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/exports [post]
+func RequestDataExport(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+
+		var inProgress int64
+		err := db.Model(&models.DataExport{}).
+			Where("user_id = ? AND status IN ?", userID, []string{models.DataExportStatusPending, models.DataExportStatusRunning}).
+			Count(&inProgress).Error
+		if err != nil {
+			log.Printf("Error finding data exports in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if inProgress > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "An export is already being prepared"})
+		}
+
+		export := models.DataExport{UserID: userID, Status: models.DataExportStatusPending}
+		if err := db.Create(&export).Error; err != nil {
+			log.Printf("Error creating data export in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserDataExport, TargetType: "user", TargetID: userID})
+
+		response, err := toDataExportResponse(export)
+		if err != nil {
+			log.Printf("Error signing data export link: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.Status(fiber.StatusAccepted).JSON(response)
+	}
+}
+
+// GetDataExports godoc
+// @Summary List my data exports
+// @Description List the data exports of the logged in user, newest first. Ready exports come with a freshly signed download_url.
+// @Tags me
+// @Produce json
+// @Success 200 {array} dto.DataExportResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/exports [get]
+func GetDataExports(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var exports []models.DataExport
+		if err := db.Where("user_id = ?", c.Locals("userID")).Order("id DESC").Find(&exports).Error; err != nil {
+			log.Printf("Error finding data exports in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		responses := make([]dto.DataExportResponse, 0, len(exports))
+		for _, export := range exports {
+			response, err := toDataExportResponse(export)
+			if err != nil {
+				log.Printf("Error signing data export link: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			responses = append(responses, response)
+		}
+		return c.JSON(responses)
+	}
+}
+
+// DownloadDataExport godoc
+// @Summary Download a data export
+// @Description Download the zip of a ready data export through the signed download_url from GET /api/v1/me/exports. The link itself is the authorization, so it works without being logged in until it expires.
+// @Tags me
+// @Produce application/zip
+// @param id path int true "Data export id"
+// @param token query string true "Signature of the link"
+// @Success 200 {file} binary
+// @Failure 403 {object} object{error=string} "Invalid or expired link"
+// @Failure 404 {object} object{error=string} "Data export not found"
+// @Failure 410 {object} object{error=string} "Data export expired"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/exports/:id/download [get]
+func DownloadDataExport(db *gorm.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		exportID, err := utils.ParseDataExportJWT(c.Query("token"))
+		if err != nil || strconv.FormatUint(uint64(exportID), 10) != c.Params("id") {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid or expired link"})
+		}
+
+		var export models.DataExport
+		if err := db.First(&export, exportID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Data export not found"})
+			}
+			log.Printf("Error finding data export in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		switch {
+		case export.Status == models.DataExportStatusExpired,
+			export.Status == models.DataExportStatusReady && export.ExpiresAt != nil && !time.Now().Before(*export.ExpiresAt):
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Data export expired"})
+		case export.Status != models.DataExportStatusReady:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Data export not found"})
+		}
+
+		object, err := store.Get(c.UserContext(), export.ObjectKey)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Data export not found"})
+			}
+			log.Printf("Error reading data export from storage: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		c.Set(fiber.HeaderCacheControl, "private, no-store")
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Attachment("data-export-" + strconv.FormatUint(uint64(export.ID), 10) + ".zip")
+		return c.SendStream(object.Body, int(object.Size))
+	}
+}
+
+// RunDataExports builds pending data exports and removes the expired ones,
+// every few seconds until ctx is done.
+func RunDataExports(ctx context.Context, db *gorm.DB, store storage.Storage, mail mailer.Mailer) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		processDataExports(ctx, db, store, mail)
+		expireDataExports(db, store)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func processDataExports(ctx context.Context, db *gorm.DB, store storage.Storage, mail mailer.Mailer) {
+	for ctx.Err() == nil {
+		export, err := claimDataExport(db)
+		if err != nil {
+			log.Printf("Error claiming data export: %v", err)
+			return
+		}
+		if export == nil {
+			return
+		}
+		if err := completeDataExport(ctx, db, store, mail, export); err != nil {
+			log.Printf("Error building data export %d: %v", export.ID, err)
+			err := db.Model(export).Where("status = ?", models.DataExportStatusRunning).
+				Update("status", models.DataExportStatusFailed).Error
+			if err != nil {
+				log.Printf("Error updating data export in database: %v", err)
+			}
+		}
+	}
+}
+
+// claimDataExport marks the oldest pending export as running and returns it,
+// or nil when there is none. Locked rows are skipped so several replicas
+// don't build the same export.
+func claimDataExport(db *gorm.DB) (*models.DataExport, error) {
+	var export models.DataExport
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? OR (status = ? AND updated_at < ?)", models.DataExportStatusPending, models.DataExportStatusRunning, time.Now().Add(-dataExportStaleAfter)).
+			Order("id").
+			First(&export).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&export).Update("status", models.DataExportStatusRunning).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func completeDataExport(ctx context.Context, db *gorm.DB, store storage.Storage, mail mailer.Mailer, export *models.DataExport) error {
+	var user models.User
+	if err := db.First(&user, export.UserID).Error; err != nil {
+		return err
+	}
+	// the archive goes through a temporary file, the messages alone can be
+	// too large to hold in memory
+	file, err := os.CreateTemp("", "data-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := buildDataExport(db, &user, file); err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	name, err := utils.GenerateRandomToken(16)
+	if err != nil {
+		return err
+	}
+	key := "exports/" + strconv.FormatUint(uint64(user.ID), 10) + "/" + name + ".zip"
+	if err := store.Put(ctx, key, file, "application/zip"); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(utils.GetEnvDuration("DATA_EXPORT_TTL", 7*24*time.Hour))
+	result := db.Model(export).Where("status = ?", models.DataExportStatusRunning).Updates(map[string]any{
+		"status":       models.DataExportStatusReady,
+		"object_key":   key,
+		"size":         size,
+		"completed_at": now,
+		"expires_at":   expiresAt,
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// the user was purged meanwhile and the export with them
+		if err := store.Delete(context.Background(), key); err != nil {
+			log.Printf("Error deleting data export %s: %v", key, err)
+		}
+		return result.Error
+	}
+
+	if err := mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"The copy of your data you asked for is ready. Download it from your account before " + expiresAt.UTC().Format(time.RFC1123) + ", it is removed afterwards.",
+	}); err != nil {
+		log.Printf("Error sending data export email: %v", err)
+	}
+	return nil
+}
+
+// buildDataExport zips everything stored about the user into JSON files
+// written to w. Deleted sessions and messages are included, they are still
+// stored.
+func buildDataExport(db *gorm.DB, user *models.User, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	// every attribute, including the admin ones, is data about the user
+	view, err := selfAttributeView(db, user.ID)
+	if err != nil {
+		return err
+	}
+	view.admin = true
+	email, err := pendingEmail(db, user)
+	if err != nil {
+		return err
+	}
+	profile := dto.ProfileResponse{UserResponse: view.userResponse(*user), PendingEmail: email}
+	if err := writeDataExportFile(archive, "profile.json", profile); err != nil {
+		return err
+	}
+
+	var sessions []models.Session
+	if err := db.Unscoped().Where("user_id = ?", user.ID).Order("id").Find(&sessions).Error; err != nil {
+		return err
+	}
+	if err := writeDataExportFile(archive, "sessions.json", sessions); err != nil {
+		return err
+	}
+
+	var events []models.AuditEvent
+	targetID := strconv.FormatUint(uint64(user.ID), 10)
+	err = db.Where("actor_id = ? OR (target_type = ? AND target_id = ?)", user.ID, "user", targetID).
+		Order("id").
+		Find(&events).Error
+	if err != nil {
+		return err
+	}
+	eventResponses := make([]dto.AuditEventResponse, 0, len(events))
+	for _, event := range events {
+		// the changes of events about anything but the user, like the
+		// users they edited, hold the data of other people
+		if event.TargetType != "user" || event.TargetID != targetID {
+			event.Changes = ""
+		}
+		eventResponses = append(eventResponses, toAuditEventResponse(event))
+	}
+	if err := writeDataExportFile(archive, "audit_events.json", eventResponses); err != nil {
+		return err
+	}
+
+	if err := writeDataExportMessages(archive, db, user.ID); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeDataExportFile(archive *zip.Writer, name string, value any) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeDataExportMessages writes messages.json in batches, there can be a
+// lot of them.
+func writeDataExportMessages(archive *zip.Writer, db *gorm.DB, userID uint) error {
+	file, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, "["); err != nil {
+		return err
+	}
+	first := true
+	var messages []models.Message
+	err = db.Unscoped().Where("from_id = ? OR to_id = ?", userID, userID).Order("id").
+		FindInBatches(&messages, 500, func(tx *gorm.DB, batch int) error {
+			for _, message := range messages {
+				entry := dto.DataExportMessage{
+					ID:        message.ID,
+					FromID:    message.FromID,
+					ToID:      message.ToID,
+					Content:   message.Content,
+					Timestamp: message.Timestamp,
+				}
+				if message.DeletedAt.Valid {
+					entry.DeletedAt = &message.DeletedAt.Time
+				}
+				data, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+				if !first {
+					data = append([]byte(",\n"), data...)
+				}
+				first = false
+				if _, err := file.Write(data); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, "]\n")
+	return err
+}
+
+// expireDataExports removes the files of the exports that expired.
+func expireDataExports(db *gorm.DB, store storage.Storage) {
+	var exports []models.DataExport
+	err := db.Where("status = ? AND expires_at < ?", models.DataExportStatusReady, time.Now()).Find(&exports).Error
+	if err != nil {
+		log.Printf("Error finding expired data exports: %v", err)
+		return
+	}
+	for _, export := range exports {
+		if err := store.Delete(context.Background(), export.ObjectKey); err != nil {
+			log.Printf("Error deleting data export %s: %v", export.ObjectKey, err)
+			continue
+		}
+		err := db.Model(&export).Updates(map[string]any{"status": models.DataExportStatusExpired, "object_key": ""}).Error
+		if err != nil {
+			log.Printf("Error updating data export in database: %v", err)
+		}
+	}
+}
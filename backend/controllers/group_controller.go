@@ -0,0 +1,413 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func toGroupResponse(group models.Group) dto.GroupResponse {
+	// groups and roles hold permissions the same way
+	role := toRoleResponse(models.Role{Permissions: group.Permissions})
+	return dto.GroupResponse{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+		Permissions: role.Permissions,
+	}
+}
+
+func validGroupRole(role string) bool {
+	return role == models.GroupRoleAdmin || role == models.GroupRoleMember
+}
+
+// findGroup loads the :id group of the organization of the request.
+func findGroup(db *gorm.DB, c *fiber.Ctx) (*models.Group, error) {
+	var group models.Group
+	if err := db.WithContext(c.UserContext()).Preload("Permissions").First(&group, c.Params("id")).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// canManageGroup reports whether the caller has every permission the group
+// grants, which they need to change the permissions or who gets them.
+func canManageGroup(db *gorm.DB, c *fiber.Ctx, group *models.Group) (bool, error) {
+	permissions := make([]string, 0, len(group.Permissions))
+	for _, permission := range group.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+	return middleware.HasPermissions(db, c, permissions)
+}
+
+func groupError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Group not found"})
+	}
+	log.Printf("Error finding group in database: %v", err)
+	return c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// GetGroups godoc
+// @Summary List groups
+// @Description List the groups of the current organization with their permissions
+// @Tags groups
+// @Produce json
+// @Success 200 {array} dto.GroupResponse
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups [get]
+func GetGroups(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var groups []models.Group
+		if err := db.WithContext(c.UserContext()).Preload("Permissions").Order("name").Find(&groups).Error; err != nil {
+			log.Printf("Error getting groups from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.GroupResponse, 0, len(groups))
+		for _, group := range groups {
+			response = append(response, toGroupResponse(group))
+		}
+		return c.JSON(response)
+	}
+}
+
+// GetGroup godoc
+// @Summary Get group by id
+// @Description Get a group of the current organization with its permissions and members
+// @Tags groups
+// @Produce json
+// @param id path int true "Group id"
+// @Success 200 {object} dto.GroupResponse
+// @Failure 404 {object} object{error=string} "Group not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id [get]
+func GetGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+
+		var members []models.GroupMember
+		if err := db.Preload("User").
+			Joins("JOIN users ON users.id = group_members.user_id AND users.deleted_at IS NULL").
+			Where("group_members.group_id = ?", group.ID).
+			Order("group_members.created_at").
+			Find(&members).Error; err != nil {
+			log.Printf("Error finding group members in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		response := toGroupResponse(*group)
+		response.Members = make([]dto.MemberResponse, 0, len(members))
+		for _, member := range members {
+			response.Members = append(response.Members, dto.MemberResponse{
+				User:     toUserResponse(member.User),
+				Role:     member.Role,
+				JoinedAt: member.CreatedAt,
+			})
+		}
+		return c.JSON(response)
+	}
+}
+
+// CreateGroup godoc
+// @Summary Create a group
+// @Description Create a group in the current organization
+// @Tags groups
+// @Accept json
+// @Produce json
+// @Param group body dto.GroupRequest true "Group information"
+// @Success 201 {object} dto.GroupResponse
+// @Failure 400 {object} object{error=string} "Invalid request body or empty name"
+// @Failure 409 {object} object{error=string} "Group already exists"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups [post]
+func CreateGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.GroupRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Name = strings.TrimSpace(input.Name)
+		if input.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name can't be empty"})
+		}
+
+		group := &models.Group{
+			OrganizationID: *c.Locals("organizationID").(*uint),
+			Name:           input.Name,
+			Description:    input.Description,
+		}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(group)
+		if result.Error != nil {
+			log.Printf("Error creating group: %v", result.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Group already exists"})
+		}
+		return c.Status(fiber.StatusCreated).JSON(toGroupResponse(*group))
+	}
+}
+
+// UpdateGroup godoc
+// @Summary Update a group
+// @Description Rename a group or change its description (group admins only)
+// @Tags groups
+// @Accept json
+// @Produce json
+// @param id path int true "Group id"
+// @Param group body dto.GroupRequest true "Group information"
+// @Success 200 {object} dto.GroupResponse
+// @Failure 400 {object} object{error=string} "Invalid request body"
+// @Failure 404 {object} object{error=string} "Group not found"
+// @Failure 409 {object} object{error=string} "Group already exists"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id [put]
+func UpdateGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.GroupRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+
+		if name := strings.TrimSpace(input.Name); name != "" && name != group.Name {
+			var count int64
+			if err := db.Model(&models.Group{}).
+				Where("organization_id = ? AND name = ?", group.OrganizationID, name).
+				Count(&count).Error; err != nil {
+				log.Printf("Error finding group in database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			if count > 0 {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Group already exists"})
+			}
+			group.Name = name
+		}
+		group.Description = input.Description
+
+		if err := db.Model(group).Updates(map[string]any{"name": group.Name, "description": group.Description}).Error; err != nil {
+			log.Printf("Error updating group: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(toGroupResponse(*group))
+	}
+}
+
+// DeleteGroup godoc
+// @Summary Delete a group
+// @Description Delete a group, its members lose the permissions granted to it
+// @Tags groups
+// @Produce json
+// @param id path int true "Group id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Group not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id [delete]
+func DeleteGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+			return tx.Select("Permissions").Delete(group).Error
+		})
+		if err != nil {
+			log.Printf("Error deleting group: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Group deleted successfully"})
+	}
+}
+
+// SetGroupPermissions godoc
+// @Summary Set the permissions of a group
+// @Description Replace the permissions granted to the members of a group while they work in its organization. The caller needs the permissions the group has and the ones it gets.
+// @Tags groups
+// @Accept json
+// @Produce json
+// @param id path int true "Group id"
+// @Param permissions body dto.GroupPermissionsRequest true "Permissions"
+// @Success 200 {object} dto.GroupResponse
+// @Failure 400 {object} object{error=string} "Invalid request body or unknown permission"
+// @Failure 403 {object} object{error=string} "A permission the caller doesn't have"
+// @Failure 404 {object} object{error=string} "Group not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id/permissions [put]
+func SetGroupPermissions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.GroupPermissionsRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+
+		permissions, err := findPermissions(db, input.Permissions)
+		if err != nil {
+			var unknown errUnknownPermission
+			if errors.As(err, &unknown) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": unknown.Error()})
+			}
+			log.Printf("Error finding permissions in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if allowed, err := canManageGroup(db, c, group); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change a group with permissions you don't have"})
+		}
+		if allowed, err := middleware.HasPermissions(db, c, input.Permissions); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't grant permissions you don't have"})
+		}
+		before := toGroupResponse(*group)
+		if err := db.Model(group).Association("Permissions").Replace(permissions); err != nil {
+			log.Printf("Error updating group permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		group.Permissions = permissions
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionGroupPermissions,
+			TargetType: "group",
+			TargetID:   group.ID,
+			Changes:    audit.Diff(before, toGroupResponse(*group)),
+		})
+		return c.JSON(toGroupResponse(*group))
+	}
+}
+
+// AddGroupMember godoc
+// @Summary Add a member to a group
+// @Description Add a member of the current organization to a group (group admins only)
+// @Tags groups
+// @Accept json
+// @Produce json
+// @param id path int true "Group id"
+// @Param member body dto.GroupMemberAddRequest true "Member information"
+// @Success 201 {object} dto.MemberResponse
+// @Failure 400 {object} object{error=string} "Invalid request body or invalid role"
+// @Failure 404 {object} object{error=string} "Group or user not found"
+// @Failure 409 {object} object{error=string} "User is already a member"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id/members [post]
+func AddGroupMember(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.GroupMemberAddRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Role == "" {
+			input.Role = models.GroupRoleMember
+		}
+		if !validGroupRole(input.Role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
+		}
+
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+		// only members of the organization of the group can join it
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, input.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		member := models.GroupMember{GroupID: group.ID, UserID: user.ID, Role: input.Role}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member)
+		if result.Error != nil {
+			log.Printf("Error adding group member: %v", result.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "User is already a member"})
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionGroupMemberAdd,
+			TargetType: "group",
+			TargetID:   group.ID,
+			Changes:    map[string]audit.Change{"user_id": {After: user.ID}, "role": {After: member.Role}},
+		})
+		return c.Status(fiber.StatusCreated).JSON(dto.MemberResponse{
+			User:     toUserResponse(user),
+			Role:     member.Role,
+			JoinedAt: member.CreatedAt,
+		})
+	}
+}
+
+// RemoveGroupMember godoc
+// @Summary Remove a member from a group
+// @Description Remove a user from a group (group admins only)
+// @Tags groups
+// @Produce json
+// @param id path int true "Group id"
+// @param userId path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Group or member not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/groups/:id/members/:userId [delete]
+func RemoveGroupMember(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		group, err := findGroup(db, c)
+		if err != nil {
+			return groupError(c, err)
+		}
+		result := db.Where("group_id = ? AND user_id = ?", group.ID, c.Params("userId")).Delete(&models.GroupMember{})
+		if result.Error != nil {
+			log.Printf("Error removing group member: %v", result.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Member not found"})
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionGroupMemberRemove,
+			TargetType: "group",
+			TargetID:   group.ID,
+			Changes:    map[string]audit.Change{"user_id": {Before: c.Params("userId")}},
+		})
+		return c.JSON(fiber.Map{"message": "Member removed successfully"})
+	}
+}
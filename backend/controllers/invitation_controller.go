@@ -0,0 +1,518 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errInvalidInvitation = errors.New("invalid or expired invitation")
+
+func toInvitationResponse(invitation models.Invitation) dto.InvitationResponse {
+	return dto.InvitationResponse{
+		ID:               invitation.ID,
+		CreatedAt:        invitation.CreatedAt,
+		Email:            invitation.Email,
+		Role:             invitation.Role,
+		OrganizationRole: invitation.OrganizationRole,
+		Status:           invitation.Status(time.Now()),
+		InvitedBy:        invitation.InvitedBy,
+		SentAt:           invitation.SentAt,
+		ExpiresAt:        invitation.ExpiresAt,
+		AcceptedAt:       invitation.AcceptedAt,
+		UserID:           invitation.UserID,
+		RevokedAt:        invitation.RevokedAt,
+	}
+}
+
+// invitationStatusFilters select the invitations of a status, see
+// models.Invitation.Status.
+var invitationStatusFilters = map[string]string{
+	models.InvitationStatusPending:  "accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?",
+	models.InvitationStatusAccepted: "accepted_at IS NOT NULL",
+	models.InvitationStatusRevoked:  "accepted_at IS NULL AND revoked_at IS NOT NULL",
+	models.InvitationStatusExpired:  "accepted_at IS NULL AND revoked_at IS NULL AND expires_at <= ?",
+}
+
+// canManageInvitations reports whether the user may see and change every
+// invitation of the organization. Other members only see the ones they sent.
+func canManageInvitations(db *gorm.DB, c *fiber.Ctx) (bool, error) {
+	return middleware.HasPermission(db, c, models.PermissionUsersWrite)
+}
+
+// findInvitation loads the :id invitation of the organization of the request,
+// if the user may manage it.
+func findInvitation(db *gorm.DB, c *fiber.Ctx) (*models.Invitation, error) {
+	manage, err := canManageInvitations(db, c)
+	if err != nil {
+		return nil, err
+	}
+	query := db.WithContext(c.UserContext())
+	if !manage {
+		query = query.Where("invited_by = ?", c.Locals("userID"))
+	}
+	var invitation models.Invitation
+	if err := query.First(&invitation, c.Params("id")).Error; err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func invitationError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invitation not found"})
+	}
+	log.Printf("Error finding invitation in database: %v", err)
+	return c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// findInvitationByToken loads the invitation of a token, which has to be
+// pending.
+func findInvitationByToken(db *gorm.DB, token string) (*models.Invitation, error) {
+	var invitation models.Invitation
+	if err := db.Where("token_hash = ?", utils.HashToken(token)).First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errInvalidInvitation
+		}
+		return nil, err
+	}
+	if invitation.Status(time.Now()) != models.InvitationStatusPending {
+		return nil, errInvalidInvitation
+	}
+	return &invitation, nil
+}
+
+// issueInvitationToken gives the invitation a new token and expiry, earlier
+// links stop working. The token is returned to be mailed.
+func issueInvitationToken(invitation *models.Invitation) (string, error) {
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	invitation.TokenHash = utils.HashToken(token)
+	invitation.SentAt = now
+	invitation.ExpiresAt = now.Add(utils.GetEnvDuration("USER_INVITE_TTL", 72*time.Hour))
+	return token, nil
+}
+
+// sendInvitationEmail mails the invitee the link to accept the invitation.
+// Invitees who have an account by now are sent to JoinOrganization instead.
+func sendInvitationEmail(db *gorm.DB, mail mailer.Mailer, invitation *models.Invitation, token string) error {
+	var organization models.Organization
+	if err := db.First(&organization, invitation.OrganizationID).Error; err != nil {
+		return err
+	}
+	var inviter models.User
+	if err := db.Unscoped().First(&inviter, invitation.InvitedBy).Error; err != nil {
+		return err
+	}
+	var users int64
+	if err := db.Model(&models.User{}).Where("lower(email) = lower(?)", invitation.Email).Count(&users).Error; err != nil {
+		return err
+	}
+
+	if users > 0 {
+		link := utils.GetEnv("APP_URL", "http://localhost:5173") + "/join-organization?token=" + token
+		return mail.Send(mailer.Message{
+			To:      invitation.Email,
+			Subject: "You have been invited to " + organization.Name,
+			Body: "Hi,\n\n" +
+				inviter.Name + " invited you to join " + organization.Name + ". Log in with this email and open the link below to accept, or ignore this email to decline. It expires on " + invitation.ExpiresAt.UTC().Format(time.RFC1123) + ".\n\n" +
+				link,
+		})
+	}
+	link := utils.GetEnv("APP_URL", "http://localhost:5173") + "/accept-invitation?token=" + token
+	return mail.Send(mailer.Message{
+		To:      invitation.Email,
+		Subject: "You have been invited to " + organization.Name,
+		Body: "Hi,\n\n" +
+			inviter.Name + " invited you to join " + organization.Name + ". Open the link below to choose your name and password. It expires on " + invitation.ExpiresAt.UTC().Format(time.RFC1123) + ".\n\n" +
+			link,
+	})
+}
+
+// CreateInvitation godoc
+// @Summary Invite someone
+// @Description Mail an invitation to join the current organization to an email without an account. The invitee chooses their own name and password and gets the preset roles. Inviting requires users:write, or INVITATIONS_BY_MEMBERS for members inviting with the user role. The preset role can't have permissions the inviter doesn't have.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Param invitation body dto.InvitationCreateRequest true "Invitation"
+// @Success 201 {object} dto.InvitationResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, email or role"
+// @Failure 403 {object} object{error=string} "Not allowed to invite, or to preset these roles"
+// @Failure 409 {object} object{error=string} "Email already has an account or a pending invitation"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/invitations [post]
+func CreateInvitation(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.InvitationCreateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Email = strings.TrimSpace(input.Email)
+		if address, err := netmail.ParseAddress(input.Email); err != nil || address.Address != input.Email {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email"})
+		}
+		if input.Role == "" {
+			input.Role = "user"
+		}
+		if input.OrganizationRole == "" {
+			input.OrganizationRole = models.OrganizationRoleMember
+		}
+		if !validOrganizationRole(input.OrganizationRole) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid organization role"})
+		}
+
+		manage, err := canManageInvitations(db, c)
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !manage {
+			if !utils.GetEnvBool("INVITATIONS_BY_MEMBERS", false) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
+			}
+			if input.Role != "user" || input.OrganizationRole != models.OrganizationRoleMember {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Members can only invite with the user role"})
+			}
+		}
+		if valid, err := roleExists(db, input.Role); err != nil {
+			log.Printf("Error finding role in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !valid {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
+		}
+		if allowed, err := canAssignRole(db, c, input.Role); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't preset a role with permissions you don't have"})
+		}
+
+		var users int64
+		if err := db.Model(&models.User{}).Where("lower(email) = lower(?)", input.Email).Count(&users).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if users > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already has an account, add the user to the organization instead"})
+		}
+		var pending int64
+		if err := db.WithContext(c.UserContext()).Model(&models.Invitation{}).
+			Where("lower(email) = lower(?)", input.Email).
+			Where(invitationStatusFilters[models.InvitationStatusPending], time.Now()).
+			Count(&pending).Error; err != nil {
+			log.Printf("Error finding invitation in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if pending > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already has a pending invitation, resend it instead"})
+		}
+
+		invitation := &models.Invitation{
+			OrganizationID:   *c.Locals("organizationID").(*uint),
+			Email:            input.Email,
+			Role:             input.Role,
+			OrganizationRole: input.OrganizationRole,
+			InvitedBy:        c.Locals("userID").(uint),
+		}
+		token, err := issueInvitationToken(invitation)
+		if err != nil {
+			log.Printf("Error generating invitation token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Create(invitation).Error; err != nil {
+			log.Printf("Error creating invitation: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionInvitationCreate,
+			TargetType: "invitation",
+			TargetID:   invitation.ID,
+			Changes: map[string]audit.Change{
+				"email":             {After: invitation.Email},
+				"role":              {After: invitation.Role},
+				"organization_role": {After: invitation.OrganizationRole},
+			},
+		})
+		if err := sendInvitationEmail(db, mail, invitation, token); err != nil {
+			// the invitation can be resent, don't fail
+			log.Printf("Error sending invitation email: %v", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(toInvitationResponse(*invitation))
+	}
+}
+
+// GetInvitations godoc
+// @Summary List invitations
+// @Description List the invitations of the current organization, newest first. Users without users:write only see the invitations they sent.
+// @Tags invitations
+// @Produce json
+// @Param status query string false "pending, accepted, revoked, expired or all" default(pending)
+// @Success 200 {array} dto.InvitationResponse
+// @Failure 400 {object} object{error=string} "Invalid status"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/invitations [get]
+func GetInvitations(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		query := db.WithContext(c.UserContext()).Order("created_at DESC, id DESC")
+		status := c.Query("status", models.InvitationStatusPending)
+		if status != "all" {
+			filter, ok := invitationStatusFilters[status]
+			if !ok {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "status must be pending, accepted, revoked, expired or all"})
+			}
+			if strings.Contains(filter, "?") {
+				query = query.Where(filter, time.Now())
+			} else {
+				query = query.Where(filter)
+			}
+		}
+		manage, err := canManageInvitations(db, c)
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !manage {
+			query = query.Where("invited_by = ?", c.Locals("userID"))
+		}
+
+		var invitations []models.Invitation
+		if err := query.Find(&invitations).Error; err != nil {
+			log.Printf("Error getting invitations from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.InvitationResponse, 0, len(invitations))
+		for _, invitation := range invitations {
+			response = append(response, toInvitationResponse(invitation))
+		}
+		return c.JSON(response)
+	}
+}
+
+// ResendInvitation godoc
+// @Summary Resend an invitation
+// @Description Mail a pending or expired invitation again with a new link and expiry. The previous link stops working.
+// @Tags invitations
+// @Produce json
+// @param id path int true "Invitation id"
+// @Success 200 {object} dto.InvitationResponse
+// @Failure 404 {object} object{error=string} "Invitation not found"
+// @Failure 409 {object} object{error=string} "Invitation was accepted or revoked"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/invitations/:id/resend [post]
+func ResendInvitation(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		invitation, err := findInvitation(db, c)
+		if err != nil {
+			return invitationError(c, err)
+		}
+		if status := invitation.Status(time.Now()); status == models.InvitationStatusAccepted || status == models.InvitationStatusRevoked {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Invitation was " + status})
+		}
+
+		token, err := issueInvitationToken(invitation)
+		if err != nil {
+			log.Printf("Error generating invitation token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Model(invitation).Updates(map[string]any{
+			"token_hash": invitation.TokenHash,
+			"sent_at":    invitation.SentAt,
+			"expires_at": invitation.ExpiresAt,
+		}).Error; err != nil {
+			log.Printf("Error updating invitation: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := sendInvitationEmail(db, mail, invitation, token); err != nil {
+			log.Printf("Error sending invitation email: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionInvitationResend, TargetType: "invitation", TargetID: invitation.ID})
+		return c.JSON(toInvitationResponse(*invitation))
+	}
+}
+
+// RevokeInvitation godoc
+// @Summary Revoke an invitation
+// @Description Cancel an invitation that wasn't accepted, its link stops working
+// @Tags invitations
+// @Produce json
+// @param id path int true "Invitation id"
+// @Success 200 {object} dto.InvitationResponse
+// @Failure 404 {object} object{error=string} "Invitation not found"
+// @Failure 409 {object} object{error=string} "Invitation was accepted or revoked"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/invitations/:id [delete]
+func RevokeInvitation(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		invitation, err := findInvitation(db, c)
+		if err != nil {
+			return invitationError(c, err)
+		}
+		if status := invitation.Status(time.Now()); status == models.InvitationStatusAccepted || status == models.InvitationStatusRevoked {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Invitation was " + status})
+		}
+
+		now := time.Now()
+		result := db.Model(invitation).Where("accepted_at IS NULL AND revoked_at IS NULL").Update("revoked_at", now)
+		if result.Error != nil {
+			log.Printf("Error revoking invitation: %v", result.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if result.RowsAffected == 0 {
+			// accepted in the meantime
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Invitation was accepted"})
+		}
+		invitation.RevokedAt = &now
+		audit.Record(db, c, audit.Event{Action: audit.ActionInvitationRevoke, TargetType: "invitation", TargetID: invitation.ID})
+		return c.JSON(toInvitationResponse(*invitation))
+	}
+}
+
+// GetInvitationByToken godoc
+// @Summary Look up an invitation
+// @Description Show the invitee the email, organization and role of a pending invitation before they accept it
+// @Tags invitations
+// @Produce json
+// @Param token query string true "Token from the invitation email"
+// @Success 200 {object} dto.InvitationPreviewResponse
+// @Failure 404 {object} object{error=string} "Invalid or expired invitation"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/invitations/accept [get]
+func GetInvitationByToken(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		invitation, err := findInvitationByToken(db, c.Query("token"))
+		if err != nil {
+			if errors.Is(err, errInvalidInvitation) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+			}
+			log.Printf("Error finding invitation in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		var organization models.Organization
+		if err := db.First(&organization, invitation.OrganizationID).Error; err != nil {
+			log.Printf("Error finding organization in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(dto.InvitationPreviewResponse{
+			Email:        invitation.Email,
+			Organization: organization.Name,
+			Role:         invitation.Role,
+			ExpiresAt:    invitation.ExpiresAt,
+		})
+	}
+}
+
+// AcceptInvitation godoc
+// @Summary Accept an invitation
+// @Description Create the account of the invitee with their own name and password. The email counts as verified since the invitation was mailed to it, and the user joins the organization with the preset roles. The token can only be used once.
+// @Tags invitations
+// @Accept json
+// @Produce json
+// @Param request body dto.InvitationAcceptRequest true "Token, name and password"
+// @Success 201 {object} dto.UserResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, empty name or password, or invalid or expired invitation"
+// @Failure 409 {object} object{error=string} "Email already has an account, or the role no longer exists"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/invitations/accept [post]
+func AcceptInvitation(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.InvitationAcceptRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Name = strings.TrimSpace(input.Name)
+		if input.Token == "" || input.Name == "" || input.Password == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Token, name and password can't be empty"})
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		errEmailTaken := errors.New("email already has an account")
+		errRoleGone := errors.New("role no longer exists")
+		var invitation *models.Invitation
+		user := &models.User{Name: input.Name, Password: string(hashedPassword), EmailVerified: true}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if invitation, err = findInvitationByToken(tx.Clauses(clause.Locking{Strength: "UPDATE"}), input.Token); err != nil {
+				return err
+			}
+			var users int64
+			if err := tx.Model(&models.User{}).Where("lower(email) = lower(?)", invitation.Email).Count(&users).Error; err != nil {
+				return err
+			}
+			if users > 0 {
+				return errEmailTaken
+			}
+			if valid, err := roleExists(tx, invitation.Role); err != nil {
+				return err
+			} else if !valid {
+				return errRoleGone
+			}
+
+			now := time.Now()
+			user.Email = invitation.Email
+			user.Role = invitation.Role
+			user.EmailVerifiedAt = &now
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			if err := addMembership(tx, invitation.OrganizationID, user.ID, invitation.OrganizationRole); err != nil {
+				return err
+			}
+			return tx.Model(invitation).Updates(map[string]any{"accepted_at": now, "user_id": user.ID}).Error
+		})
+		switch {
+		case errors.Is(err, errInvalidInvitation):
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+		case errors.Is(err, errEmailTaken):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already has an account"})
+		case errors.Is(err, errRoleGone):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "The role of the invitation no longer exists, ask for a new invitation"})
+		case err != nil:
+			log.Printf("Error accepting invitation: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionInvitationAccept,
+			TargetType: "invitation",
+			TargetID:   invitation.ID,
+			ActorID:    &user.ID,
+			Changes:    map[string]audit.Change{"user_id": {After: user.ID}},
+		})
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserCreate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			ActorID:    &user.ID,
+			Changes:    audit.Diff(nil, toUserResponse(*user)),
+		})
+		return c.Status(fiber.StatusCreated).JSON(toUserResponse(*user))
+	}
+}
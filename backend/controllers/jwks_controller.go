@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"github.com/aotsurasak46/user-management/keyring"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetJWKS godoc
+// @Summary JSON Web Key Set
+// @Description Public keys that verify the access tokens issued by this server, for other services
+// @Tags authentication
+// @Produce json
+// @Success 200 {object} keyring.JSONWebKeySet
+// @Router /.well-known/jwks.json [get]
+func GetJWKS(kr *keyring.Keyring) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(kr.JWKS())
+	}
+}
@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// pendingEmail returns the email the user asked to change to and didn't
+// verify yet, if any.
+func pendingEmail(db *gorm.DB, user *models.User) (string, error) {
+	var verification models.EmailVerificationToken
+	err := db.Where("user_id = ? AND used_at IS NULL AND expires_at > ? AND email <> ?", user.ID, time.Now(), user.Email).
+		Order("created_at DESC").
+		First(&verification).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return verification.Email, err
+}
+
+func toProfileResponse(db *gorm.DB, user *models.User) (dto.ProfileResponse, error) {
+	view, err := selfAttributeView(db, user.ID)
+	if err != nil {
+		return dto.ProfileResponse{}, err
+	}
+	email, err := pendingEmail(db, user)
+	return dto.ProfileResponse{UserResponse: view.userResponse(*user), PendingEmail: email}, err
+}
+
+// GetMe godoc
+// @Summary Get my profile
+// @Description Get the logged in user with their public and private attributes, and the new email they asked for while it isn't verified
+// @Tags me
+// @Produce json
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me [get]
+func GetMe(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// UpdateMe godoc
+// @Summary Update my profile
+// @Description Change the name, email or public and private attributes of the logged in user. A new email only replaces the current one once it is verified through the link mailed to it. Users can't change their own role.
+// @Tags me
+// @Accept json
+// @Produce json
+// @Param profile body dto.ProfileUpdateRequest true "Name, email and attributes"
+// @Success 200 {object} dto.ProfileResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, empty name, invalid email or invalid attributes"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 403 {object} object{error=string} "Role can't be changed"
+// @Failure 409 {object} object{error=string} "Email or value of a unique attribute already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me [patch]
+func UpdateMe(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.ProfileUpdateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Role != nil {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change your own role"})
+		}
+
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		view, err := selfAttributeView(db, user.ID)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		before := view.userResponse(user)
+
+		if input.Name != nil {
+			name := strings.TrimSpace(*input.Name)
+			if name == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name can't be empty"})
+			}
+			user.Name = name
+		}
+		newEmail := ""
+		if input.Email != nil {
+			email := strings.TrimSpace(*input.Email)
+			if address, err := netmail.ParseAddress(email); err != nil || address.Address != email {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email"})
+			}
+			if !strings.EqualFold(email, user.Email) {
+				var users int64
+				if err := db.Model(&models.User{}).Where("lower(email) = lower(?)", email).Count(&users).Error; err != nil {
+					log.Printf("Error finding user in database: %v", err)
+					return c.SendStatus(fiber.StatusInternalServerError)
+				}
+				if users > 0 {
+					return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already exists"})
+				}
+				newEmail = email
+			}
+		}
+
+		if input.Attributes != nil {
+			attributes, err := view.merge(user.Attributes, input.Attributes, user.ID, false)
+			if err == nil {
+				err = view.checkUniqueAttributes(db, attributes, input.Attributes, user.ID)
+			}
+			if err != nil {
+				return attributeRequestError(c, err)
+			}
+			user.Attributes = attributes
+		}
+
+		if user.Name != before.Name || input.Attributes != nil {
+			if err := db.Model(&user).Select("name", "attributes").Updates(&user).Error; err != nil {
+				log.Printf("Error updating user in database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		changes := audit.Diff(before, view.userResponse(user))
+		if newEmail != "" {
+			if err := sendVerificationEmail(db, mail, &user, newEmail); err != nil {
+				log.Printf("Error sending verification email: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			if err := mail.Send(mailer.Message{
+				To:      user.Email,
+				Subject: "Your email is being changed",
+				Body: "Hi " + user.Name + ",\n\n" +
+					"A change of the email of your account to " + newEmail + " was requested. It takes effect once the new address is verified.\n\n" +
+					"If you didn't ask for this, change your password right away.",
+			}); err != nil {
+				log.Printf("Error sending email change notice: %v", err)
+			}
+			changes["pending_email"] = audit.Change{After: newEmail}
+		}
+		if len(changes) > 0 {
+			audit.Record(db, c, audit.Event{Action: audit.ActionUserUpdate, TargetType: "user", TargetID: user.ID, Changes: changes})
+		}
+
+		response, err := toProfileResponse(db, &user)
+		if err != nil {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
+
+// ChangePassword godoc
+// @Summary Change my password
+// @Description Change the password of the logged in user, which requires the current one. Every session is logged out and the current one is replaced by a new session.
+// @Tags me
+// @Accept json
+// @Produce json
+// @Param request body dto.ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} object{message=string} "Password changed"
+// @Failure 400 {object} object{error=string} "Invalid request body, empty password, wrong current password or unchanged password"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/me/password [post]
+func ChangePassword(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.ChangePasswordRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.CurrentPassword == "" || input.NewPassword == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Current and new password can't be empty"})
+		}
+
+		var user models.User
+		if err := db.First(&user, c.Locals("userID")).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Current password is incorrect"})
+			}
+			log.Printf("Error comparing hash password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if input.NewPassword == input.CurrentPassword {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "New password must be different from the current one"})
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Model(&user).Update("password", string(hashedPassword)).Error; err != nil {
+			log.Printf("Error updating user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// whoever else knew the old password is logged out, this client
+		// continues in a fresh session
+		if err := revokeUserSessions(db, user.ID, 0, "password change"); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		session, refreshToken, err := createSession(db, c, user.ID)
+		if err != nil {
+			log.Printf("Error creating session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if organizationID, _ := c.Locals("organizationID").(*uint); organizationID != nil {
+			// stay in the organization the old session was working in
+			if err := db.Model(session).Update("organization_id", *organizationID).Error; err != nil {
+				log.Printf("Error updating session organization: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		if err := setAuthCookies(c, session, refreshToken); err != nil {
+			log.Printf("Error generate JWT: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionPasswordChange, TargetType: "user", TargetID: user.ID})
+		return c.JSON(fiber.Map{"message": "Password changed"})
+	}
+}
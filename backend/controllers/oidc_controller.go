@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/oidc"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const oidcStateCookie = "oidc_state"
+
+var (
+	errOIDCEmailNotVerified = errors.New("email is not verified by the provider")
+	errOIDCSignupDisabled   = errors.New("signup is disabled for this provider")
+	errOIDCUserDeleted      = errors.New("linked user has been deleted")
+)
+
+// GetOIDCProviders godoc
+// @Summary List OpenID Connect providers
+// @Description List the names of the identity providers users can log in with
+// @Tags authentication
+// @Produce json
+// @Success 200 {array} string
+// @Router /api/v1/oidc/providers [get]
+func GetOIDCProviders(providers *oidc.Registry) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(providers.Names())
+	}
+}
+
+// OIDCLogin godoc
+// @Summary Start OpenID Connect login
+// @Description Redirect the browser to the identity provider using the authorization code flow with PKCE
+// @Tags authentication
+// @param provider path string true "Provider name"
+// @Success 302
+// @Failure 404 {object} object{error=string} "Unknown provider"
+// @Failure 502 {object} object{error=string} "Identity provider unavailable"
+// @Router /api/v1/oidc/:provider/login [get]
+func OIDCLogin(providers *oidc.Registry) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provider, ok := providers.Get(c.Params("provider"))
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown provider"})
+		}
+
+		var values [3]string
+		for i := range values {
+			value, err := utils.GenerateRandomToken(32)
+			if err != nil {
+				log.Printf("Error generating OIDC state: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			values[i] = value
+		}
+		state, nonce, verifier := values[0], values[1], values[2]
+
+		authURL, err := provider.AuthCodeURL(c.Context(), state, nonce, oidc.CodeChallenge(verifier))
+		if err != nil {
+			log.Printf("Error building OIDC authorization url: %v", err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Identity provider unavailable"})
+		}
+
+		// the state only has to survive the round trip to the provider
+		c.Cookie(&fiber.Cookie{
+			Name:     oidcStateCookie,
+			Value:    strings.Join([]string{provider.Name, state, nonce, verifier}, "."),
+			Expires:  time.Now().Add(10 * time.Minute),
+			HTTPOnly: true,
+			SameSite: "Lax",
+			Path:     "/api/v1/oidc",
+			Secure:   false,
+		})
+		return c.Redirect(authURL, fiber.StatusFound)
+	}
+}
+
+// OIDCCallback godoc
+// @Summary Finish OpenID Connect login
+// @Description Callback the identity provider redirects to. Verifies the ID token, links or provisions the user by verified email, starts a session and redirects to the app. Users with two factor authentication are redirected to /login/2fa of the app instead, with a challenge_token in the URL fragment for POST /api/v1/login/2fa.
+// @Tags authentication
+// @param provider path string true "Provider name"
+// @param code query string true "Authorization code"
+// @param state query string true "State"
+// @Success 302
+// @Failure 400 {object} object{error=string} "Invalid state or provider error"
+// @Failure 401 {object} object{error=string} "Invalid ID token"
+// @Failure 403 {object} object{error=string} "Email not verified, signup disabled, account deleted, suspended or banned"
+// @Failure 404 {object} object{error=string} "Unknown provider"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/oidc/:provider/callback [get]
+func OIDCCallback(db *gorm.DB, providers *oidc.Registry) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provider, ok := providers.Get(c.Params("provider"))
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown provider"})
+		}
+
+		stateCookie := c.Cookies(oidcStateCookie)
+		c.Cookie(&fiber.Cookie{
+			Name:     oidcStateCookie,
+			Value:    "",
+			Expires:  time.Now().Add(-time.Hour),
+			HTTPOnly: true,
+			Path:     "/api/v1/oidc",
+		})
+		parts := strings.Split(stateCookie, ".")
+		if len(parts) != 4 || parts[0] != provider.Name || parts[1] != c.Query("state") {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid state"})
+		}
+		nonce, verifier := parts[2], parts[3]
+
+		if providerError := c.Query("error"); providerError != "" {
+			log.Printf("OIDC provider %s returned error: %s %s", provider.Name, providerError, c.Query("error_description"))
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Login was cancelled or failed at the identity provider"})
+		}
+		code := c.Query("code")
+		if code == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Authorization code is required"})
+		}
+
+		claims, err := provider.Exchange(c.Context(), code, verifier, nonce)
+		if err != nil {
+			log.Printf("Error exchanging OIDC code: %v", err)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid ID token"})
+		}
+
+		user, err := findOrProvisionOIDCUser(db, provider, claims)
+		if err != nil {
+			switch {
+			case errors.Is(err, errOIDCEmailNotVerified):
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Email is not verified by the identity provider"})
+			case errors.Is(err, errOIDCSignupDisabled):
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No account exists for this email"})
+			case errors.Is(err, errOIDCUserDeleted):
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Account has been deleted"})
+			}
+			log.Printf("Error linking OIDC user: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if user.Blocked(time.Now()) {
+			return middleware.RejectBlockedUser(c, user)
+		}
+		if user.TwoFactorEnabled {
+			// the identity provider only replaces the password, the code is
+			// still asked for through POST /api/v1/login/2fa. The challenge
+			// goes in the fragment so it never reaches a server log.
+			challengeToken, err := utils.GenerateChallengeJWT(user.ID)
+			if err != nil {
+				log.Printf("Error generate JWT: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			return c.Redirect(utils.GetEnv("APP_URL", "http://localhost:5173")+"/login/2fa#challenge_token="+challengeToken, fiber.StatusFound)
+		}
+
+		session, refreshToken, err := createSession(db, c, user.ID)
+		if err != nil {
+			log.Printf("Error creating session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := setAuthCookies(c, session, refreshToken); err != nil {
+			log.Printf("Error generate JWT: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionLogin, TargetType: "session", TargetID: session.ID, ActorID: &user.ID})
+		return c.Redirect(utils.GetEnv("APP_URL", "http://localhost:5173")+"/", fiber.StatusFound)
+	}
+}
+
+// findOrProvisionOIDCUser returns the user linked to the provider account.
+// An account seen for the first time is linked to the user with the same
+// verified email, or a new user is created for it.
+func findOrProvisionOIDCUser(db *gorm.DB, provider *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	var identity models.UserIdentity
+	err := db.Preload("User").Where("provider = ? AND subject = ?", provider.Name, claims.Subject).First(&identity).Error
+	if err == nil {
+		if identity.User.ID == 0 {
+			return nil, errOIDCUserDeleted
+		}
+		return &identity.User, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errOIDCEmailNotVerified
+	}
+
+	var user models.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("email = ?", claims.Email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if !provider.AllowSignup {
+				return errOIDCSignupDisabled
+			}
+			// the account can only be used through the provider until the
+			// user resets their password
+			password, err := utils.GenerateRandomToken(32)
+			if err != nil {
+				return err
+			}
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			name := claims.Name
+			if name == "" {
+				name = claims.Email
+			}
+			now := time.Now()
+			user = models.User{
+				Name:            name,
+				Email:           claims.Email,
+				Password:        string(hashedPassword),
+				EmailVerified:   true,
+				EmailVerifiedAt: &now,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if err := joinDefaultOrganization(tx, user.ID); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if !user.EmailVerified {
+			now := time.Now()
+			if err := tx.Model(&user).Updates(map[string]any{"email_verified": true, "email_verified_at": now}).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: provider.Name,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,549 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var slugSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// addMembership puts the user in the organization, keeping the role they
+// already have when they are a member.
+func addMembership(db *gorm.DB, organizationID uint, userID uint, role string) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Membership{
+		OrganizationID: organizationID,
+		UserID:         userID,
+		Role:           role,
+	}).Error
+}
+
+// joinDefaultOrganization adds a self registered user to the default
+// organization.
+func joinDefaultOrganization(db *gorm.DB, userID uint) error {
+	var organization models.Organization
+	if err := db.Where("slug = ?", models.DefaultOrganizationSlug).First(&organization).Error; err != nil {
+		return err
+	}
+	return addMembership(db, organization.ID, userID, models.OrganizationRoleMember)
+}
+
+// firstOrganizationID is the organization a new session starts in, the one
+// the user joined first.
+func firstOrganizationID(db *gorm.DB, userID uint) *uint {
+	var membership models.Membership
+	if err := db.Where("user_id = ?", userID).Order("created_at").First(&membership).Error; err != nil {
+		return nil
+	}
+	return &membership.OrganizationID
+}
+
+// sharesOrganization reports whether two users are members of at least one
+// common organization, which they need to be to chat.
+func sharesOrganization(db *gorm.DB, userID uint, otherUserID uint) (bool, error) {
+	if userID == otherUserID {
+		return true, nil
+	}
+	var count int64
+	err := db.Model(&models.Membership{}).
+		Where("user_id = ? AND organization_id IN (?)", userID,
+			db.Model(&models.Membership{}).Select("organization_id").Where("user_id = ?", otherUserID)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func validOrganizationRole(role string) bool {
+	return role == models.OrganizationRoleAdmin || role == models.OrganizationRoleMember
+}
+
+// uniqueSlug turns the name into a slug, adding a random suffix when it is
+// already taken.
+func uniqueSlug(db *gorm.DB, name string) (string, error) {
+	slug := strings.Trim(slugSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		slug = "organization"
+	}
+	var count int64
+	if err := db.Unscoped().Model(&models.Organization{}).Where("slug = ?", slug).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return slug, nil
+	}
+	suffix, err := utils.GenerateRandomToken(4)
+	if err != nil {
+		return "", err
+	}
+	return slug + "-" + strings.ToLower(suffix), nil
+}
+
+// GetMyOrganizations godoc
+// @Summary List my organizations
+// @Description List the organizations the logged in user is a member of, with their role in each
+// @Tags organizations
+// @Produce json
+// @Success 200 {array} dto.OrganizationResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations [get]
+func GetMyOrganizations(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var memberships []models.Membership
+		if err := db.Preload("Organization").
+			Where("user_id = ?", c.Locals("userID")).
+			Order("created_at").
+			Find(&memberships).Error; err != nil {
+			log.Printf("Error finding memberships in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		activeID, _ := c.Locals("organizationID").(*uint)
+		response := make([]dto.OrganizationResponse, 0, len(memberships))
+		for _, membership := range memberships {
+			response = append(response, dto.OrganizationResponse{
+				ID:     membership.OrganizationID,
+				Name:   membership.Organization.Name,
+				Slug:   membership.Organization.Slug,
+				Role:   membership.Role,
+				Active: activeID != nil && *activeID == membership.OrganizationID,
+			})
+		}
+		return c.JSON(response)
+	}
+}
+
+// CreateOrganization godoc
+// @Summary Create an organization
+// @Description Create an organization with the logged in user as its admin. Requires organizations:create.
+// @Tags organizations
+// @Accept json
+// @Produce json
+// @Param organization body dto.OrganizationCreateRequest true "Organization information"
+// @Success 201 {object} dto.OrganizationResponse
+// @Failure 400 {object} object{error=string} "Invalid request body or empty name"
+// @Failure 403 {object} object{error=string} "Permission denied"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations [post]
+func CreateOrganization(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.OrganizationCreateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Name = strings.TrimSpace(input.Name)
+		if input.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name can't be empty"})
+		}
+
+		var organization models.Organization
+		err := db.Transaction(func(tx *gorm.DB) error {
+			slug, err := uniqueSlug(tx, input.Name)
+			if err != nil {
+				return err
+			}
+			organization = models.Organization{Name: input.Name, Slug: slug}
+			if err := tx.Create(&organization).Error; err != nil {
+				return err
+			}
+			return addMembership(tx, organization.ID, c.Locals("userID").(uint), models.OrganizationRoleAdmin)
+		})
+		if err != nil {
+			log.Printf("Error creating organization: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(dto.OrganizationResponse{
+			ID:   organization.ID,
+			Name: organization.Name,
+			Slug: organization.Slug,
+			Role: models.OrganizationRoleAdmin,
+		})
+	}
+}
+
+// SwitchOrganization godoc
+// @Summary Switch organization
+// @Description Make the organization the one the current session works in. User queries only return its members afterwards.
+// @Tags organizations
+// @Produce json
+// @param id path int true "Organization id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Organization not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/:id/switch [post]
+func SwitchOrganization(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		membership := c.Locals("membership").(models.Membership)
+		if err := db.Model(&models.Session{}).
+			Where("id = ?", c.Locals("sessionID")).
+			Update("organization_id", membership.OrganizationID).Error; err != nil {
+			log.Printf("Error switching session organization: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Organization switched successfully"})
+	}
+}
+
+// GetOrganizationMembers godoc
+// @Summary List members of an organization
+// @Description List the members of an organization the logged in user belongs to
+// @Tags organizations
+// @Produce json
+// @param id path int true "Organization id"
+// @Success 200 {array} dto.MemberResponse
+// @Failure 404 {object} object{error=string} "Organization not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/:id/members [get]
+func GetOrganizationMembers(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var memberships []models.Membership
+		if err := db.Preload("User").
+			Joins("JOIN users ON users.id = memberships.user_id AND users.deleted_at IS NULL").
+			Where("memberships.organization_id = ?", c.Params("id")).
+			Order("memberships.created_at").
+			Find(&memberships).Error; err != nil {
+			log.Printf("Error finding members in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.MemberResponse, 0, len(memberships))
+		for _, membership := range memberships {
+			response = append(response, toMemberResponse(membership))
+		}
+		return c.JSON(response)
+	}
+}
+
+func toMemberResponse(membership models.Membership) dto.MemberResponse {
+	return dto.MemberResponse{
+		User:     toUserResponse(membership.User),
+		Role:     membership.Role,
+		JoinedAt: membership.CreatedAt,
+	}
+}
+
+// AddOrganizationMember godoc
+// @Summary Invite a user to an organization
+// @Description Invite an existing user to the organization by email (organization admins only). They are mailed a link and only join once they accept it, see JoinOrganization. The answer is the same whether the email has an account, is already a member or was already invited, so it can't be used to find out who has an account.
+// @Tags organizations
+// @Accept json
+// @Produce json
+// @param id path int true "Organization id"
+// @Param member body dto.MemberAddRequest true "Member information"
+// @Success 202 {object} object{message=string}
+// @Failure 400 {object} object{error=string} "Invalid request body, email or role"
+// @Failure 404 {object} object{error=string} "Organization not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/:id/members [post]
+func AddOrganizationMember(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.MemberAddRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Email = strings.TrimSpace(input.Email)
+		if address, err := netmail.ParseAddress(input.Email); err != nil || address.Address != input.Email {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid email"})
+		}
+		if input.Role == "" {
+			input.Role = models.OrganizationRoleMember
+		}
+		if !validOrganizationRole(input.Role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
+		}
+
+		response := fiber.Map{"message": "If the email belongs to a user who isn't a member yet, they were invited to join the organization"}
+		organizationID := c.Locals("membership").(models.Membership).OrganizationID
+		var user models.User
+		if err := db.Where("lower(email) = lower(?)", input.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusAccepted).JSON(response)
+			}
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		var members int64
+		if err := db.Model(&models.Membership{}).Where("organization_id = ? AND user_id = ?", organizationID, user.ID).Count(&members).Error; err != nil {
+			log.Printf("Error finding membership in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		var pending int64
+		if err := db.Model(&models.Invitation{}).
+			Where("organization_id = ? AND lower(email) = lower(?)", organizationID, user.Email).
+			Where(invitationStatusFilters[models.InvitationStatusPending], time.Now()).
+			Count(&pending).Error; err != nil {
+			log.Printf("Error finding invitation in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if members > 0 || pending > 0 {
+			return c.Status(fiber.StatusAccepted).JSON(response)
+		}
+
+		// existing users keep their global role, only the organization role
+		// is preset
+		invitation := &models.Invitation{
+			OrganizationID:   organizationID,
+			Email:            user.Email,
+			OrganizationRole: input.Role,
+			InvitedBy:        c.Locals("userID").(uint),
+		}
+		token, err := issueInvitationToken(invitation)
+		if err != nil {
+			log.Printf("Error generating invitation token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Create(invitation).Error; err != nil {
+			log.Printf("Error creating invitation: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionInvitationCreate,
+			TargetType: "invitation",
+			TargetID:   invitation.ID,
+			Changes: map[string]audit.Change{
+				"user_id":           {After: user.ID},
+				"organization_role": {After: invitation.OrganizationRole},
+			},
+		})
+		if err := sendInvitationEmail(db, mail, invitation, token); err != nil {
+			// the invitation can be resent, don't fail
+			log.Printf("Error sending invitation email: %v", err)
+		}
+		return c.Status(fiber.StatusAccepted).JSON(response)
+	}
+}
+
+// JoinOrganization godoc
+// @Summary Join an organization
+// @Description Accept an invitation mailed to the email of the logged in user, who joins the organization with the preset organization role. The global role preset on invitations of new users isn't applied. The token can only be used once.
+// @Tags organizations
+// @Accept json
+// @Produce json
+// @Param request body dto.OrganizationJoinRequest true "Token from the invitation email"
+// @Success 200 {object} dto.OrganizationResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, or invalid or expired invitation"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/join [post]
+func JoinOrganization(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.OrganizationJoinRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		userID := c.Locals("userID").(uint)
+		var invitation *models.Invitation
+		var membership models.Membership
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			if invitation, err = findInvitationByToken(tx.Clauses(clause.Locking{Strength: "UPDATE"}), input.Token); err != nil {
+				return err
+			}
+			var user models.User
+			if err := tx.First(&user, userID).Error; err != nil {
+				return err
+			}
+			// the link only works for the account it was mailed to
+			if !strings.EqualFold(user.Email, invitation.Email) {
+				return errInvalidInvitation
+			}
+			if err := addMembership(tx, invitation.OrganizationID, userID, invitation.OrganizationRole); err != nil {
+				return err
+			}
+			if err := tx.Model(invitation).Updates(map[string]any{"accepted_at": time.Now(), "user_id": userID}).Error; err != nil {
+				return err
+			}
+			return tx.Preload("Organization").
+				Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, userID).
+				First(&membership).Error
+		})
+		if err != nil {
+			if errors.Is(err, errInvalidInvitation) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+			}
+			log.Printf("Error joining organization: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionInvitationAccept,
+			TargetType: "invitation",
+			TargetID:   invitation.ID,
+			Changes:    map[string]audit.Change{"user_id": {After: userID}},
+		})
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionOrganizationMemberAdd,
+			TargetType: "organization",
+			TargetID:   membership.OrganizationID,
+			Changes:    map[string]audit.Change{"user_id": {After: userID}, "role": {After: membership.Role}},
+		})
+		activeID, _ := c.Locals("organizationID").(*uint)
+		return c.JSON(dto.OrganizationResponse{
+			ID:     membership.OrganizationID,
+			Name:   membership.Organization.Name,
+			Slug:   membership.Organization.Slug,
+			Role:   membership.Role,
+			Active: activeID != nil && *activeID == membership.OrganizationID,
+		})
+	}
+}
+
+// UpdateOrganizationMember godoc
+// @Summary Change the role of a member
+// @Description Change the role of a member of the organization (organization admins only). The last admin can't be demoted.
+// @Tags organizations
+// @Accept json
+// @Produce json
+// @param id path int true "Organization id"
+// @param userId path int true "User id"
+// @Param member body dto.MemberUpdateRequest true "Member information"
+// @Success 200 {object} dto.MemberResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, invalid role or last admin"
+// @Failure 404 {object} object{error=string} "Organization or member not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/:id/members/:userId [put]
+func UpdateOrganizationMember(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.MemberUpdateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if !validOrganizationRole(input.Role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
+		}
+
+		var membership models.Membership
+		var previousRole string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := findMemberForUpdate(tx, c, &membership); err != nil {
+				return err
+			}
+			if membership.Role == models.OrganizationRoleAdmin && input.Role != models.OrganizationRoleAdmin {
+				if err := ensureAnotherAdmin(tx, membership); err != nil {
+					return err
+				}
+			}
+			previousRole = membership.Role
+			membership.Role = input.Role
+			return tx.Model(&membership).Update("role", input.Role).Error
+		})
+		if err != nil {
+			return memberError(c, err)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionOrganizationMemberUpdate,
+			TargetType: "organization",
+			TargetID:   membership.OrganizationID,
+			Changes:    map[string]audit.Change{"user_id": {Before: membership.UserID, After: membership.UserID}, "role": {Before: previousRole, After: membership.Role}},
+		})
+		return c.JSON(toMemberResponse(membership))
+	}
+}
+
+// RemoveOrganizationMember godoc
+// @Summary Remove a member from an organization
+// @Description Remove a user from the organization (organization admins only). The last admin can't be removed.
+// @Tags organizations
+// @Produce json
+// @param id path int true "Organization id"
+// @param userId path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string} "Last admin"
+// @Failure 404 {object} object{error=string} "Organization or member not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/organizations/:id/members/:userId [delete]
+func RemoveOrganizationMember(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var membership models.Membership
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := findMemberForUpdate(tx, c, &membership); err != nil {
+				return err
+			}
+			if membership.Role == models.OrganizationRoleAdmin {
+				if err := ensureAnotherAdmin(tx, membership); err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("user_id = ? AND group_id IN (?)", membership.UserID,
+				tx.Model(&models.Group{}).Select("id").Where("organization_id = ?", membership.OrganizationID)).
+				Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&membership).Error
+		})
+		if err != nil {
+			return memberError(c, err)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionOrganizationMemberRemove,
+			TargetType: "organization",
+			TargetID:   membership.OrganizationID,
+			Changes:    map[string]audit.Change{"user_id": {Before: membership.UserID}, "role": {Before: membership.Role}},
+		})
+		return c.JSON(fiber.Map{"message": "Member removed successfully"})
+	}
+}
+
+var errLastOrganizationAdmin = errors.New("last organization admin")
+
+// findMemberForUpdate locks the membership of the :userId user in the
+// organization of the request.
+func findMemberForUpdate(tx *gorm.DB, c *fiber.Ctx, membership *models.Membership) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("User").
+		Where("organization_id = ? AND user_id = ?", c.Locals("membership").(models.Membership).OrganizationID, c.Params("userId")).
+		First(membership).Error
+}
+
+// ensureAnotherAdmin keeps organizations from losing their last admin, who
+// is the only one able to manage the members. The admins are locked so two
+// admins can't demote each other at the same time.
+func ensureAnotherAdmin(tx *gorm.DB, membership models.Membership) error {
+	var admins []models.Membership
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("organization_id = ? AND role = ? AND id <> ?", membership.OrganizationID, models.OrganizationRoleAdmin, membership.ID).
+		Find(&admins).Error; err != nil {
+		return err
+	}
+	if len(admins) == 0 {
+		return errLastOrganizationAdmin
+	}
+	return nil
+}
+
+func memberError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Member not found"})
+	case errors.Is(err, errLastOrganizationAdmin):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "An organization needs at least one admin"})
+	default:
+		log.Printf("Error updating member: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+}
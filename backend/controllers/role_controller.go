@@ -0,0 +1,333 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func toRoleResponse(role models.Role) dto.RoleResponse {
+	permissions := make([]string, 0, len(role.Permissions))
+	for _, permission := range role.Permissions {
+		permissions = append(permissions, permission.Name)
+	}
+	slices.Sort(permissions)
+	return dto.RoleResponse{
+		ID:          role.ID,
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: permissions,
+	}
+}
+
+// roleExists reports whether users can be given the role.
+func roleExists(db *gorm.DB, name string) (bool, error) {
+	var count int64
+	err := db.Model(&models.Role{}).Where("name = ?", name).Count(&count).Error
+	return count > 0, err
+}
+
+// canAssignRole reports whether the caller may give the role to a user. They
+// need every permission of the role themselves, otherwise users:write would
+// let them hand out more than they have, up to the admin role.
+func canAssignRole(db *gorm.DB, c *fiber.Ctx, role string) (bool, error) {
+	var permissions []string
+	err := db.Table("permissions").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN roles ON roles.id = role_permissions.role_id").
+		Where("roles.name = ?", role).
+		Pluck("permissions.name", &permissions).Error
+	if err != nil {
+		return false, err
+	}
+	return middleware.HasPermissions(db, c, permissions)
+}
+
+// findPermissions loads the permissions with the given names, failing when
+// one of them doesn't exist.
+func findPermissions(db *gorm.DB, names []string) ([]models.Permission, error) {
+	var permissions []models.Permission
+	if len(names) == 0 {
+		return permissions, nil
+	}
+	if err := db.Where("name IN ?", names).Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(permissions, func(p models.Permission) bool { return p.Name == name }) {
+			return nil, errUnknownPermission{name}
+		}
+	}
+	return permissions, nil
+}
+
+type errUnknownPermission struct {
+	name string
+}
+
+func (e errUnknownPermission) Error() string {
+	return "Unknown permission: " + e.name
+}
+
+// GetPermissions godoc
+// @Summary List permissions
+// @Description List every permission that can be granted to a role
+// @Tags roles
+// @Produce json
+// @Success 200 {array} models.Permission
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/permissions [get]
+func GetPermissions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var permissions []models.Permission
+		if err := db.Order("name").Find(&permissions).Error; err != nil {
+			log.Printf("Error getting permissions from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(permissions)
+	}
+}
+
+// GetRoles godoc
+// @Summary List roles
+// @Description List the roles users can be given, with their permissions
+// @Tags roles
+// @Produce json
+// @Success 200 {array} dto.RoleResponse
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/roles [get]
+func GetRoles(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var roles []models.Role
+		if err := db.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+			log.Printf("Error getting roles from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.RoleResponse, 0, len(roles))
+		for _, role := range roles {
+			response = append(response, toRoleResponse(role))
+		}
+		return c.JSON(response)
+	}
+}
+
+// CreateRole godoc
+// @Summary Create a role
+// @Description Create a role with the given permissions, which the caller needs to have themselves
+// @Tags roles
+// @Accept json
+// @Produce json
+// @Param role body dto.RoleCreateRequest true "Role information"
+// @Success 201 {object} dto.RoleResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, empty name or unknown permission"
+// @Failure 403 {object} object{error=string} "A permission the caller doesn't have"
+// @Failure 409 {object} object{error=string} "Role already exists"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/roles [post]
+func CreateRole(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.RoleCreateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Name = strings.ToLower(strings.TrimSpace(input.Name))
+		if input.Name == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name can't be empty"})
+		}
+
+		exists, err := roleExists(db, input.Name)
+		if err != nil {
+			log.Printf("Error finding role in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if exists {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Role already exists"})
+		}
+
+		permissions, err := findPermissions(db, input.Permissions)
+		if err != nil {
+			var unknown errUnknownPermission
+			if errors.As(err, &unknown) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": unknown.Error()})
+			}
+			log.Printf("Error finding permissions in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if allowed, err := middleware.HasPermissions(db, c, input.Permissions); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't grant permissions you don't have"})
+		}
+
+		role := models.Role{
+			Name:        input.Name,
+			Description: input.Description,
+			Permissions: permissions,
+		}
+		if err := db.Create(&role).Error; err != nil {
+			log.Printf("Error creating role: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionRoleCreate,
+			TargetType: "role",
+			TargetID:   role.Name,
+			Changes:    audit.Diff(nil, toRoleResponse(role)),
+		})
+		return c.Status(fiber.StatusCreated).JSON(toRoleResponse(role))
+	}
+}
+
+// UpdateRole godoc
+// @Summary Update a role
+// @Description Replace the description and permissions of a role. The caller needs the permissions the role has and the ones it gets. The change applies to every user with the role on their next request.
+// @Tags roles
+// @Accept json
+// @Produce json
+// @param name path string true "Role name"
+// @Param role body dto.RoleUpdateRequest true "Role information"
+// @Success 200 {object} dto.RoleResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, unknown permission or removing roles:manage from your own role"
+// @Failure 403 {object} object{error=string} "A permission the caller doesn't have"
+// @Failure 404 {object} object{error=string} "Role not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/roles/:name [put]
+func UpdateRole(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.RoleUpdateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+
+		var role models.Role
+		if err := db.Preload("Permissions").Where("name = ?", c.Params("name")).First(&role).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Role not found"})
+			}
+			log.Printf("Error finding role in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// otherwise nobody may be left who can give the permission back
+		if role.Name == c.Locals("role") && !slices.Contains(input.Permissions, models.PermissionRolesManage) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "You can't remove " + models.PermissionRolesManage + " from your own role"})
+		}
+
+		permissions, err := findPermissions(db, input.Permissions)
+		if err != nil {
+			var unknown errUnknownPermission
+			if errors.As(err, &unknown) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": unknown.Error()})
+			}
+			log.Printf("Error finding permissions in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if allowed, err := canAssignRole(db, c, role.Name); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change a role with permissions you don't have"})
+		}
+		if allowed, err := middleware.HasPermissions(db, c, input.Permissions); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't grant permissions you don't have"})
+		}
+
+		before := toRoleResponse(role)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			role.Description = input.Description
+			if err := tx.Omit("Permissions").Save(&role).Error; err != nil {
+				return err
+			}
+			return tx.Model(&role).Association("Permissions").Replace(permissions)
+		})
+		if err != nil {
+			log.Printf("Error updating role: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		role.Permissions = permissions
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionRoleUpdate,
+			TargetType: "role",
+			TargetID:   role.Name,
+			Changes:    audit.Diff(before, toRoleResponse(role)),
+		})
+		return c.JSON(toRoleResponse(role))
+	}
+}
+
+// DeleteRole godoc
+// @Summary Delete a role
+// @Description Delete a role that no user or pending invitation has. The default user and admin roles can't be deleted.
+// @Tags roles
+// @Produce json
+// @param name path string true "Role name"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string} "Default role"
+// @Failure 404 {object} object{error=string} "Role not found"
+// @Failure 409 {object} object{error=string} "Role is still assigned to users or preset on pending invitations"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/roles/:name [delete]
+func DeleteRole(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		name := c.Params("name")
+		if slices.ContainsFunc(models.DefaultRoles, func(r models.DefaultRole) bool { return r.Name == name }) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Default roles can't be deleted"})
+		}
+
+		var role models.Role
+		if err := db.Where("name = ?", name).First(&role).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Role not found"})
+			}
+			log.Printf("Error finding role in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// deleted users count too, they can be restored
+		var users int64
+		if err := db.Unscoped().Model(&models.User{}).Where("role = ? AND purged_at IS NULL", role.Name).Count(&users).Error; err != nil {
+			log.Printf("Error counting users with role: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if users > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Role is still assigned to users"})
+		}
+		var invitations int64
+		if err := db.Model(&models.Invitation{}).
+			Where("role = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", role.Name, time.Now()).
+			Count(&invitations).Error; err != nil {
+			log.Printf("Error counting invitations with role: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if invitations > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Role is preset on pending invitations"})
+		}
+
+		if err := db.Select("Permissions").Delete(&role).Error; err != nil {
+			log.Printf("Error deleting role: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionRoleDelete, TargetType: "role", TargetID: role.Name})
+		return c.JSON(fiber.Map{"message": "Role deleted successfully"})
+	}
+}
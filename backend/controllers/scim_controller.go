@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/aotsurasak46/user-management/scim"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSCIMPageSize = 100
+	maxSCIMPageSize     = 200
+)
+
+// scimRequestError is a client error with the scimType that explains it.
+type scimRequestError struct {
+	scimType string
+	detail   string
+}
+
+func (e *scimRequestError) Error() string {
+	return e.detail
+}
+
+func scimJSON(c *fiber.Ctx, status int, body any) error {
+	return c.Status(status).JSON(body, scim.ContentType)
+}
+
+func scimError(c *fiber.Ctx, status int, scimType string, detail string) error {
+	return scimJSON(c, status, scim.NewError(status, scimType, detail))
+}
+
+// scimBadRequest answers a scimRequestError with its scimType and any other
+// error as an invalid value.
+func scimBadRequest(c *fiber.Ctx, err error) error {
+	var requestError *scimRequestError
+	if errors.As(err, &requestError) {
+		return scimError(c, fiber.StatusBadRequest, requestError.scimType, requestError.detail)
+	}
+	return scimError(c, fiber.StatusBadRequest, scim.ErrorInvalidValue, err.Error())
+}
+
+// decodeSCIM reads the JSON body whatever its content type, identity
+// providers send both application/json and application/scim+json.
+func decodeSCIM(c *fiber.Ctx, v any) error {
+	if err := json.Unmarshal(c.Body(), v); err != nil {
+		return &scimRequestError{scimType: scim.ErrorInvalidSyntax, detail: "Invalid request body"}
+	}
+	return nil
+}
+
+func decodeSCIMValue(value json.RawMessage, v any, attribute string) error {
+	if err := json.Unmarshal(value, v); err != nil {
+		return &scimRequestError{scimType: scim.ErrorInvalidValue, detail: "Invalid value for " + attribute}
+	}
+	return nil
+}
+
+func scimLocation(c *fiber.Ctx, endpoint string, id uint) string {
+	return c.BaseURL() + "/scim/v2/" + endpoint + "/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// scimResourceID parses the :id of the resource, ids that aren't numbers
+// can't exist.
+func scimResourceID(c *fiber.Ctx) (uint, error) {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return 0, gorm.ErrRecordNotFound
+	}
+	return uint(id), nil
+}
+
+// scimPage reads the 1-based startIndex and the count of a list request.
+func scimPage(c *fiber.Ctx) (int, int) {
+	startIndex := c.QueryInt("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count := c.QueryInt("count", defaultSCIMPageSize)
+	if count < 0 {
+		count = 0
+	}
+	if count > maxSCIMPageSize {
+		count = maxSCIMPageSize
+	}
+	return startIndex, count
+}
+
+// scimFilter applies the filter query parameter to db, with the attributes
+// that can be filtered on.
+func scimFilter(c *fiber.Ctx, db *gorm.DB, attributes map[string]scim.Attribute) (*gorm.DB, error) {
+	filter := c.Query("filter")
+	if filter == "" {
+		return db, nil
+	}
+	expression, err := scim.ParseFilter(filter)
+	if err != nil {
+		return nil, &scimRequestError{scimType: scim.ErrorInvalidFilter, detail: err.Error()}
+	}
+	condition, args, err := scim.Compile(expression, attributes)
+	if err != nil {
+		return nil, &scimRequestError{scimType: scim.ErrorInvalidFilter, detail: err.Error()}
+	}
+	return db.Where(condition, args...), nil
+}
+
+// scimAttributeList parses a list like "userName,name.givenName" into the
+// attributes and their sub-attributes, nil meaning the whole attribute.
+func scimAttributeList(list string) map[string]map[string]bool {
+	attributes := map[string]map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		attribute, sub, ok := strings.Cut(scim.NormalizeAttribute(item), ".")
+		subs, seen := attributes[attribute]
+		switch {
+		case !ok:
+			attributes[attribute] = nil
+		case !seen:
+			attributes[attribute] = map[string]bool{sub: true}
+		case subs != nil:
+			subs[sub] = true
+		}
+	}
+	return attributes
+}
+
+// scimReturns reports whether the attribute is part of the response, to skip
+// loading large attributes like the members of a group when they are
+// excluded.
+func scimReturns(c *fiber.Ctx, attribute string) bool {
+	if _, ok := scimAttributeList(c.Query("excludedAttributes"))[attribute]; ok {
+		return false
+	}
+	attributes := scimAttributeList(c.Query("attributes"))
+	if len(attributes) == 0 {
+		return true
+	}
+	_, ok := attributes[attribute]
+	return ok
+}
+
+// scimProject applies the attributes and excludedAttributes query parameters
+// to a resource. The schemas and id are always returned.
+func scimProject(c *fiber.Ctx, resource any) (any, error) {
+	attributes := scimAttributeList(c.Query("attributes"))
+	excluded := scimAttributeList(c.Query("excludedAttributes"))
+	if len(attributes) == 0 && len(excluded) == 0 {
+		return resource, nil
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	for key, value := range fields {
+		name := strings.ToLower(key)
+		if name == "schemas" || name == "id" {
+			continue
+		}
+		if len(attributes) > 0 {
+			subs, ok := attributes[name]
+			if !ok {
+				delete(fields, key)
+				continue
+			}
+			if subs != nil {
+				filterSubAttributes(value, func(sub string) bool { return subs[sub] })
+			}
+		}
+		if subs, ok := excluded[name]; ok {
+			if subs == nil {
+				delete(fields, key)
+				continue
+			}
+			filterSubAttributes(value, func(sub string) bool { return !subs[sub] })
+		}
+	}
+	return fields, nil
+}
+
+// filterSubAttributes removes the sub-attributes of a complex value, or of
+// every value of a multi-valued one, that keep rejects.
+func filterSubAttributes(value any, keep func(string) bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		for sub := range v {
+			if !keep(strings.ToLower(sub)) {
+				delete(v, sub)
+			}
+		}
+	case []any:
+		for _, item := range v {
+			filterSubAttributes(item, keep)
+		}
+	}
+}
+
+// scimResource answers a single resource, after applying the attributes
+// query parameters.
+func scimResource(c *fiber.Ctx, status int, resource any) error {
+	projected, err := scimProject(c, resource)
+	if err != nil {
+		return err
+	}
+	return scimJSON(c, status, projected)
+}
+
+// GetSCIMServiceProviderConfig godoc
+// @Summary SCIM service provider configuration
+// @Description Describe the SCIM 2.0 features the server supports (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @Success 200 {object} scim.ServiceProviderConfig
+// @Security ApiKeyAuth
+// @Router /scim/v2/ServiceProviderConfig [get]
+func GetSCIMServiceProviderConfig() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return scimJSON(c, fiber.StatusOK, scim.ServiceProviderConfig{
+			Schemas:        []string{scim.SchemaServiceProviderConfig},
+			Patch:          scim.Supported{Supported: true},
+			Bulk:           scim.BulkSupported{},
+			Filter:         scim.FilterSupported{Supported: true, MaxResults: maxSCIMPageSize},
+			ChangePassword: scim.Supported{Supported: true},
+			AuthenticationSchemes: []scim.AuthenticationScheme{{
+				Type:        "oauthbearertoken",
+				Name:        "Personal access token",
+				Description: "A personal access token with the scim:provision scope, sent as Authorization: Bearer <token>",
+				Primary:     true,
+			}},
+			Meta: &scim.Meta{ResourceType: "ServiceProviderConfig", Location: c.BaseURL() + "/scim/v2/ServiceProviderConfig"},
+		})
+	}
+}
+
+// GetSCIMResourceTypes godoc
+// @Summary SCIM resource types
+// @Description List the SCIM 2.0 resource types, User and Group, or get one of them by id (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @param id path string false "Resource type id"
+// @Success 200 {object} scim.ListResponse
+// @Failure 404 {object} scim.Error "Resource type not found"
+// @Security ApiKeyAuth
+// @Router /scim/v2/ResourceTypes/:id [get]
+func GetSCIMResourceTypes() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		resources := make([]any, 0, len(scim.ResourceTypes))
+		for _, resourceType := range scim.ResourceTypes {
+			resourceType.Meta = &scim.Meta{ResourceType: "ResourceType", Location: c.BaseURL() + "/scim/v2/ResourceTypes/" + resourceType.ID}
+			if c.Params("id") == resourceType.ID {
+				return scimJSON(c, fiber.StatusOK, resourceType)
+			}
+			resources = append(resources, resourceType)
+		}
+		return scimDiscoveryList(c, resources, "Resource type not found")
+	}
+}
+
+// GetSCIMSchemas godoc
+// @Summary SCIM schemas
+// @Description List the attributes of the SCIM 2.0 User and Group schemas that are supported, or get one schema by its URN (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @param id path string false "Schema URN"
+// @Success 200 {object} scim.ListResponse
+// @Failure 404 {object} scim.Error "Schema not found"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Schemas/:id [get]
+func GetSCIMSchemas() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		resources := []any{}
+		for _, schema := range []scim.Schema{scim.UserSchema, scim.GroupSchema} {
+			schema.Meta = &scim.Meta{ResourceType: "Schema", Location: c.BaseURL() + "/scim/v2/Schemas/" + schema.ID}
+			if c.Params("id") == schema.ID {
+				return scimJSON(c, fiber.StatusOK, schema)
+			}
+			resources = append(resources, schema)
+		}
+		return scimDiscoveryList(c, resources, "Schema not found")
+	}
+}
+
+// scimDiscoveryList answers the list of a discovery endpoint, or 404 when a
+// single resource was asked for and not found.
+func scimDiscoveryList(c *fiber.Ctx, resources []any, notFound string) error {
+	if c.Params("id") != "" {
+		return scimError(c, fiber.StatusNotFound, "", notFound)
+	}
+	return scimJSON(c, fiber.StatusOK, scim.NewListResponse(resources, int64(len(resources)), 1))
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSCIMPage(t *testing.T) {
+	tests := []struct {
+		query      string
+		startIndex int
+		count      int
+	}{
+		{"", 1, defaultSCIMPageSize},
+		{"?startIndex=3&count=10", 3, 10},
+		{"?startIndex=0", 1, defaultSCIMPageSize},
+		{"?startIndex=-5", 1, defaultSCIMPageSize},
+		{"?startIndex=abc", 1, defaultSCIMPageSize},
+		{"?count=0", 1, 0},
+		{"?count=-1", 1, 0},
+		{"?count=500", 1, maxSCIMPageSize},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var startIndex, count int
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				startIndex, count = scimPage(c)
+				return nil
+			})
+			if _, err := app.Test(httptest.NewRequest("GET", "/"+test.query, nil)); err != nil {
+				t.Fatal(err)
+			}
+			if startIndex != test.startIndex || count != test.count {
+				t.Fatalf("got %d %d, want %d %d", startIndex, count, test.startIndex, test.count)
+			}
+		})
+	}
+}
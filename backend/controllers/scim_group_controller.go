@@ -0,0 +1,637 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/scim"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// scimGroupAttributes are the group attributes a SCIM filter can use.
+var scimGroupAttributes = map[string]scim.Attribute{
+	"id":          {Column: `CAST("groups".id AS TEXT)`, CaseExact: true},
+	"externalid":  {Column: `"groups".external_id`, CaseExact: true},
+	"displayname": {Column: `"groups".name`},
+	"members": {
+		Column:    "CAST(group_members.user_id AS TEXT)",
+		CaseExact: true,
+		Exists:    `EXISTS (SELECT 1 FROM group_members WHERE group_members.group_id = "groups".id AND %s)`,
+	},
+	"members.value": {
+		Column:    "CAST(group_members.user_id AS TEXT)",
+		CaseExact: true,
+		Exists:    `EXISTS (SELECT 1 FROM group_members WHERE group_members.group_id = "groups".id AND %s)`,
+	},
+	"meta.created":      {Column: `"groups".created_at`, Type: scim.DateTime},
+	"meta.lastmodified": {Column: `"groups".updated_at`, Type: scim.DateTime},
+}
+
+var errSCIMGroupTaken = errors.New("group already exists")
+
+func toSCIMGroup(c *fiber.Ctx, group models.Group, members []scim.Reference) scim.Group {
+	return scim.Group{
+		Schemas:     []string{scim.SchemaGroup},
+		ID:          strconv.FormatUint(uint64(group.ID), 10),
+		ExternalID:  group.ExternalID,
+		DisplayName: group.Name,
+		Members:     members,
+		Meta: &scim.Meta{
+			ResourceType: "Group",
+			Created:      &group.CreatedAt,
+			LastModified: &group.UpdatedAt,
+			Location:     scimLocation(c, "Groups", group.ID),
+		},
+	}
+}
+
+// scimGroupMembers returns the members of each group, leaving out deleted
+// users.
+func scimGroupMembers(db *gorm.DB, c *fiber.Ctx, groupIDs []uint) (map[uint][]scim.Reference, error) {
+	members := map[uint][]scim.Reference{}
+	if len(groupIDs) == 0 || !scimReturns(c, "members") {
+		return members, nil
+	}
+	var rows []struct {
+		GroupID uint
+		UserID  uint
+		Name    string
+	}
+	if err := db.Model(&models.GroupMember{}).
+		Select("group_members.group_id, group_members.user_id, users.name").
+		Joins("JOIN users ON users.id = group_members.user_id AND users.deleted_at IS NULL").
+		Where("group_members.group_id IN ?", groupIDs).
+		Order("group_members.user_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		members[row.GroupID] = append(members[row.GroupID], scim.Reference{
+			Value:   strconv.FormatUint(uint64(row.UserID), 10),
+			Ref:     scimLocation(c, "Users", row.UserID),
+			Display: row.Name,
+		})
+	}
+	return members, nil
+}
+
+// scimMemberIDs returns the user ids of the members, which have to be users
+// of the organization of the request.
+func scimMemberIDs(db *gorm.DB, c *fiber.Ctx, members []scim.Reference) ([]uint, error) {
+	ids := make([]uint, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseUint(member.Value, 10, 64)
+		if err != nil {
+			return nil, &scimRequestError{scimType: scim.ErrorInvalidValue, detail: fmt.Sprintf("member %q is not a user id", member.Value)}
+		}
+		ids = append(ids, uint(id))
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	var found []uint
+	if err := db.WithContext(c.UserContext()).Model(&models.User{}).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if !slices.Contains(found, id) {
+			return nil, &scimRequestError{scimType: scim.ErrorInvalidValue, detail: fmt.Sprintf("member %d is not a user of the organization", id)}
+		}
+	}
+	return ids, nil
+}
+
+// currentSCIMMembers returns the user ids of the members of the group.
+func currentSCIMMembers(db *gorm.DB, groupID uint) ([]uint, error) {
+	var ids []uint
+	err := db.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Order("user_id").Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+func findSCIMGroup(db *gorm.DB, c *fiber.Ctx) (*models.Group, error) {
+	id, err := scimResourceID(c)
+	if err != nil {
+		return nil, err
+	}
+	var group models.Group
+	if err := db.WithContext(c.UserContext()).Preload("Permissions").First(&group, id).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func scimGroupError(c *fiber.Ctx, err error) error {
+	var requestError *scimRequestError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return scimError(c, fiber.StatusNotFound, "", "Group not found")
+	case errors.Is(err, errSCIMGroupTaken):
+		return scimError(c, fiber.StatusConflict, scim.ErrorUniqueness, "displayName is already taken")
+	case errors.As(err, &requestError):
+		return scimBadRequest(c, err)
+	}
+	log.Printf("Error handling SCIM group: %v", err)
+	return c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// scimGroupResponse answers a single group with its members.
+func scimGroupResponse(db *gorm.DB, c *fiber.Ctx, status int, group *models.Group) error {
+	members, err := scimGroupMembers(db, c, []uint{group.ID})
+	if err != nil {
+		log.Printf("Error getting group members from database: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	resource := toSCIMGroup(c, *group, members[group.ID])
+	c.Set(fiber.HeaderLocation, resource.Meta.Location)
+	return scimResource(c, status, resource)
+}
+
+// recordSCIMMembers adds the members that joined or left a group to the audit
+// log.
+func recordSCIMMembers(db *gorm.DB, c *fiber.Ctx, groupID uint, added []uint, removed []uint) {
+	for _, userID := range added {
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionGroupMemberAdd,
+			TargetType: "group",
+			TargetID:   groupID,
+			Changes:    map[string]audit.Change{"user_id": {After: userID}, "role": {After: models.GroupRoleMember}},
+		})
+	}
+	for _, userID := range removed {
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionGroupMemberRemove,
+			TargetType: "group",
+			TargetID:   groupID,
+			Changes:    map[string]audit.Change{"user_id": {Before: userID}},
+		})
+	}
+}
+
+// GetSCIMGroups godoc
+// @Summary List SCIM groups
+// @Description List the groups of the organization of the token, optionally filtered with a SCIM filter like displayName eq "Engineering" (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @Param filter query string false "SCIM filter on id, externalId, displayName, members.value, meta.created or meta.lastModified"
+// @Param startIndex query int false "1-based index of the first group" default(1)
+// @Param count query int false "Page size, at most 200" default(100)
+// @Param attributes query string false "Only return these attributes"
+// @Param excludedAttributes query string false "Don't return these attributes, excluding members skips loading them"
+// @Success 200 {object} scim.ListResponse
+// @Failure 400 {object} scim.Error "Invalid filter"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups [get]
+func GetSCIMGroups(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		startIndex, count := scimPage(c)
+		filtered, err := scimFilter(c, db.WithContext(c.UserContext()).Model(&models.Group{}), scimGroupAttributes)
+		if err != nil {
+			return scimBadRequest(c, err)
+		}
+
+		var total int64
+		if err := filtered.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			log.Printf("Error counting groups in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		groups := []models.Group{}
+		if count > 0 {
+			if err := filtered.Session(&gorm.Session{}).Order(`"groups".id`).Offset(startIndex - 1).Limit(count).Find(&groups).Error; err != nil {
+				log.Printf("Error getting groups from database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		groupIDs := make([]uint, len(groups))
+		for i, group := range groups {
+			groupIDs[i] = group.ID
+		}
+		members, err := scimGroupMembers(db, c, groupIDs)
+		if err != nil {
+			log.Printf("Error getting group members from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		resources := make([]any, len(groups))
+		for i, group := range groups {
+			if resources[i], err = scimProject(c, toSCIMGroup(c, group, members[group.ID])); err != nil {
+				return err
+			}
+		}
+		return scimJSON(c, fiber.StatusOK, scim.NewListResponse(resources, total, startIndex))
+	}
+}
+
+// GetSCIMGroup godoc
+// @Summary Get a SCIM group
+// @Description Get a group of the organization of the token with its members (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @param id path string true "Group id"
+// @Param attributes query string false "Only return these attributes"
+// @Param excludedAttributes query string false "Don't return these attributes"
+// @Success 200 {object} scim.Group
+// @Failure 404 {object} scim.Error "Group not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups/:id [get]
+func GetSCIMGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		group, err := findSCIMGroup(db, c)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		return scimGroupResponse(db, c, fiber.StatusOK, group)
+	}
+}
+
+// CreateSCIMGroup godoc
+// @Summary Provision a SCIM group
+// @Description Create a group in the organization of the token (requires scim:provision). Members join it with the member role and have to be users of the organization.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param group body scim.Group true "SCIM group"
+// @Success 201 {object} scim.Group
+// @Failure 400 {object} scim.Error "Invalid body, displayName or member"
+// @Failure 409 {object} scim.Error "displayName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups [post]
+func CreateSCIMGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var resource scim.Group
+		if err := decodeSCIM(c, &resource); err != nil {
+			return scimBadRequest(c, err)
+		}
+		name := strings.TrimSpace(resource.DisplayName)
+		if name == "" {
+			return scimError(c, fiber.StatusBadRequest, scim.ErrorInvalidValue, "displayName is required")
+		}
+		memberIDs, err := scimMemberIDs(db, c, resource.Members)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+
+		group := &models.Group{
+			OrganizationID: *c.Locals("organizationID").(*uint),
+			Name:           name,
+			ExternalID:     resource.ExternalID,
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(group)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errSCIMGroupTaken
+			}
+			return addSCIMMembers(tx, group.ID, memberIDs)
+		})
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		recordSCIMMembers(db, c, group.ID, memberIDs, nil)
+		return scimGroupResponse(db, c, fiber.StatusCreated, group)
+	}
+}
+
+// ReplaceSCIMGroup godoc
+// @Summary Replace a SCIM group
+// @Description Replace the name, external id and members of a group (requires scim:provision, and every permission of the group to change its members). Members that stay keep their group role.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @param id path string true "Group id"
+// @Param group body scim.Group true "SCIM group"
+// @Success 200 {object} scim.Group
+// @Failure 400 {object} scim.Error "Invalid body, displayName or member"
+// @Failure 403 {object} scim.Error "Changing the members of a group with permissions the caller doesn't have"
+// @Failure 404 {object} scim.Error "Group not found"
+// @Failure 409 {object} scim.Error "displayName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups/:id [put]
+func ReplaceSCIMGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var resource scim.Group
+		if err := decodeSCIM(c, &resource); err != nil {
+			return scimBadRequest(c, err)
+		}
+		group, err := findSCIMGroup(db, c)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		memberIDs, err := scimMemberIDs(db, c, resource.Members)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		return saveSCIMGroup(db, c, group, resource.DisplayName, resource.ExternalID, memberIDs)
+	}
+}
+
+// PatchSCIMGroup godoc
+// @Summary Patch a SCIM group
+// @Description Apply add, replace and remove operations to a group (requires scim:provision, and every permission of the group to change its members). Paths can be displayName, externalId, members and members[value eq "id"].
+// @Tags scim
+// @Accept json
+// @Produce json
+// @param id path string true "Group id"
+// @Param operations body scim.PatchRequest true "SCIM patch operations"
+// @Success 200 {object} scim.Group
+// @Failure 400 {object} scim.Error "Invalid operation, path, value or member"
+// @Failure 403 {object} scim.Error "Changing the members of a group with permissions the caller doesn't have"
+// @Failure 404 {object} scim.Error "Group not found"
+// @Failure 409 {object} scim.Error "displayName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups/:id [patch]
+func PatchSCIMGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var request scim.PatchRequest
+		if err := decodeSCIM(c, &request); err != nil {
+			return scimBadRequest(c, err)
+		}
+		group, err := findSCIMGroup(db, c)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		current, err := currentSCIMMembers(db, group.ID)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+
+		patch := &scimGroupPatch{name: group.Name, externalID: group.ExternalID, members: slices.Clone(current)}
+		for _, operation := range request.Operations {
+			if err := patch.apply(operation); err != nil {
+				return scimBadRequest(c, err)
+			}
+		}
+		// only the members that join need to be checked
+		var joining []scim.Reference
+		for _, id := range patch.members {
+			if !slices.Contains(current, id) {
+				joining = append(joining, scim.Reference{Value: strconv.FormatUint(uint64(id), 10)})
+			}
+		}
+		if _, err := scimMemberIDs(db, c, joining); err != nil {
+			return scimGroupError(c, err)
+		}
+		return saveSCIMGroup(db, c, group, patch.name, patch.externalID, patch.members)
+	}
+}
+
+// DeleteSCIMGroup godoc
+// @Summary Deprovision a SCIM group
+// @Description Delete a group, its members lose the permissions granted to it (requires scim:provision)
+// @Tags scim
+// @param id path string true "Group id"
+// @Success 204
+// @Failure 404 {object} scim.Error "Group not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Groups/:id [delete]
+func DeleteSCIMGroup(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		group, err := findSCIMGroup(db, c)
+		if err != nil {
+			return scimGroupError(c, err)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("group_id = ?", group.ID).Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+			return tx.Select("Permissions").Delete(group).Error
+		})
+		if err != nil {
+			log.Printf("Error deleting group: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func addSCIMMembers(tx *gorm.DB, groupID uint, userIDs []uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	members := make([]models.GroupMember, len(userIDs))
+	for i, userID := range userIDs {
+		members[i] = models.GroupMember{GroupID: groupID, UserID: userID, Role: models.GroupRoleMember}
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&members, 100).Error
+}
+
+// saveSCIMGroup replaces the name, external id and members of the group. The
+// members of a group can only be changed by callers with all of its
+// permissions, otherwise they could add themselves to get them.
+func saveSCIMGroup(db *gorm.DB, c *fiber.Ctx, group *models.Group, name string, externalID string, memberIDs []uint) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return scimError(c, fiber.StatusBadRequest, scim.ErrorInvalidValue, "displayName is required")
+	}
+	current, err := currentSCIMMembers(db, group.ID)
+	if err != nil {
+		return scimGroupError(c, err)
+	}
+	var added, removed []uint
+	for _, id := range memberIDs {
+		if !slices.Contains(current, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range current {
+		if !slices.Contains(memberIDs, id) {
+			removed = append(removed, id)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		if allowed, err := canManageGroup(db, c, group); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return scimError(c, fiber.StatusForbidden, "", "The group has permissions you don't have, you can't change its members")
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if name != group.Name {
+			var count int64
+			if err := tx.Model(&models.Group{}).
+				Where("organization_id = ? AND name = ? AND id <> ?", group.OrganizationID, name, group.ID).
+				Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return errSCIMGroupTaken
+			}
+		}
+		if err := tx.Model(group).Updates(map[string]any{"name": name, "external_id": externalID}).Error; err != nil {
+			return err
+		}
+		if len(removed) > 0 {
+			if err := tx.Where("group_id = ? AND user_id IN ?", group.ID, removed).Delete(&models.GroupMember{}).Error; err != nil {
+				return err
+			}
+		}
+		return addSCIMMembers(tx, group.ID, added)
+	})
+	if err != nil {
+		return scimGroupError(c, err)
+	}
+	group.Name = name
+	group.ExternalID = externalID
+	recordSCIMMembers(db, c, group.ID, added, removed)
+	return scimGroupResponse(db, c, fiber.StatusOK, group)
+}
+
+// scimGroupPatch is the state of a group while PATCH operations apply to it.
+type scimGroupPatch struct {
+	name       string
+	externalID string
+	members    []uint
+}
+
+func (p *scimGroupPatch) apply(operation scim.PatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return &scimRequestError{scimType: scim.ErrorInvalidSyntax, detail: "op must be add, replace or remove"}
+	}
+	if operation.Path == "" {
+		if op == "remove" {
+			return &scimRequestError{scimType: scim.ErrorNoTarget, detail: "remove needs a path"}
+		}
+		var values map[string]json.RawMessage
+		if err := decodeSCIMValue(operation.Value, &values, "the operation"); err != nil {
+			return err
+		}
+		for path, value := range values {
+			if err := p.applyPath(op, path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return p.applyPath(op, operation.Path, operation.Value)
+}
+
+func (p *scimGroupPatch) applyPath(op string, rawPath string, value json.RawMessage) error {
+	if !scim.InSchema(rawPath, scim.SchemaGroup) {
+		return nil
+	}
+	path, err := scim.ParsePath(rawPath)
+	if err != nil {
+		return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: err.Error()}
+	}
+
+	switch path.Attribute {
+	case "displayname":
+		if op == "remove" {
+			return &scimRequestError{scimType: scim.ErrorMutability, detail: "displayName can't be removed"}
+		}
+		return decodeSCIMValue(value, &p.name, rawPath)
+	case "externalid":
+		if op == "remove" {
+			p.externalID = ""
+			return nil
+		}
+		return decodeSCIMValue(value, &p.externalID, rawPath)
+	case "members":
+		if path.Filter != nil {
+			// members[value eq "12"] only makes sense to remove members
+			if op != "remove" {
+				return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: "a members filter can only be used to remove members"}
+			}
+			kept := p.members[:0]
+			for _, id := range p.members {
+				matched, err := matchSCIMMember(path.Filter, id)
+				if err != nil {
+					return err
+				}
+				if !matched {
+					kept = append(kept, id)
+				}
+			}
+			p.members = kept
+			return nil
+		}
+
+		var ids []uint
+		if len(value) > 0 && string(value) != "null" {
+			var references []scim.Reference
+			if err := decodeSCIMValue(value, &references, rawPath); err != nil {
+				return err
+			}
+			for _, reference := range references {
+				id, err := strconv.ParseUint(reference.Value, 10, 64)
+				if err != nil {
+					return &scimRequestError{scimType: scim.ErrorInvalidValue, detail: fmt.Sprintf("member %q is not a user id", reference.Value)}
+				}
+				ids = append(ids, uint(id))
+			}
+		}
+		switch op {
+		case "add":
+			p.members = append(p.members, ids...)
+		case "replace":
+			p.members = ids
+		case "remove":
+			// without a value every member is removed
+			if len(ids) == 0 {
+				p.members = nil
+			} else {
+				p.members = slices.DeleteFunc(p.members, func(id uint) bool { return slices.Contains(ids, id) })
+			}
+		}
+		slices.Sort(p.members)
+		p.members = slices.Compact(p.members)
+		return nil
+	}
+	return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: rawPath + " is not supported"}
+}
+
+// matchSCIMMember evaluates the filter of a members[...] path against the
+// user id of a member.
+func matchSCIMMember(expression scim.Expression, userID uint) (bool, error) {
+	switch e := expression.(type) {
+	case scim.Logical:
+		left, err := matchSCIMMember(e.Left, userID)
+		if err != nil {
+			return false, err
+		}
+		right, err := matchSCIMMember(e.Right, userID)
+		if err != nil {
+			return false, err
+		}
+		if e.Operator == "and" {
+			return left && right, nil
+		}
+		return left || right, nil
+	case scim.Not:
+		matched, err := matchSCIMMember(e.Expression, userID)
+		return !matched, err
+	case scim.Comparison:
+		value, ok := e.Value.(string)
+		if e.Attribute != "value" || !ok || (e.Operator != "eq" && e.Operator != "ne") {
+			return false, &scimRequestError{scimType: scim.ErrorInvalidFilter, detail: `members can only be filtered with value eq "id"`}
+		}
+		matched := value == strconv.FormatUint(uint64(userID), 10)
+		if e.Operator == "ne" {
+			return !matched, nil
+		}
+		return matched, nil
+	}
+	return false, &scimRequestError{scimType: scim.ErrorInvalidFilter, detail: "invalid members filter"}
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aotsurasak46/user-management/scim"
+)
+
+func testSCIMGroupPatch() scimGroupPatch {
+	return scimGroupPatch{name: "Admins", externalID: "ext-1", members: []uint{1, 2, 3}}
+}
+
+func TestSCIMGroupPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation scim.PatchOperation
+		want      func(patch *scimGroupPatch)
+	}{
+		{"add members", patchOperation("add", "members", `[{"value":"4"},{"value":"2"}]`), func(patch *scimGroupPatch) {
+			patch.members = []uint{1, 2, 3, 4}
+		}},
+		{"replace members", patchOperation("replace", "members", `[{"value":"5"}]`), func(patch *scimGroupPatch) {
+			patch.members = []uint{5}
+		}},
+		{"remove members by value", patchOperation("remove", "members", `[{"value":"3"}]`), func(patch *scimGroupPatch) {
+			patch.members = []uint{1, 2}
+		}},
+		{"remove every member", patchOperation("remove", "members", ``), func(patch *scimGroupPatch) {
+			patch.members = nil
+		}},
+		{"remove a member by filter", patchOperation("remove", `members[value eq "2"]`, ``), func(patch *scimGroupPatch) {
+			patch.members = []uint{1, 3}
+		}},
+		{"remove members by a combined filter", patchOperation("remove", `members[value eq "1" or value eq "3"]`, ``), func(patch *scimGroupPatch) {
+			patch.members = []uint{2}
+		}},
+		{"remove all but one member", patchOperation("remove", `members[value ne "2"]`, ``), func(patch *scimGroupPatch) {
+			patch.members = []uint{2}
+		}},
+		{"replace without a path", patchOperation("Replace", "", `{"displayName":"Ops","externalId":"ext-2"}`), func(patch *scimGroupPatch) {
+			patch.name = "Ops"
+			patch.externalID = "ext-2"
+		}},
+		{"remove the external id", patchOperation("remove", "externalId", ``), func(patch *scimGroupPatch) {
+			patch.externalID = ""
+		}},
+		{"ignore extension attributes", patchOperation("add", "urn:example:scim:extension:Group:owner", `"x"`), func(patch *scimGroupPatch) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := testSCIMGroupPatch()
+			if err := got.apply(test.operation); err != nil {
+				t.Fatalf("apply failed: %v", err)
+			}
+			want := testSCIMGroupPatch()
+			test.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSCIMGroupPatchRejectsInvalidOperations(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation scim.PatchOperation
+		scimType  string
+	}{
+		{"unknown op", patchOperation("move", "members", `[]`), scim.ErrorInvalidSyntax},
+		{"remove without a path", patchOperation("remove", "", ``), scim.ErrorNoTarget},
+		{"remove the display name", patchOperation("remove", "displayName", ``), scim.ErrorMutability},
+		{"add with a members filter", patchOperation("add", `members[value eq "2"]`, `[{"value":"2"}]`), scim.ErrorInvalidPath},
+		{"member that isn't a user id", patchOperation("add", "members", `[{"value":"abc"}]`), scim.ErrorInvalidValue},
+		{"members filter on another attribute", patchOperation("remove", `members[display eq "Ada"]`, ``), scim.ErrorInvalidFilter},
+		{"unsupported attribute", patchOperation("replace", "owner", `"x"`), scim.ErrorInvalidPath},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch := testSCIMGroupPatch()
+			err := patch.apply(test.operation)
+			var requestError *scimRequestError
+			if !errors.As(err, &requestError) || requestError.scimType != test.scimType {
+				t.Fatalf("got %v, want a %s error", err, test.scimType)
+			}
+		})
+	}
+}
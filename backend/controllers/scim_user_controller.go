@@ -0,0 +1,650 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	netmail "net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/scim"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Reasons recorded in the status history when the identity provider changes
+// active.
+const (
+	scimDeactivateReason = "Deactivated by the identity provider"
+	scimReactivateReason = "Reactivated by the identity provider"
+)
+
+// scimUserAttributes are the user attributes a SCIM filter can use. The user
+// name is the email, and a user is active unless they are banned or
+// suspended.
+var scimUserAttributes = map[string]scim.Attribute{
+	"id":                {Column: "CAST(users.id AS TEXT)", CaseExact: true},
+	"externalid":        {Column: "users.external_id", CaseExact: true},
+	"username":          {Column: "users.email"},
+	"emails":            {Column: "users.email"},
+	"emails.value":      {Column: "users.email"},
+	"displayname":       {Column: "users.name"},
+	"name.formatted":    {Column: "users.name"},
+	"active":            {Column: "(users.status = 'active' OR (users.status = 'suspended' AND users.suspended_until <= now()))", Type: scim.Boolean},
+	"meta.created":      {Column: "users.created_at", Type: scim.DateTime},
+	"meta.lastmodified": {Column: "users.updated_at", Type: scim.DateTime},
+}
+
+// toSCIMUser maps a user to the SCIM User resource. Users have a single name,
+// so the given and family names are its first word and the rest.
+func toSCIMUser(c *fiber.Ctx, user models.User, groups []scim.Reference) scim.User {
+	givenName, familyName, _ := strings.Cut(user.Name, " ")
+	active := scim.Bool(!user.Blocked(time.Now()))
+	return scim.User{
+		Schemas:     []string{scim.SchemaUser},
+		ID:          strconv.FormatUint(uint64(user.ID), 10),
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		Name:        &scim.Name{Formatted: user.Name, GivenName: givenName, FamilyName: familyName},
+		DisplayName: user.Name,
+		Emails:      []scim.Email{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Groups:      groups,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      &user.CreatedAt,
+			LastModified: &user.UpdatedAt,
+			Location:     scimLocation(c, "Users", user.ID),
+		},
+	}
+}
+
+// scimUserGroups returns the groups of the organization of the request each
+// user is a member of.
+func scimUserGroups(db *gorm.DB, c *fiber.Ctx, userIDs []uint) (map[uint][]scim.Reference, error) {
+	groups := map[uint][]scim.Reference{}
+	if len(userIDs) == 0 || !scimReturns(c, "groups") {
+		return groups, nil
+	}
+	var rows []struct {
+		UserID  uint
+		GroupID uint
+		Name    string
+	}
+	if err := db.WithContext(c.UserContext()).Model(&models.Group{}).
+		Select(`group_members.user_id, "groups".id AS group_id, "groups".name`).
+		Joins(`JOIN group_members ON group_members.group_id = "groups".id`).
+		Where("group_members.user_id IN ?", userIDs).
+		Order(`"groups".name`).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		groups[row.UserID] = append(groups[row.UserID], scim.Reference{
+			Value:   strconv.FormatUint(uint64(row.GroupID), 10),
+			Ref:     scimLocation(c, "Groups", row.GroupID),
+			Display: row.Name,
+		})
+	}
+	return groups, nil
+}
+
+// scimUserFields returns the name and email of a SCIM user. The email is the
+// user name, or the primary email when there is no user name. The display
+// name is preferred over the name.
+func scimUserFields(resource *scim.User) (string, string, error) {
+	email := strings.TrimSpace(resource.UserName)
+	if email == "" {
+		for i, address := range resource.Emails {
+			if address.Primary || i == 0 {
+				email = strings.TrimSpace(address.Value)
+			}
+		}
+	}
+	if address, err := netmail.ParseAddress(email); err != nil || address.Address != email {
+		return "", "", &scimRequestError{scimType: scim.ErrorInvalidValue, detail: "userName must be an email address"}
+	}
+
+	name := strings.TrimSpace(resource.DisplayName)
+	if name == "" && resource.Name != nil {
+		name = strings.TrimSpace(resource.Name.Formatted)
+		if name == "" {
+			name = strings.TrimSpace(resource.Name.GivenName + " " + resource.Name.FamilyName)
+		}
+	}
+	if name == "" {
+		name = email
+	}
+	return name, email, nil
+}
+
+// scimEmailTaken reports whether another user, of any organization, has the
+// email.
+func scimEmailTaken(db *gorm.DB, email string, userID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.User{}).Where("lower(email) = lower(?) AND id <> ?", email, userID).Count(&count).Error
+	return count > 0, err
+}
+
+func findSCIMUser(db *gorm.DB, c *fiber.Ctx) (*models.User, error) {
+	id, err := scimResourceID(c)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := db.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func scimUserError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return scimError(c, fiber.StatusNotFound, "", "User not found")
+	}
+	log.Printf("Error finding user in database: %v", err)
+	return c.SendStatus(fiber.StatusInternalServerError)
+}
+
+// scimUserResponse answers a single user with their groups.
+func scimUserResponse(db *gorm.DB, c *fiber.Ctx, status int, user *models.User) error {
+	groups, err := scimUserGroups(db, c, []uint{user.ID})
+	if err != nil {
+		log.Printf("Error getting user groups from database: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	resource := toSCIMUser(c, *user, groups[user.ID])
+	c.Set(fiber.HeaderLocation, resource.Meta.Location)
+	return scimResource(c, status, resource)
+}
+
+// GetSCIMUsers godoc
+// @Summary List SCIM users
+// @Description List the users of the organization of the token, optionally filtered with a SCIM filter like userName eq "bjensen@example.com" (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @Param filter query string false "SCIM filter on id, externalId, userName, emails, displayName, name.formatted, active, meta.created or meta.lastModified"
+// @Param startIndex query int false "1-based index of the first user" default(1)
+// @Param count query int false "Page size, at most 200" default(100)
+// @Param attributes query string false "Only return these attributes"
+// @Param excludedAttributes query string false "Don't return these attributes"
+// @Success 200 {object} scim.ListResponse
+// @Failure 400 {object} scim.Error "Invalid filter"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users [get]
+func GetSCIMUsers(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		startIndex, count := scimPage(c)
+		filtered, err := scimFilter(c, db.WithContext(c.UserContext()).Model(&models.User{}), scimUserAttributes)
+		if err != nil {
+			return scimBadRequest(c, err)
+		}
+
+		var total int64
+		if err := filtered.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			log.Printf("Error counting users in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		users := []models.User{}
+		if count > 0 {
+			if err := filtered.Session(&gorm.Session{}).Order("users.id").Offset(startIndex - 1).Limit(count).Find(&users).Error; err != nil {
+				log.Printf("Error getting users from database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		userIDs := make([]uint, len(users))
+		for i, user := range users {
+			userIDs[i] = user.ID
+		}
+		groups, err := scimUserGroups(db, c, userIDs)
+		if err != nil {
+			log.Printf("Error getting user groups from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		resources := make([]any, len(users))
+		for i, user := range users {
+			if resources[i], err = scimProject(c, toSCIMUser(c, user, groups[user.ID])); err != nil {
+				return err
+			}
+		}
+		return scimJSON(c, fiber.StatusOK, scim.NewListResponse(resources, total, startIndex))
+	}
+}
+
+// GetSCIMUser godoc
+// @Summary Get a SCIM user
+// @Description Get a user of the organization of the token (requires scim:provision)
+// @Tags scim
+// @Produce json
+// @param id path string true "User id"
+// @Param attributes query string false "Only return these attributes"
+// @Param excludedAttributes query string false "Don't return these attributes"
+// @Success 200 {object} scim.User
+// @Failure 404 {object} scim.Error "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users/:id [get]
+func GetSCIMUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := findSCIMUser(db, c)
+		if err != nil {
+			return scimUserError(c, err)
+		}
+		return scimUserResponse(db, c, fiber.StatusOK, user)
+	}
+}
+
+// CreateSCIMUser godoc
+// @Summary Provision a SCIM user
+// @Description Create a user in the organization of the token (requires scim:provision). The userName is the email of the user, who gets the user role and counts as verified since the identity provider vouches for the address. Without a password the user can only log in through single sign on or after resetting it. A user created with active false starts suspended.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param user body scim.User true "SCIM user"
+// @Success 201 {object} scim.User
+// @Failure 400 {object} scim.Error "Invalid body or userName"
+// @Failure 409 {object} scim.Error "userName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users [post]
+func CreateSCIMUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var resource scim.User
+		if err := decodeSCIM(c, &resource); err != nil {
+			return scimBadRequest(c, err)
+		}
+		name, email, err := scimUserFields(&resource)
+		if err != nil {
+			return scimBadRequest(c, err)
+		}
+		if taken, err := scimEmailTaken(db, email, 0); err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if taken {
+			return scimError(c, fiber.StatusConflict, scim.ErrorUniqueness, "userName is already taken")
+		}
+
+		password := resource.Password
+		if password == "" {
+			// nobody knows it, the user logs in with single sign on or
+			// resets it
+			if password, err = utils.GenerateRandomToken(32); err != nil {
+				log.Printf("Error generating password: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		now := time.Now()
+		user := &models.User{
+			Name:            name,
+			Email:           email,
+			Password:        string(hashedPassword),
+			Role:            "user",
+			EmailVerified:   true,
+			EmailVerifiedAt: &now,
+			ExternalID:      resource.ExternalID,
+		}
+		actorID := c.Locals("userID").(uint)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			organizationID := c.Locals("organizationID").(*uint)
+			if err := addMembership(tx, *organizationID, user.ID, models.OrganizationRoleMember); err != nil {
+				return err
+			}
+			if resource.Active != nil && !*resource.Active {
+				return changeUserStatus(tx, user, models.UserStatusSuspended, nil, scimDeactivateReason, actorID)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error creating user: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserCreate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    audit.Diff(nil, toUserResponse(*user)),
+		})
+		return scimUserResponse(db, c, fiber.StatusCreated, user)
+	}
+}
+
+// ReplaceSCIMUser godoc
+// @Summary Replace a SCIM user
+// @Description Replace the name, email, external id and password of a user (requires scim:provision and every permission of the user's role). Setting active to false suspends the user without an end, setting it back to true lifts the suspension. Banned users can only be reactivated by an administrator. A new password logs the user out everywhere.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @param id path string true "User id"
+// @Param user body scim.User true "SCIM user"
+// @Success 200 {object} scim.User
+// @Failure 400 {object} scim.Error "Invalid body, invalid userName or banned user"
+// @Failure 403 {object} scim.Error "The user has a role with permissions the caller doesn't have"
+// @Failure 404 {object} scim.Error "User not found"
+// @Failure 409 {object} scim.Error "userName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users/:id [put]
+func ReplaceSCIMUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var resource scim.User
+		if err := decodeSCIM(c, &resource); err != nil {
+			return scimBadRequest(c, err)
+		}
+		user, err := findSCIMUser(db, c)
+		if err != nil {
+			return scimUserError(c, err)
+		}
+		return saveSCIMUser(db, c, user, &resource)
+	}
+}
+
+// PatchSCIMUser godoc
+// @Summary Patch a SCIM user
+// @Description Apply add, replace and remove operations to a user (requires scim:provision and every permission of the user's role). Paths can be userName, displayName, name and its sub-attributes, emails, externalId, active and password, and only externalId can be removed. A new password logs the user out everywhere.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @param id path string true "User id"
+// @Param operations body scim.PatchRequest true "SCIM patch operations"
+// @Success 200 {object} scim.User
+// @Failure 400 {object} scim.Error "Invalid operation, path or value"
+// @Failure 403 {object} scim.Error "The user has a role with permissions the caller doesn't have"
+// @Failure 404 {object} scim.Error "User not found"
+// @Failure 409 {object} scim.Error "userName is already taken"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users/:id [patch]
+func PatchSCIMUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var request scim.PatchRequest
+		if err := decodeSCIM(c, &request); err != nil {
+			return scimBadRequest(c, err)
+		}
+		user, err := findSCIMUser(db, c)
+		if err != nil {
+			return scimUserError(c, err)
+		}
+
+		// the operations apply to the current resource, which is then saved
+		// like a replacement
+		resource := toSCIMUser(c, *user, nil)
+		for _, operation := range request.Operations {
+			if err := patchSCIMUser(&resource, operation); err != nil {
+				return scimBadRequest(c, err)
+			}
+		}
+		return saveSCIMUser(db, c, user, &resource)
+	}
+}
+
+// DeleteSCIMUser godoc
+// @Summary Deprovision a SCIM user
+// @Description Delete a user (requires scim:provision and every permission of the user's role). Like DELETE /api/v1/users/:id it can be undone by restoring the user.
+// @Tags scim
+// @param id path string true "User id"
+// @Success 204
+// @Failure 403 {object} scim.Error "The user has a role with permissions the caller doesn't have"
+// @Failure 404 {object} scim.Error "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /scim/v2/Users/:id [delete]
+func DeleteSCIMUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := findSCIMUser(db, c)
+		if err != nil {
+			return scimUserError(c, err)
+		}
+		// scim:provision alone mustn't be enough to remove an admin
+		if allowed, err := canAssignRole(db, c, user.Role); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return scimError(c, fiber.StatusForbidden, "", "The user has a role with permissions you don't have")
+		}
+		if err := db.WithContext(c.UserContext()).Delete(user).Error; err != nil {
+			log.Printf("Error deleting user from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := revokeUserSessions(db, user.ID, 0, "user deleted"); err != nil {
+			log.Printf("Error revoking sessions of deleted user: %v", err)
+		}
+		disconnectUser(user.ID, "account deleted")
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserDelete, TargetType: "user", TargetID: user.ID})
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// saveSCIMUser replaces the user with the resource. active only changes the
+// status when it is set, and a ban can't be lifted through SCIM. A new
+// password revokes the sessions of the user.
+func saveSCIMUser(db *gorm.DB, c *fiber.Ctx, user *models.User, resource *scim.User) error {
+	// scim:provision alone mustn't be enough to take over an admin
+	if allowed, err := canAssignRole(db, c, user.Role); err != nil {
+		log.Printf("Error loading permissions: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	} else if !allowed {
+		return scimError(c, fiber.StatusForbidden, "", "The user has a role with permissions you don't have")
+	}
+	name, email, err := scimUserFields(resource)
+	if err != nil {
+		return scimBadRequest(c, err)
+	}
+	if !strings.EqualFold(email, user.Email) {
+		if taken, err := scimEmailTaken(db, email, user.ID); err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if taken {
+			return scimError(c, fiber.StatusConflict, scim.ErrorUniqueness, "userName is already taken")
+		}
+	}
+
+	status, reason := "", ""
+	if resource.Active != nil {
+		active, blocked := bool(*resource.Active), user.Blocked(time.Now())
+		switch {
+		case !active && !blocked:
+			status, reason = models.UserStatusSuspended, scimDeactivateReason
+		case active && user.Status == models.UserStatusBanned:
+			return scimError(c, fiber.StatusBadRequest, scim.ErrorMutability, "The user is banned, only an administrator can lift a ban")
+		case active && user.Status != models.UserStatusActive:
+			status, reason = models.UserStatusActive, scimReactivateReason
+		}
+	}
+
+	updates := map[string]any{"name": name, "email": email, "external_id": resource.ExternalID}
+	if resource.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(resource.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		updates["password"] = string(hashedPassword)
+	}
+
+	before := toUserResponse(*user)
+	actorID := c.Locals("userID").(uint)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if status != "" {
+			return changeUserStatus(tx, user, status, nil, reason, actorID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error updating user: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	user.Name = name
+	user.Email = email
+	user.ExternalID = resource.ExternalID
+
+	changes := audit.Diff(before, toUserResponse(*user))
+	if status != "" {
+		changes["reason"] = audit.Change{After: reason}
+	}
+	if len(changes) > 0 {
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserUpdate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    changes,
+		})
+	}
+	if resource.Password != "" {
+		if err := revokeUserSessions(db, user.ID, 0, "password change"); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	if status == models.UserStatusSuspended {
+		disconnectUser(user.ID, "account suspended")
+	}
+	return scimUserResponse(db, c, fiber.StatusOK, user)
+}
+
+// patchSCIMUser applies one PATCH operation to the resource. The names and
+// emails are kept consistent since the user has a single name and email.
+func patchSCIMUser(resource *scim.User, operation scim.PatchOperation) error {
+	switch strings.ToLower(operation.Op) {
+	case "add", "replace":
+		if operation.Path != "" {
+			return setSCIMUserAttribute(resource, operation.Path, operation.Value)
+		}
+		var values map[string]json.RawMessage
+		if err := decodeSCIMValue(operation.Value, &values, "the operation"); err != nil {
+			return err
+		}
+		// the display name wins over the name, like in scimUserFields
+		paths := make([]string, 0, len(values))
+		for path := range values {
+			paths = append(paths, path)
+		}
+		slices.SortFunc(paths, func(a, b string) int {
+			return boolOrder(scim.NormalizeAttribute(a) == "displayname") - boolOrder(scim.NormalizeAttribute(b) == "displayname")
+		})
+		for _, path := range paths {
+			if err := setSCIMUserAttribute(resource, path, values[path]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "remove":
+		if operation.Path == "" {
+			return &scimRequestError{scimType: scim.ErrorNoTarget, detail: "remove needs a path"}
+		}
+		if !scim.InSchema(operation.Path, scim.SchemaUser) {
+			return nil
+		}
+		path, err := scim.ParsePath(operation.Path)
+		if err != nil {
+			return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: err.Error()}
+		}
+		if path.Attribute == "externalid" {
+			resource.ExternalID = ""
+			return nil
+		}
+		return &scimRequestError{scimType: scim.ErrorMutability, detail: operation.Path + " can't be removed"}
+	}
+	return &scimRequestError{scimType: scim.ErrorInvalidSyntax, detail: "op must be add, replace or remove"}
+}
+
+func boolOrder(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// setSCIMUserAttribute sets the attribute at path. Attributes of schema
+// extensions aren't stored and are ignored.
+func setSCIMUserAttribute(resource *scim.User, rawPath string, value json.RawMessage) error {
+	if !scim.InSchema(rawPath, scim.SchemaUser) {
+		return nil
+	}
+	path, err := scim.ParsePath(rawPath)
+	if err != nil {
+		return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: err.Error()}
+	}
+	if resource.Name == nil {
+		resource.Name = &scim.Name{}
+	}
+
+	switch path.Attribute {
+	case "username":
+		return decodeSCIMValue(value, &resource.UserName, rawPath)
+	case "externalid":
+		return decodeSCIMValue(value, &resource.ExternalID, rawPath)
+	case "password":
+		return decodeSCIMValue(value, &resource.Password, rawPath)
+	case "active":
+		var active scim.Bool
+		if err := decodeSCIMValue(value, &active, rawPath); err != nil {
+			return err
+		}
+		resource.Active = &active
+		return nil
+	case "displayname":
+		if err := decodeSCIMValue(value, &resource.DisplayName, rawPath); err != nil {
+			return err
+		}
+		resource.Name = &scim.Name{Formatted: resource.DisplayName}
+		return nil
+	case "name":
+		// the display name is derived from the new name
+		resource.DisplayName = ""
+		switch path.SubAttribute {
+		case "":
+			return decodeSCIMValue(value, resource.Name, rawPath)
+		case "formatted":
+			return decodeSCIMValue(value, &resource.Name.Formatted, rawPath)
+		case "givenname":
+			resource.Name.Formatted = ""
+			return decodeSCIMValue(value, &resource.Name.GivenName, rawPath)
+		case "familyname":
+			resource.Name.Formatted = ""
+			return decodeSCIMValue(value, &resource.Name.FamilyName, rawPath)
+		}
+	case "emails":
+		if path.Filter == nil && path.SubAttribute == "" {
+			var emails []scim.Email
+			if err := decodeSCIMValue(value, &emails, rawPath); err != nil {
+				return err
+			}
+			resource.UserName = ""
+			resource.Emails = emails
+			return nil
+		}
+		if path.SubAttribute == "value" {
+			var email string
+			if err := decodeSCIMValue(value, &email, rawPath); err != nil {
+				return err
+			}
+			resource.UserName = email
+			resource.Emails = []scim.Email{{Value: email, Type: "work", Primary: true}}
+			return nil
+		}
+		// the type and primary flag of the only email can't change
+		return nil
+	}
+	return &scimRequestError{scimType: scim.ErrorInvalidPath, detail: rawPath + " is not supported"}
+}
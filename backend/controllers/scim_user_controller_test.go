@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aotsurasak46/user-management/scim"
+)
+
+func testSCIMUser() scim.User {
+	return scim.User{
+		UserName:    "ada@example.com",
+		ExternalID:  "ext-1",
+		DisplayName: "Ada Lovelace",
+		Name:        &scim.Name{Formatted: "Ada Lovelace"},
+		Emails:      []scim.Email{{Value: "ada@example.com", Type: "work", Primary: true}},
+	}
+}
+
+func patchOperation(op string, path string, value string) scim.PatchOperation {
+	return scim.PatchOperation{Op: op, Path: path, Value: json.RawMessage(value)}
+}
+
+func TestPatchSCIMUser(t *testing.T) {
+	inactive := scim.Bool(false)
+	tests := []struct {
+		name      string
+		operation scim.PatchOperation
+		want      func(user *scim.User)
+	}{
+		{"replace userName", patchOperation("replace", "userName", `"ada@example.org"`), func(user *scim.User) {
+			user.UserName = "ada@example.org"
+		}},
+		{"replace with a capitalized op", patchOperation("Replace", "externalId", `"ext-2"`), func(user *scim.User) {
+			user.ExternalID = "ext-2"
+		}},
+		{"deactivate with a string", patchOperation("replace", "active", `"False"`), func(user *scim.User) {
+			user.Active = &inactive
+		}},
+		{"replace the work email", patchOperation("replace", `emails[type eq "work"].value`, `"ada@example.org"`), func(user *scim.User) {
+			user.UserName = "ada@example.org"
+			user.Emails = []scim.Email{{Value: "ada@example.org", Type: "work", Primary: true}}
+		}},
+		{"replace every email", patchOperation("add", "emails", `[{"value":"ada@example.org","primary":true}]`), func(user *scim.User) {
+			user.UserName = ""
+			user.Emails = []scim.Email{{Value: "ada@example.org", Primary: true}}
+		}},
+		{"replace the given name", patchOperation("replace", "name.givenName", `"Augusta"`), func(user *scim.User) {
+			user.DisplayName = ""
+			user.Name = &scim.Name{GivenName: "Augusta"}
+		}},
+		{"replace the display name", patchOperation("replace", "displayName", `"Ada King"`), func(user *scim.User) {
+			user.DisplayName = "Ada King"
+			user.Name = &scim.Name{Formatted: "Ada King"}
+		}},
+		{"display name wins without a path", patchOperation("replace", "", `{"displayName":"Ada King","name":{"givenName":"Augusta"}}`), func(user *scim.User) {
+			user.DisplayName = "Ada King"
+			user.Name = &scim.Name{Formatted: "Ada King"}
+		}},
+		{"remove the external id", patchOperation("remove", "externalId", ``), func(user *scim.User) {
+			user.ExternalID = ""
+		}},
+		{"ignore extension attributes", patchOperation("add", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", `"Sales"`), func(user *scim.User) {}},
+		{"ignore the type of the email", patchOperation("replace", `emails[type eq "work"].type`, `"home"`), func(user *scim.User) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := testSCIMUser()
+			if err := patchSCIMUser(&got, test.operation); err != nil {
+				t.Fatalf("patchSCIMUser failed: %v", err)
+			}
+			want := testSCIMUser()
+			test.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPatchSCIMUserRejectsInvalidOperations(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation scim.PatchOperation
+		scimType  string
+	}{
+		{"unknown op", patchOperation("move", "userName", `"x"`), scim.ErrorInvalidSyntax},
+		{"remove without a path", patchOperation("remove", "", ``), scim.ErrorNoTarget},
+		{"remove the user name", patchOperation("remove", "userName", ``), scim.ErrorMutability},
+		{"unsupported attribute", patchOperation("replace", "nickName", `"Ada"`), scim.ErrorInvalidPath},
+		{"invalid path", patchOperation("replace", `emails[type eq`, `"x"`), scim.ErrorInvalidPath},
+		{"invalid boolean", patchOperation("replace", "active", `"maybe"`), scim.ErrorInvalidValue},
+		{"value of the wrong type", patchOperation("replace", "userName", `42`), scim.ErrorInvalidValue},
+		{"no object without a path", patchOperation("add", "", `"x"`), scim.ErrorInvalidValue},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := testSCIMUser()
+			err := patchSCIMUser(&user, test.operation)
+			var requestError *scimRequestError
+			if !errors.As(err, &requestError) || requestError.scimType != test.scimType {
+				t.Fatalf("got %v, want a %s error", err, test.scimType)
+			}
+		})
+	}
+}
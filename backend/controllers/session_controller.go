@@ -0,0 +1,421 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	accessTokenCookie  = "jwt"
+	refreshTokenCookie = "refresh_token"
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// createSession starts a new session for the user and returns it together
+// with its first refresh token. The token is "<family id>.<secret>", only the
+// hash of the secret is stored.
+func createSession(db *gorm.DB, c *fiber.Ctx, userID uint) (*models.Session, string, error) {
+	secret, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	session := &models.Session{
+		UserID:           userID,
+		OrganizationID:   firstOrganizationID(db, userID),
+		FamilyID:         uuid.NewString(),
+		RefreshTokenHash: utils.HashToken(secret),
+		ExpiresAt:        now.Add(utils.RefreshTokenTTL()),
+		LastUsedAt:       now,
+		IPAddress:        c.IP(),
+		UserAgent:        c.Get(fiber.HeaderUserAgent),
+	}
+	if err := db.Create(session).Error; err != nil {
+		return nil, "", err
+	}
+	return session, session.FamilyID + "." + secret, nil
+}
+
+// rotateSession exchanges a refresh token for a new one. A token that has the
+// right family but a stale secret means it was already used, so somebody else
+// holds a copy of it and the whole session is revoked.
+//
+// The token that was just replaced is the exception for
+// REFRESH_TOKEN_REUSE_GRACE after the rotation, so two tabs or requests
+// refreshing at once don't log the user out. The loser gets the session back
+// with an empty refresh token, its client keeps the cookie the winner set.
+func rotateSession(db *gorm.DB, c *fiber.Ctx, refreshToken string) (*models.Session, string, error) {
+	familyID, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || familyID == "" || secret == "" {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	var session models.Session
+	if err := db.Where("family_id = ?", familyID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", errInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+	now := time.Now()
+	if !session.IsActive(now) {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	newSecret, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	result := db.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, utils.HashToken(secret)).
+		Updates(map[string]any{
+			"refresh_token_hash":          utils.HashToken(newSecret),
+			"previous_refresh_token_hash": utils.HashToken(secret),
+			"rotated_at":                  now,
+			"last_used_at":                now,
+			"ip_address":                  c.IP(),
+			"user_agent":                  c.Get(fiber.HeaderUserAgent),
+		})
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		// the session may have been rotated since it was read above
+		if err := db.First(&session, session.ID).Error; err != nil {
+			return nil, "", err
+		}
+		grace := utils.GetEnvDuration("REFRESH_TOKEN_REUSE_GRACE", 30*time.Second)
+		if session.RevokedAt == nil && session.PreviousRefreshTokenHash == utils.HashToken(secret) &&
+			session.RotatedAt != nil && now.Sub(*session.RotatedAt) < grace {
+			return &session, "", nil
+		}
+		if err := revokeSession(db, &session, "refresh token reuse detected"); err != nil {
+			return nil, "", err
+		}
+		return nil, "", errInvalidRefreshToken
+	}
+	return &session, session.FamilyID + "." + newSecret, nil
+}
+
+// revokeSession marks the session as revoked so neither its refresh token nor
+// any access token issued from it is accepted anymore, and closes the chat
+// sockets that were opened from it.
+func revokeSession(db *gorm.DB, session *models.Session, reason string) error {
+	now := time.Now()
+	if err := db.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", session.ID).
+		Updates(map[string]any{"revoked_at": now, "revoked_reason": reason}).Error; err != nil {
+		return err
+	}
+	disconnectSession(session.UserID, session.ID)
+	return nil
+}
+
+// revokeUserSessions revokes every active session of the user except the one
+// with id keepSessionID, pass 0 to revoke them all.
+func revokeUserSessions(db *gorm.DB, userID uint, keepSessionID uint, reason string) error {
+	var sessions []models.Session
+	if err := db.Where("user_id = ? AND revoked_at IS NULL AND id <> ?", userID, keepSessionID).Find(&sessions).Error; err != nil {
+		return err
+	}
+	for i := range sessions {
+		if err := revokeSession(db, &sessions[i], reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findSessionByRefreshToken looks up the session a refresh token belongs to
+// without checking its secret.
+func findSessionByRefreshToken(db *gorm.DB, refreshToken string) (*models.Session, error) {
+	familyID, _, ok := strings.Cut(refreshToken, ".")
+	if !ok || familyID == "" {
+		return nil, errInvalidRefreshToken
+	}
+	var session models.Session
+	if err := db.Where("family_id = ?", familyID).First(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// setAuthCookies issues a fresh access token for the session and stores both
+// tokens in HTTP only cookies. An empty refresh token leaves the refresh token
+// cookie as it is.
+func setAuthCookies(c *fiber.Ctx, session *models.Session, refreshToken string) error {
+	accessToken, err := utils.GenerateJWT(session.UserID, session.ID)
+	if err != nil {
+		return err
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     accessTokenCookie,
+		Value:    accessToken,
+		Expires:  time.Now().Add(utils.AccessTokenTTL()),
+		HTTPOnly: true,
+		SameSite: "Lax",
+		Path:     "/",
+		Secure:   false,
+	})
+	if refreshToken == "" {
+		return nil
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Expires:  session.ExpiresAt,
+		HTTPOnly: true,
+		SameSite: "Lax",
+		Path:     "/api/v1",
+		Secure:   false,
+	})
+	return nil
+}
+
+func clearAuthCookies(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     accessTokenCookie,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Path:     "/",
+	})
+	c.Cookie(&fiber.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Path:     "/api/v1",
+	})
+}
+
+func toSessionResponse(session models.Session, currentSessionID uint) dto.SessionResponse {
+	return dto.SessionResponse{
+		ID:         session.ID,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+		IPAddress:  session.IPAddress,
+		UserAgent:  session.UserAgent,
+		Current:    session.ID == currentSessionID,
+	}
+}
+
+func listActiveSessions(db *gorm.DB, userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// GetMySessions godoc
+// @Summary List my sessions
+// @Description List the active sessions of the logged in user, the session making the request is marked as current
+// @Tags sessions
+// @Produce json
+// @Success 200 {array} dto.SessionResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/sessions [get]
+func GetMySessions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		currentSessionID, _ := c.Locals("sessionID").(uint)
+
+		sessions, err := listActiveSessions(db, userID)
+		if err != nil {
+			log.Printf("Error finding sessions in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.SessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, toSessionResponse(session, currentSessionID))
+		}
+		return c.JSON(response)
+	}
+}
+
+// RevokeMySession godoc
+// @Summary Revoke one of my sessions
+// @Description Log out one session of the logged in user, for example a lost phone
+// @Tags sessions
+// @Produce json
+// @param id path int true "Session id"
+// @Success 200 {object} object{message=string}
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 404 {object} object{error=string} "Session not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/sessions/:id [delete]
+func RevokeMySession(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		currentSessionID, _ := c.Locals("sessionID").(uint)
+
+		var session models.Session
+		if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userID).First(&session).Error; err != nil {
+			log.Printf("Error finding session in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := revokeSession(db, &session, "revoked by user"); err != nil {
+			log.Printf("Error revoking session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if session.ID == currentSessionID {
+			clearAuthCookies(c)
+		}
+		return c.JSON(fiber.Map{"message": "Session revoked successfully"})
+	}
+}
+
+// RevokeMySessions godoc
+// @Summary Log out of all devices
+// @Description Revoke every session of the logged in user. With except_current=true the session making the request stays logged in.
+// @Tags sessions
+// @Produce json
+// @param except_current query bool false "Keep the current session"
+// @Success 200 {object} object{message=string}
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/sessions [delete]
+func RevokeMySessions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		currentSessionID, _ := c.Locals("sessionID").(uint)
+
+		var keepSessionID uint
+		if c.QueryBool("except_current") {
+			keepSessionID = currentSessionID
+		}
+		if err := revokeUserSessions(db, userID, keepSessionID, "logged out of all devices"); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if keepSessionID == 0 {
+			clearAuthCookies(c)
+		}
+		return c.JSON(fiber.Map{"message": "Sessions revoked successfully"})
+	}
+}
+
+// GetUserSessions godoc
+// @Summary List sessions of a user
+// @Description List the active sessions of any user (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {array} dto.SessionResponse
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/sessions [get]
+func GetUserSessions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		sessions, err := listActiveSessions(db, user.ID)
+		if err != nil {
+			log.Printf("Error finding sessions in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.SessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, toSessionResponse(session, 0))
+		}
+		return c.JSON(response)
+	}
+}
+
+// RevokeUserSession godoc
+// @Summary Revoke a session of a user
+// @Description Log out one session of any user (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @param sessionId path int true "Session id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Session not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/sessions/:sessionId [delete]
+func RevokeUserSession(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		var session models.Session
+		if err := db.Where("id = ? AND user_id = ?", c.Params("sessionId"), user.ID).First(&session).Error; err != nil {
+			log.Printf("Error finding session in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := revokeSession(db, &session, "revoked by admin"); err != nil {
+			log.Printf("Error revoking session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserSessionsRevoke, TargetType: "session", TargetID: session.ID})
+		return c.JSON(fiber.Map{"message": "Session revoked successfully"})
+	}
+}
+
+// RevokeUserSessions godoc
+// @Summary Revoke all sessions of a user
+// @Description Log a user out of all devices (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/sessions [delete]
+func RevokeUserSessions(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := revokeUserSessions(db, user.ID, 0, "revoked by admin"); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserSessionsRevoke, TargetType: "user", TargetID: user.ID})
+		return c.JSON(fiber.Map{"message": "Sessions revoked successfully"})
+	}
+}
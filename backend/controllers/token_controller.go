@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultTokenExpiresInDays = 30
+	maxTokenExpiresInDays     = 365
+)
+
+func toPersonalAccessTokenResponse(token models.PersonalAccessToken) dto.PersonalAccessTokenResponse {
+	return dto.PersonalAccessTokenResponse{
+		ID:         token.ID,
+		CreatedAt:  token.CreatedAt,
+		Name:       token.Name,
+		Scopes:     token.ScopeList(),
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+	}
+}
+
+// GetPersonalAccessTokens godoc
+// @Summary List my personal access tokens
+// @Description List the personal access tokens of the logged in user. The token values themselves are never returned again.
+// @Tags tokens
+// @Produce json
+// @Success 200 {array} dto.PersonalAccessTokenResponse
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/tokens [get]
+func GetPersonalAccessTokens(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		var tokens []models.PersonalAccessToken
+		if err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error; err != nil {
+			log.Printf("Error finding tokens in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := make([]dto.PersonalAccessTokenResponse, 0, len(tokens))
+		for _, token := range tokens {
+			response = append(response, toPersonalAccessTokenResponse(token))
+		}
+		return c.JSON(response)
+	}
+}
+
+// CreatePersonalAccessToken godoc
+// @Summary Create a personal access token
+// @Description Mint a named, scoped and expiring token to call the API with "Authorization: Bearer <token>". Scopes are permissions the user has. The token is only shown in this response.
+// @Tags tokens
+// @Accept json
+// @Produce json
+// @Param token body dto.PersonalAccessTokenCreateRequest true "Token information"
+// @Success 201 {object} dto.PersonalAccessTokenResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, empty name, invalid scope or invalid expiry"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/tokens [post]
+func CreatePersonalAccessToken(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.PersonalAccessTokenCreateRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		input.Name = strings.TrimSpace(input.Name)
+		if input.Name == "" || len(input.Scopes) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Name and scopes can't be empty"})
+		}
+		// a token can only be scoped to what the user may do today, losing a
+		// permission later limits the token too
+		permissions, err := middleware.UserPermissions(db, c.Locals("userID").(uint), c.Locals("role").(string), c.Locals("organizationID").(*uint))
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		for _, scope := range input.Scopes {
+			if !slices.Contains(permissions, scope) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid scope: " + scope})
+			}
+		}
+		if input.ExpiresInDays == 0 {
+			input.ExpiresInDays = defaultTokenExpiresInDays
+		}
+		if input.ExpiresInDays < 0 || input.ExpiresInDays > maxTokenExpiresInDays {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Expiry must be between 1 and 365 days"})
+		}
+
+		secret, err := utils.GenerateRandomToken(32)
+		if err != nil {
+			log.Printf("Error generating token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		plainToken := models.PersonalAccessTokenPrefix + secret
+
+		slices.Sort(input.Scopes)
+		token := models.PersonalAccessToken{
+			UserID:    c.Locals("userID").(uint),
+			Name:      input.Name,
+			TokenHash: utils.HashToken(plainToken),
+			Scopes:    strings.Join(slices.Compact(input.Scopes), ","),
+			ExpiresAt: time.Now().AddDate(0, 0, input.ExpiresInDays),
+			// the token works in the organization the session is in
+			OrganizationID: c.Locals("organizationID").(*uint),
+		}
+		if err := db.Create(&token).Error; err != nil {
+			log.Printf("Error creating token: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		response := toPersonalAccessTokenResponse(token)
+		response.Token = plainToken
+		return c.Status(fiber.StatusCreated).JSON(response)
+	}
+}
+
+// DeletePersonalAccessToken godoc
+// @Summary Revoke a personal access token
+// @Description Delete one of the personal access tokens of the logged in user
+// @Tags tokens
+// @Produce json
+// @param id path int true "Token id"
+// @Success 200 {object} object{message=string}
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 404 {object} object{error=string} "Token not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/tokens/:id [delete]
+func DeletePersonalAccessToken(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		var token models.PersonalAccessToken
+		if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userID).First(&token).Error; err != nil {
+			log.Printf("Error finding token in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Token not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Delete(&token).Error; err != nil {
+			log.Printf("Error deleting token from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Token revoked successfully"})
+	}
+}
@@ -0,0 +1,400 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/limiter"
+	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const recoveryCodeCount = 10
+
+// normalizeRecoveryCode makes "ABCDE-FGHIJ", "abcde fghij" and "abcdefghij"
+// the same code.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user and returns
+// the new ones. They are only ever shown in this response.
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		if err := tx.Create(&models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: utils.HashToken(normalizeRecoveryCode(code)),
+		}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code of the user. Both are consumed so the same code can't be used twice.
+func verifySecondFactor(db *gorm.DB, user *models.User, code string) (bool, error) {
+	if user.TOTPSecret == "" {
+		return false, nil
+	}
+	secret, err := utils.Decrypt(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	if step, ok := utils.ValidateTOTP(secret, code, time.Now(), user.TOTPLastStep); ok {
+		result := db.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		user.TOTPLastStep = step
+		return result.RowsAffected == 1, nil
+	}
+
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, utils.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// LoginTwoFactor godoc
+// @Summary Two factor login
+// @Description Finish a login that returned a challenge token by sending a TOTP code or a recovery code
+// @Tags authentication
+// @Accept json
+// @Produce json
+// @Param request body dto.TwoFactorLoginRequest true "Challenge token and code"
+// @Success 200 {object} dto.UserResponse "Login successful"
+// @Failure 400 {object} object{error=string} "Invalid request body"
+// @Failure 401 {object} object{error=string} "Invalid or expired challenge, or invalid code"
+// @Failure 403 {object} object{error=string} "Account suspended or banned"
+// @Failure 429 {object} object{error=string} "Too many failed login attempts, see the Retry-After header"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/login/2fa [post]
+func LoginTwoFactor(db *gorm.DB, guard *limiter.LoginGuard) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.TwoFactorLoginRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.ChallengeToken == "" || input.Code == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Challenge token or code can't be empty"})
+		}
+
+		userID, err := utils.ParseChallengeJWT(input.ChallengeToken)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired challenge"})
+		}
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired challenge"})
+		}
+		if user.Blocked(time.Now()) {
+			return middleware.RejectBlockedUser(c, &user)
+		}
+
+		// wrong codes count against the account like wrong passwords
+		wait, err := guard.Reserve(c.Context(), user.Email, c.IP())
+		if err != nil {
+			log.Printf("Error checking login attempts: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if wait > 0 {
+			return tooManyRequests(c, wait, "Too many failed login attempts, try again later")
+		}
+
+		ok, err := verifySecondFactor(db, &user, input.Code)
+		if err != nil {
+			log.Printf("Error verifying second factor: %v", err)
+			releaseLoginAttempt(c, guard, user.Email)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !ok {
+			recordLoginFailure(c, guard, user.Email)
+			audit.Record(db, c, audit.Event{Action: audit.ActionLoginFailed, TargetType: "user", TargetID: user.ID, ActorID: &user.ID})
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid code"})
+		}
+		if err := guard.Succeed(c.Context(), user.Email, c.IP()); err != nil {
+			log.Printf("Error resetting login attempts: %v", err)
+		}
+
+		session, refreshToken, err := createSession(db, c, user.ID)
+		if err != nil {
+			log.Printf("Error creating session: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := setAuthCookies(c, session, refreshToken); err != nil {
+			log.Printf("Error generate JWT: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionLogin, TargetType: "session", TargetID: session.ID, ActorID: &user.ID})
+		return c.JSON(toUserResponse(user))
+	}
+}
+
+// SetupTwoFactor godoc
+// @Summary Start two factor enrolment
+// @Description Generate a new TOTP secret for the logged in user. Two factor authentication is only enabled after the first code is confirmed.
+// @Tags two-factor
+// @Produce json
+// @Success 200 {object} dto.TwoFactorSetupResponse
+// @Failure 400 {object} object{error=string} "Two factor authentication is already enabled"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/2fa/setup [post]
+func SetupTwoFactor(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if user.TwoFactorEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two factor authentication is already enabled"})
+		}
+
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			log.Printf("Error generating TOTP secret: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		encrypted, err := utils.Encrypt(secret)
+		if err != nil {
+			log.Printf("Error encrypting TOTP secret: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := db.Model(&user).Updates(map[string]any{"totp_secret": encrypted, "totp_last_step": 0}).Error; err != nil {
+			log.Printf("Error saving TOTP secret: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		issuer := utils.GetEnv("TOTP_ISSUER", "User Management")
+		return c.JSON(dto.TwoFactorSetupResponse{
+			Secret:     secret,
+			OtpauthURI: utils.TOTPURI(issuer, user.Email, secret),
+		})
+	}
+}
+
+// ConfirmTwoFactor godoc
+// @Summary Confirm two factor enrolment
+// @Description Enable two factor authentication with the first code from the authenticator app. The recovery codes are only shown in this response.
+// @Tags two-factor
+// @Accept json
+// @Produce json
+// @Param request body dto.TwoFactorCodeRequest true "TOTP code"
+// @Success 200 {object} dto.RecoveryCodesResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, setup not started, already enabled or invalid code"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/2fa/confirm [post]
+func ConfirmTwoFactor(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.TwoFactorCodeRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		userID := c.Locals("userID").(uint)
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if user.TwoFactorEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two factor authentication is already enabled"})
+		}
+		if user.TOTPSecret == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two factor setup has not been started"})
+		}
+
+		secret, err := utils.Decrypt(user.TOTPSecret)
+		if err != nil {
+			log.Printf("Error decrypting TOTP secret: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		step, ok := utils.ValidateTOTP(secret, input.Code, time.Now(), user.TOTPLastStep)
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid code"})
+		}
+
+		var codes []string
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&user).Updates(map[string]any{"two_factor_enabled": true, "totp_last_step": step}).Error; err != nil {
+				return err
+			}
+			codes, err = generateRecoveryCodes(tx, user.ID)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error enabling two factor authentication: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(dto.RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// DisableTwoFactor godoc
+// @Summary Disable two factor authentication
+// @Description Turn off two factor authentication for the logged in user, a current TOTP code or a recovery code is required
+// @Tags two-factor
+// @Accept json
+// @Produce json
+// @Param request body dto.TwoFactorCodeRequest true "TOTP or recovery code"
+// @Success 200 {object} object{message=string}
+// @Failure 400 {object} object{error=string} "Invalid request body, not enabled or invalid code"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/2fa/disable [post]
+func DisableTwoFactor(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.TwoFactorCodeRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		userID := c.Locals("userID").(uint)
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if !user.TwoFactorEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two factor authentication is not enabled"})
+		}
+
+		ok, err := verifySecondFactor(db, &user, input.Code)
+		if err != nil {
+			log.Printf("Error verifying second factor: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid code"})
+		}
+
+		if err := resetTwoFactor(db, user.ID); err != nil {
+			log.Printf("Error disabling two factor authentication: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Two factor authentication disabled"})
+	}
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary Regenerate recovery codes
+// @Description Replace all recovery codes of the logged in user, a current TOTP code or a recovery code is required
+// @Tags two-factor
+// @Accept json
+// @Produce json
+// @Param request body dto.TwoFactorCodeRequest true "TOTP or recovery code"
+// @Success 200 {object} dto.RecoveryCodesResponse
+// @Failure 400 {object} object{error=string} "Invalid request body, not enabled or invalid code"
+// @Failure 401 {object} object{error=string} "Unauthorized"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/2fa/recovery-codes [post]
+func RegenerateRecoveryCodes(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.TwoFactorCodeRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		userID := c.Locals("userID").(uint)
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+		}
+		if !user.TwoFactorEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Two factor authentication is not enabled"})
+		}
+
+		ok, err := verifySecondFactor(db, &user, input.Code)
+		if err != nil {
+			log.Printf("Error verifying second factor: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid code"})
+		}
+
+		var codes []string
+		err = db.Transaction(func(tx *gorm.DB) error {
+			codes, err = generateRecoveryCodes(tx, user.ID)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error generating recovery codes: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(dto.RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// ResetUserTwoFactor godoc
+// @Summary Reset two factor authentication of a user
+// @Description Turn off two factor authentication for a user who lost their authenticator and recovery codes (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/2fa [delete]
+func ResetUserTwoFactor(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := resetTwoFactor(db, user.ID); err != nil {
+			log.Printf("Error resetting two factor authentication: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserTwoFactorReset, TargetType: "user", TargetID: user.ID})
+		return c.JSON(fiber.Map{"message": "Two factor authentication reset successfully"})
+	}
+}
+
+func resetTwoFactor(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"two_factor_enabled": false,
+			"totp_secret":        "",
+			"totp_last_step":     0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
@@ -3,27 +3,56 @@ package controllers
 import (
 	"errors"
 	"log"
+	"strconv"
+	"time"
 
+	"github.com/aotsurasak46/user-management/audit"
 	_ "github.com/aotsurasak46/user-management/docs"
 	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/limiter"
+	"github.com/aotsurasak46/user-management/mailer"
 	"github.com/aotsurasak46/user-management/models"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+func toUserResponse(user models.User) dto.UserResponse {
+	response := dto.UserResponse{
+		ID:                  user.ID,
+		CreatedAt:           user.CreatedAt,
+		UpdatedAt:           user.UpdatedAt,
+		Name:                user.Name,
+		Email:               user.Email,
+		Role:                user.Role,
+		EmailVerified:       user.EmailVerified,
+		TwoFactorEnabled:    user.TwoFactorEnabled,
+		Status:              user.Status,
+		SuspendedUntil:      user.SuspendedUntil,
+		AvatarURLs:          avatarURLs(user.AvatarKey),
+		DeletionScheduledAt: user.DeletionScheduledAt,
+	}
+	if user.DeletedAt.Valid {
+		response.DeletedAt = &user.DeletedAt.Time
+	}
+	return response
+}
+
 // CreateUser godoc
 // @Summary Create a new user
-// @Description Create a new user with the provided information (Admin only)
+// @Description Create a new user with the provided information (requires users:write, and every permission of the role). Unless skip_verification is set, a verification link is sent to the email.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param user body dto.UserCreateRequest true "User Information"
 // @Success 201 {object} dto.UserResponse
-// @Failure 400 {object} object{error=string} "Invalid request body, invalid role or email already exists"
+// @Failure 400 {object} object{error=string} "Invalid request body, invalid role, email already exists or invalid attributes"
+// @Failure 403 {object} object{error=string} "Role has permissions the logged in user doesn't have"
+// @Failure 409 {object} object{error=string} "Value of a unique attribute already taken"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/users [post]
-func CreateUser(db *gorm.DB) fiber.Handler {
+func CreateUser(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		inputUser := new(dto.UserCreateRequest)
 		if err := c.BodyParser(&inputUser); err != nil {
@@ -34,20 +63,38 @@ func CreateUser(db *gorm.DB) fiber.Handler {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Input can't be empty"})
 		}
 
-		validRoles := map[string]bool{
-			"user":  true,
-			"admin": true,
-		}
-		if !validRoles[inputUser.Role] {
+		if valid, err := roleExists(db, inputUser.Role); err != nil {
+			log.Printf("Error finding role in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !valid {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
 		}
+		if allowed, err := canAssignRole(db, c, inputUser.Role); err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		} else if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't assign a role with permissions you don't have"})
+		}
 
 		var existingUser models.User
-		if err := db.Unscoped().Where("email = ?", inputUser.Email).First(&existingUser).Error; err == nil {
+		if err := db.Where("email = ?", inputUser.Email).First(&existingUser).Error; err == nil {
 			log.Printf("Duplicate email detected: %v", inputUser.Email)
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email already exists"})
 		}
 
+		view, err := newAttributeView(db, c)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		attributes, err := view.merge(nil, inputUser.Attributes, 0, true)
+		if err == nil {
+			err = view.checkUniqueAttributes(db, attributes, inputUser.Attributes, 0)
+		}
+		if err != nil {
+			return attributeRequestError(c, err)
+		}
+
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(inputUser.Password), bcrypt.DefaultCost)
 		if err != nil {
 			log.Printf("Error hashing password: %v", err)
@@ -55,40 +102,119 @@ func CreateUser(db *gorm.DB) fiber.Handler {
 		}
 
 		user := &models.User{
-			Name:     inputUser.Name,
-			Email:    inputUser.Email,
-			Password: string(hashedPassword),
-			Role:     inputUser.Role,
+			Name:       inputUser.Name,
+			Email:      inputUser.Email,
+			Password:   string(hashedPassword),
+			Role:       inputUser.Role,
+			Attributes: attributes,
+		}
+		if inputUser.SkipVerification {
+			now := time.Now()
+			user.EmailVerified = true
+			user.EmailVerifiedAt = &now
 		}
 
-		if err := db.Create(user).Error; err != nil {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+			// the user joins the organization of the admin creating them
+			organizationID := c.Locals("organizationID").(*uint)
+			return addMembership(tx, *organizationID, user.ID, models.OrganizationRoleMember)
+		})
+		if err != nil {
 			log.Printf("Error creating user: %v", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserCreate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    audit.Diff(nil, view.userResponse(*user)),
+		})
 
-		return c.Status(fiber.StatusCreated).JSON(user)
+		if !user.EmailVerified {
+			if err := sendVerificationEmail(db, mail, user, user.Email); err != nil {
+				log.Printf("Error sending verification email: %v", err)
+			}
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(view.userResponse(*user))
 	}
 }
 
 // GetUsers godoc
-// @Summary Get all users
-// @Description Retrieve a list of all users from the database
+// @Summary Get users
+// @Description List the users of the current organization one page at a time. Pages are reached with offset or, faster on large directories, with the next_cursor of the previous page.
 // @Tags users
 // @Accept json
 // @Produce json
-// @Success 200 {array} dto.UserResponse
+// @Param limit query int false "Page size, 1 to 200" default(50)
+// @Param offset query int false "Users to skip, can't be combined with cursor"
+// @Param cursor query string false "next_cursor of the previous page, needs the same sort"
+// @Param sort query string false "Comma separated fields out of id, name, email, role, created_at and updated_at, prefixed with - for descending" default(id)
+// @Param role query string false "Only users with this role"
+// @Param status query string false "Only users with this status: active, suspended or banned"
+// @Param group query int false "Only members of this group"
+// @Param name query string false "Name prefix, case insensitive"
+// @Param email query string false "Email prefix, case insensitive"
+// @Param created_after query string false "Created at or after this RFC 3339 time"
+// @Param created_before query string false "Created before this RFC 3339 time"
+// @Param deleted query string false "exclude, include or only deleted users" default(exclude)
+// @Param attr.name query string false "Only users whose custom attribute name, replaced by the attribute name, has this value. Private and admin attributes need users:write."
+// @Success 200 {object} dto.UserListResponse
+// @Failure 400 {object} object{error=string} "Invalid query parameter or cursor"
+// @Failure 403 {object} object{error=string} "Listing deleted users requires users:write"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/users [get]
 func GetUsers(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		users := new([]models.User)
-		result := db.Find(&users)
-		if result.Error != nil {
-			log.Printf("Error getting users from database: %v", result.Error)
+		view, err := newAttributeView(db, c)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		return c.JSON(users)
+		query, err := parseUserListQuery(c, view)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if query.deleted != "exclude" && !view.admin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Listing deleted users requires users:write"})
+		}
+		return listUsers(db, c, query, view)
+	}
+}
+
+// listUsers responds with the page of users the query asks for.
+func listUsers(db *gorm.DB, c *fiber.Ctx, query *userListQuery, view *attributeView) error {
+	filtered := query.filter(db.WithContext(c.UserContext()).Model(&models.User{}))
+	var total int64
+	if err := filtered.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Error counting users in database: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	var users []models.User
+	if err := query.page(filtered.Session(&gorm.Session{})).Find(&users).Error; err != nil {
+		log.Printf("Error getting users from database: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	response := dto.UserListResponse{
+		Data:   make([]dto.UserResponse, 0, len(users)),
+		Total:  total,
+		Limit:  query.limit,
+		Offset: query.offset,
+	}
+	if len(users) > query.limit {
+		users = users[:query.limit]
+		response.NextCursor = query.nextCursor(c, users[len(users)-1])
+	}
+	for _, user := range users {
+		response.Data = append(response.Data, view.userResponse(user))
 	}
+	return c.JSON(response)
 }
 
 // GetUserById godoc
@@ -101,6 +227,7 @@ func GetUsers(db *gorm.DB) fiber.Handler {
 // @Success 200 {object} dto.UserResponse
 // @Failure 400 {object} object{error=string} "Bad request or User ID is missing"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/users/:id [get]
 func GetUserById(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -110,7 +237,7 @@ func GetUserById(db *gorm.DB) fiber.Handler {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User ID is required"})
 		}
 		user := new(models.User)
-		result := db.Where("id = ?", userId).First(&user)
+		result := db.WithContext(c.UserContext()).Where("id = ?", userId).First(&user)
 		if result.Error != nil {
 			log.Printf("Error finding user in database: %v", result.Error)
 			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -118,22 +245,30 @@ func GetUserById(db *gorm.DB) fiber.Handler {
 			}
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		return c.JSON(user)
+		view, err := newAttributeView(db, c)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(view.userResponse(*user))
 	}
 }
 
 // UpdateUser godoc
 // @Summary Update User by id
-// @Description Update a user information by using id (Admin only)
+// @Description Update a user information by using id (requires users:write). Changing the role also requires every permission of the old and the new role.
 // @Tags users
 // @Accept json
 // @Produce json
 // @param id path int true "User id"
 // @Param user body  dto.UserUpdateRequest true "User Information"
 // @Success 200 {object} dto.UserResponse
-// @Failure 400 {object} object{error=string} "Bad request, invalid request body, invalid role, email is existed or invalid role"
+// @Failure 400 {object} object{error=string} "Bad request, invalid request body, invalid role, email is existed or invalid attributes"
+// @Failure 403 {object} object{error=string} "Role of the logged in user can't be changed, or the new or old role has permissions the logged in user doesn't have"
 // @Failure 404 {object} object{error=string} "User not found"
+// @Failure 409 {object} object{error=string} "Value of a unique attribute already taken"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/users/:id [put]
 func UpdateUser(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -150,17 +285,23 @@ func UpdateUser(db *gorm.DB) fiber.Handler {
 		}
 
 		var user models.User
-		if err := db.First(&user, userId).Error; err != nil {
+		if err := db.WithContext(c.UserContext()).First(&user, userId).Error; err != nil {
 			log.Printf("Error finding user in database: %v", err)
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 			}
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
+		view, err := newAttributeView(db, c)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		before := view.userResponse(user)
 
 		if input.Email != "" && input.Email != user.Email {
 			var existing models.User
-			if err := db.Unscoped().Where("email = ?", input.Email).First(&existing).Error; err == nil {
+			if err := db.Where("email = ?", input.Email).First(&existing).Error; err == nil {
 				log.Printf("Duplicate email detected: %v", input.Email)
 				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email already exists"})
 			}
@@ -171,28 +312,57 @@ func UpdateUser(db *gorm.DB) fiber.Handler {
 			user.Name = input.Name
 		}
 
-		if input.Role != "" {
-			validRoles := map[string]bool{
-				"user":  true,
-				"admin": true,
-			}
-			if !validRoles[input.Role] {
+		if input.Role != "" && input.Role != user.Role && user.ID == c.Locals("userID") {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change your own role"})
+		}
+		if input.Role != "" && input.Role != user.Role {
+			if valid, err := roleExists(db, input.Role); err != nil {
+				log.Printf("Error finding role in database: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			} else if !valid {
 				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid role"})
 			}
+			// neither the new role nor the one taken away may have more
+			// permissions than the caller
+			for _, role := range []string{input.Role, user.Role} {
+				if allowed, err := canAssignRole(db, c, role); err != nil {
+					log.Printf("Error loading permissions: %v", err)
+					return c.SendStatus(fiber.StatusInternalServerError)
+				} else if !allowed {
+					return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change a role to or from one with permissions you don't have"})
+				}
+			}
 			user.Role = input.Role
 		}
 
-		if err := db.Save(&user).Error; err != nil {
+		if input.Attributes != nil {
+			attributes, err := view.merge(user.Attributes, input.Attributes, user.ID, false)
+			if err == nil {
+				err = view.checkUniqueAttributes(db, attributes, input.Attributes, user.ID)
+			}
+			if err != nil {
+				return attributeRequestError(c, err)
+			}
+			user.Attributes = attributes
+		}
+
+		if err := db.WithContext(c.UserContext()).Save(&user).Error; err != nil {
 			log.Printf("Error updating user in database: %v", err)
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserUpdate,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    audit.Diff(before, view.userResponse(user)),
+		})
 
-		return c.JSON(user)
+		return c.JSON(view.userResponse(user))
 	}
 }
 
 // DeleteUser godoc
-// @Summary Delete User by id (Admin only)
+// @Summary Delete User by id (requires users:write)
 // @Description Delete a user from the database by using their id
 // @Tags users
 // @Accept json
@@ -202,6 +372,7 @@ func UpdateUser(db *gorm.DB) fiber.Handler {
 // @Failure 400 {object} object{error=string} "Bad request or User ID is missing"
 // @Failure 404 {object} object{error=string} "User not found"
 // @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
 // @Router /api/v1/users/:id [delete]
 func DeleteUser(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -210,13 +381,50 @@ func DeleteUser(db *gorm.DB) fiber.Handler {
 			log.Printf("User ID is missing in the request")
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User ID is required"})
 		}
-		if err := db.Delete(&models.User{}, userId).Error; err != nil {
-			log.Printf("Error deleting user from database: %v", err)
+		result := db.WithContext(c.UserContext()).Delete(&models.User{}, userId)
+		if result.Error != nil {
+			log.Printf("Error deleting user from database: %v", result.Error)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if result.RowsAffected == 0 {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+		}
+		if id, err := strconv.ParseUint(userId, 10, 64); err == nil {
+			if err := revokeUserSessions(db, uint(id), 0, "user deleted"); err != nil {
+				log.Printf("Error revoking sessions of deleted user: %v", err)
+			}
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserDelete, TargetType: "user", TargetID: userId})
+		return c.JSON(fiber.Map{"message": "User deleted successfully"})
+	}
+}
+
+// UnlockUser godoc
+// @Summary Unlock a locked out user
+// @Description Clear the failed login attempts and lockout of a user (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/lockout [delete]
+func UnlockUser(db *gorm.DB, guard *limiter.LoginGuard) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 			}
 			return c.SendStatus(fiber.StatusInternalServerError)
 		}
-		return c.JSON(fiber.Map{"message": "User deleted successfully"})
+		if err := guard.Unlock(c.Context(), user.Email); err != nil {
+			log.Printf("Error unlocking user: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserUnlock, TargetType: "user", TargetID: user.ID})
+		return c.JSON(fiber.Map{"message": "User unlocked successfully"})
 	}
 }
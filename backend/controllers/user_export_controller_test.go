@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/models"
+)
+
+func TestUserExportAttributeColumns(t *testing.T) {
+	view := &attributeView{viewerID: 5, definitions: []models.AttributeDefinition{
+		{Name: "department", Visibility: models.AttributeVisibilityPublic},
+		{Name: "employee_id", Visibility: models.AttributeVisibilityAdmin},
+		{Name: "phone", Visibility: models.AttributeVisibilityPrivate},
+	}}
+	attributes := exportedAttributes(view)
+	if want := []string{"department"}; !reflect.DeepEqual(attributes, want) {
+		t.Fatalf("got %v, want %v", attributes, want)
+	}
+	view.admin = true
+	attributes = exportedAttributes(view)
+	if want := []string{"department", "employee_id", "phone"}; !reflect.DeepEqual(attributes, want) {
+		t.Fatalf("got %v, want %v", attributes, want)
+	}
+
+	header := userExportHeader(attributes)
+	if got := header[len(userExportColumns):]; !reflect.DeepEqual(got, []string{"attr.department", "attr.employee_id", "attr.phone"}) {
+		t.Fatalf("got attribute columns %v", got)
+	}
+
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	row := userExportRow(dto.UserResponse{
+		ID:         1,
+		CreatedAt:  at,
+		UpdatedAt:  at,
+		Attributes: map[string]any{"department": "Sales", "employee_id": float64(1042)},
+	}, attributes)
+	if len(row) != len(header) {
+		t.Fatalf("got %d cells for %d columns", len(row), len(header))
+	}
+	if got := row[len(userExportColumns):]; !reflect.DeepEqual(got, []string{"Sales", "1042", ""}) {
+		t.Fatalf("got attribute cells %q", got)
+	}
+}
@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	netmail "net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxImportRows = 1000
+
+// parseUserImport reads the records from a CSV or JSON body.
+func parseUserImport(c *fiber.Ctx) ([]dto.UserImportRecord, error) {
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+		return parseUserImportCSV(c.Body())
+	}
+	var records []dto.UserImportRecord
+	if err := json.Unmarshal(c.Body(), &records); err != nil {
+		return nil, errors.New("body must be a JSON array of users or a CSV file")
+	}
+	return records, nil
+}
+
+func parseUserImportCSV(body []byte) ([]dto.UserImportRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV file needs a header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"name", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("CSV file is missing the %s column", required)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	var records []dto.UserImportRecord
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV file: %v", err)
+		}
+		records = append(records, dto.UserImportRecord{
+			Name:     field(row, "name"),
+			Email:    field(row, "email"),
+			Password: field(row, "password"),
+			Role:     field(row, "role"),
+		})
+	}
+}
+
+// validateUserImport checks every record and returns one row per record.
+// Emails have to be unused by any user, a deleted user has to be restored
+// or purged before their email can be imported. Like CreateUser, the caller
+// can only give roles whose permissions they have.
+func validateUserImport(db *gorm.DB, c *fiber.Ctx, records []dto.UserImportRecord, invite bool) ([]dto.UserImportRow, error) {
+	var roles []string
+	if err := db.Model(&models.Role{}).Pluck("name", &roles).Error; err != nil {
+		return nil, err
+	}
+	assignable := map[string]bool{}
+	for _, role := range roles {
+		ok, err := canAssignRole(db, c, role)
+		if err != nil {
+			return nil, err
+		}
+		assignable[role] = ok
+	}
+
+	emails := make([]string, 0, len(records))
+	for i := range records {
+		records[i].Name = strings.TrimSpace(records[i].Name)
+		records[i].Email = strings.TrimSpace(records[i].Email)
+		records[i].Role = strings.TrimSpace(records[i].Role)
+		if records[i].Role == "" {
+			records[i].Role = "user"
+		}
+		emails = append(emails, strings.ToLower(records[i].Email))
+	}
+	var existing []models.User
+	if err := db.Unscoped().Select("email", "deleted_at").
+		Where("lower(email) IN ? AND purged_at IS NULL", emails).
+		Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for _, user := range existing {
+		taken[strings.ToLower(user.Email)] = user.DeletedAt.Valid
+	}
+
+	rows := make([]dto.UserImportRow, len(records))
+	seen := map[string]int{}
+	for i, record := range records {
+		row := dto.UserImportRow{Row: i + 1, Email: record.Email}
+		if record.Name == "" {
+			row.Errors = append(row.Errors, "name is required")
+		}
+		if address, err := netmail.ParseAddress(record.Email); err != nil || address.Address != record.Email {
+			row.Errors = append(row.Errors, "email is invalid")
+		}
+		email := strings.ToLower(record.Email)
+		if deleted, ok := taken[email]; ok && deleted {
+			row.Errors = append(row.Errors, "email belongs to a deleted user")
+		} else if ok {
+			row.Errors = append(row.Errors, "email already exists")
+		}
+		if first, ok := seen[email]; ok && email != "" {
+			row.Errors = append(row.Errors, fmt.Sprintf("email is a duplicate of row %d", first))
+		} else {
+			seen[email] = row.Row
+		}
+		if !slices.Contains(roles, record.Role) {
+			row.Errors = append(row.Errors, "role "+record.Role+" doesn't exist")
+		} else if !assignable[record.Role] {
+			row.Errors = append(row.Errors, "role "+record.Role+" has permissions you don't have")
+		}
+		if record.Password == "" && !invite {
+			row.Errors = append(row.Errors, "password is required unless invites are sent")
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// ImportUsers godoc
+// @Summary Import users in bulk
+// @Description Create many users from a JSON array or a CSV file with a name, email, password and role header (requires users:write). Every row is validated first and the users are only created when all rows are valid, in a single transaction. Rows can only give roles whose permissions the caller has. With dry_run nothing is created and the report shows what would happen. With invite, users without a password get an email with a link to choose one instead.
+// @Tags users
+// @Accept json,text/csv
+// @Produce json
+// @Param users body []dto.UserImportRecord true "Users to import"
+// @Param dry_run query bool false "Only validate the rows"
+// @Param invite query bool false "Send a link to choose a password to users without one"
+// @Success 200 {object} dto.UserImportResponse "Dry run report"
+// @Success 201 {object} dto.UserImportResponse "Users created"
+// @Failure 400 {object} object{error=string} "Invalid body or too many rows"
+// @Failure 422 {object} dto.UserImportResponse "Some rows are invalid, nothing was created"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/import [post]
+func ImportUsers(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		dryRun := c.QueryBool("dry_run", false)
+		invite := c.QueryBool("invite", false)
+
+		records, err := parseUserImport(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(records) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No users to import"})
+		}
+		if len(records) > maxImportRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("At most %d users can be imported at once", maxImportRows)})
+		}
+
+		rows, err := validateUserImport(db, c, records, invite)
+		if err != nil {
+			log.Printf("Error validating user import: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		response := dto.UserImportResponse{DryRun: dryRun, Valid: true, Rows: rows}
+		for _, row := range rows {
+			if len(row.Errors) > 0 {
+				response.Valid = false
+			}
+		}
+		if dryRun {
+			return c.JSON(response)
+		}
+		if !response.Valid {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(response)
+		}
+
+		users := make([]models.User, len(records))
+		for i, record := range records {
+			password := record.Password
+			if password == "" {
+				// nobody knows it, the invite link replaces it
+				if password, err = utils.GenerateRandomToken(32); err != nil {
+					log.Printf("Error generating password: %v", err)
+					return c.SendStatus(fiber.StatusInternalServerError)
+				}
+			}
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("Error hashing password: %v", err)
+				return c.SendStatus(fiber.StatusInternalServerError)
+			}
+			users[i] = models.User{
+				Name:     record.Name,
+				Email:    record.Email,
+				Password: string(hashedPassword),
+				Role:     record.Role,
+			}
+		}
+
+		// like CreateUser, the users join the organization of the admin
+		organizationID := c.Locals("organizationID").(*uint)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.CreateInBatches(&users, 100).Error; err != nil {
+				return err
+			}
+			memberships := make([]models.Membership, len(users))
+			for i, user := range users {
+				memberships[i] = models.Membership{OrganizationID: *organizationID, UserID: user.ID, Role: models.OrganizationRoleMember}
+			}
+			return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&memberships, 100).Error
+		})
+		if err != nil {
+			log.Printf("Error importing users: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		for i := range users {
+			user := &users[i]
+			response.Rows[i].UserID = user.ID
+			audit.Record(db, c, audit.Event{
+				Action:     audit.ActionUserCreate,
+				TargetType: "user",
+				TargetID:   user.ID,
+				Changes:    audit.Diff(nil, toUserResponse(*user)),
+			})
+			if records[i].Password == "" {
+				err = sendInviteEmail(db, mail, user)
+			} else {
+				err = sendVerificationEmail(db, mail, user, user.Email)
+			}
+			if err != nil {
+				log.Printf("Error sending email to imported user %d: %v", user.ID, err)
+			}
+		}
+		response.Created = len(users)
+		return c.Status(fiber.StatusCreated).JSON(response)
+	}
+}
+
+// sendInviteEmail mails a user who was created without a password a link to
+// choose one. It is a password reset link that lives longer.
+func sendInviteEmail(db *gorm.DB, mail mailer.Mailer, user *models.User) error {
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return err
+	}
+	ttl := utils.GetEnvDuration("USER_INVITE_TTL", 72*time.Hour)
+	if err := db.Create(&models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}).Error; err != nil {
+		return err
+	}
+
+	link := utils.GetEnv("APP_URL", "http://localhost:5173") + "/reset-password?token=" + token
+	return mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "You have been invited",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"An account has been created for you. Open the link below to choose your password. It expires in " + ttl.String() + ".\n\n" +
+			link,
+	})
+}
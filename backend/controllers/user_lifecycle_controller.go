@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/storage"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Message policies of a purge. Anonymizing keeps the conversations of the
+// other users intact and leaves a "Deleted user" placeholder as the author,
+// deleting removes every message the user sent or received.
+const (
+	PurgeMessagesAnonymize = "anonymize"
+	PurgeMessagesDelete    = "delete"
+)
+
+const deletedUserName = "Deleted user"
+
+func purgeMessagePolicy() string {
+	if utils.GetEnv("USER_PURGE_MESSAGE_POLICY", PurgeMessagesAnonymize) == PurgeMessagesDelete {
+		return PurgeMessagesDelete
+	}
+	return PurgeMessagesAnonymize
+}
+
+// GetDeletedUsers godoc
+// @Summary List deleted users
+// @Description List the soft deleted users that can still be restored or purged (requires users:write). Takes the same query parameters as GET /api/v1/users except deleted.
+// @Tags users
+// @Produce json
+// @Param limit query int false "Page size, at most 200" default(50)
+// @Param offset query int false "Users to skip, ignored when cursor is set" default(0)
+// @Param cursor query string false "next_cursor of the previous page, needs the same sort"
+// @Param sort query string false "Comma separated fields out of id, name, email, role, created_at and updated_at, prefixed with - for descending" default(id)
+// @Success 200 {object} dto.UserListResponse
+// @Failure 400 {object} object{error=string} "Invalid query parameter or cursor"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/deleted [get]
+func GetDeletedUsers(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		view, err := newAttributeView(db, c)
+		if err != nil {
+			log.Printf("Error loading attribute definitions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		query, err := parseUserListQuery(c, view)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		query.deleted = "only"
+		return listUsers(db, c, query, view)
+	}
+}
+
+// RestoreUser godoc
+// @Summary Restore a deleted user
+// @Description Undo the deletion of a user who has not been purged yet (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {object} dto.UserResponse
+// @Failure 404 {object} object{error=string} "Deleted user not found"
+// @Failure 409 {object} object{error=string} "Email is used by another user"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/restore [post]
+func RestoreUser(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := findDeletedUser(db.WithContext(c.UserContext()), c.Params("id"))
+		if err != nil {
+			log.Printf("Error finding deleted user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Deleted user not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// the email may have been taken by a new account meanwhile
+		var existing models.User
+		if err := db.Where("email = ?", user.Email).First(&existing).Error; err == nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email is used by another user"})
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if err := db.Unscoped().Model(user).Update("deleted_at", nil).Error; err != nil {
+			log.Printf("Error restoring user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserRestore, TargetType: "user", TargetID: user.ID})
+		return c.JSON(toUserResponse(*user))
+	}
+}
+
+// PurgeUser godoc
+// @Summary Purge a deleted user
+// @Description Permanently remove a deleted user with their sessions, tokens, identities and memberships. Their messages are anonymized or deleted depending on USER_PURGE_MESSAGE_POLICY (requires users:write).
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {object} object{message=string}
+// @Failure 404 {object} object{error=string} "Deleted user not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/purge [delete]
+func PurgeUser(db *gorm.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := findDeletedUser(db.WithContext(c.UserContext()), c.Params("id"))
+		if err != nil {
+			log.Printf("Error finding deleted user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Deleted user not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err := purgeUser(db, store, user.ID, purgeMessagePolicy()); err != nil {
+			log.Printf("Error purging user %d: %v", user.ID, err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		audit.Record(db, c, audit.Event{Action: audit.ActionUserPurge, TargetType: "user", TargetID: user.ID})
+		return c.JSON(fiber.Map{"message": "User purged successfully"})
+	}
+}
+
+// findDeletedUser finds a soft deleted user who has not been purged.
+func findDeletedUser(db *gorm.DB, id string) (*models.User, error) {
+	var user models.User
+	err := db.Unscoped().
+		Where("users.deleted_at IS NOT NULL AND users.purged_at IS NULL").
+		First(&user, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// purgeUser removes everything that belongs to the user, including their
+// avatar, data exports and the invitations that name their email. With the
+// anonymize policy the user row stays behind as a placeholder without any
+// personal data, so the messages of the other side keep their author.
+func purgeUser(db *gorm.DB, store storage.Storage, userID uint, policy string) error {
+	var purged models.User
+	if err := db.Unscoped().Select("avatar_key", "email").Where("id = ?", userID).Limit(1).Find(&purged).Error; err != nil {
+		return err
+	}
+	var exportKeys []string
+	if err := db.Model(&models.DataExport{}).Where("user_id = ? AND object_key <> ''", userID).Pluck("object_key", &exportKeys).Error; err != nil {
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		owned := []any{
+			&models.Session{},
+			&models.PersonalAccessToken{},
+			&models.RecoveryCode{},
+			&models.UserIdentity{},
+			&models.PasswordResetToken{},
+			&models.EmailVerificationToken{},
+			&models.Membership{},
+			&models.GroupMember{},
+			&models.UserStatusChange{},
+			&models.DataExport{},
+		}
+		for _, model := range owned {
+			if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ? OR lower(email) = lower(?)", userID, purged.Email).Delete(&models.Invitation{}).Error; err != nil {
+			return err
+		}
+
+		if policy == PurgeMessagesDelete {
+			if err := tx.Unscoped().Where("from_id = ? OR to_id = ?", userID, userID).Delete(&models.Message{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(&models.User{}, userID).Error
+		}
+
+		return tx.Unscoped().Model(&models.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"name":                  deletedUserName,
+			"email":                 fmt.Sprintf("deleted-%d@invalid", userID),
+			"password":              "",
+			"email_verified":        false,
+			"email_verified_at":     nil,
+			"two_factor_enabled":    false,
+			"totp_secret":           "",
+			"totp_last_step":        0,
+			"avatar_key":            "",
+			"attributes":            models.Attributes{},
+			"external_id":           "",
+			"deletion_scheduled_at": nil,
+			"purged_at":             time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	deleteAvatar(store, purged.AvatarKey)
+	for _, key := range exportKeys {
+		if err := store.Delete(context.Background(), key); err != nil {
+			log.Printf("Error deleting data export %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// RunAutoPurge purges users who were deleted more than USER_PURGE_AFTER_DAYS
+// days ago, once an hour until ctx is done. It does nothing when the setting
+// is 0 or missing.
+func RunAutoPurge(ctx context.Context, db *gorm.DB, store storage.Storage) {
+	days := utils.GetEnvInt("USER_PURGE_AFTER_DAYS", 0)
+	if days <= 0 {
+		return
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purgeExpiredUsers(db, store, retention)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeExpiredUsers(db *gorm.DB, store storage.Storage, retention time.Duration) {
+	var userIDs []uint
+	err := db.Unscoped().Model(&models.User{}).
+		Where("deleted_at < ? AND purged_at IS NULL", time.Now().Add(-retention)).
+		Pluck("id", &userIDs).Error
+	if err != nil {
+		log.Printf("Error finding users to purge: %v", err)
+		return
+	}
+	policy := purgeMessagePolicy()
+	for _, userID := range userIDs {
+		if err := purgeUser(db, store, userID, policy); err != nil {
+			log.Printf("Error purging user %d: %v", userID, err)
+			continue
+		}
+		log.Printf("Purged user %d deleted more than %s ago", userID, retention)
+	}
+}
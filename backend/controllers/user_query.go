@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// userSortColumns are the fields users can be sorted by, mapped to their
+// column. The id is always added last so the order is stable.
+var userSortColumns = map[string]string{
+	"id":         "users.id",
+	"name":       "users.name",
+	"email":      "users.email",
+	"role":       "users.role",
+	"created_at": "users.created_at",
+	"updated_at": "users.updated_at",
+}
+
+type userSort struct {
+	field      string
+	descending bool
+}
+
+// userListQuery is the parsed query string of GET /api/v1/users.
+type userListQuery struct {
+	limit  int
+	offset int
+	cursor *userCursor
+	sort   []userSort
+
+	role          string
+	status        string
+	group         string
+	namePrefix    string
+	emailPrefix   string
+	createdAfter  *time.Time
+	createdBefore *time.Time
+	deleted       string
+	// attributes are the attr.<name> filters, with their values converted
+	// to the attribute type
+	attributes models.Attributes
+}
+
+// userCursor points just after the last user of a page. It remembers the sort
+// it was made for, since its values only make sense with it.
+type userCursor struct {
+	Sort   string `json:"s"`
+	Values []any  `json:"v"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// userAttributeFilterPrefix starts the query parameters that filter by a
+// custom attribute, like attr.department=Sales.
+const userAttributeFilterPrefix = "attr."
+
+func parseUserListQuery(c *fiber.Ctx, view *attributeView) (*userListQuery, error) {
+	query := &userListQuery{
+		limit:       c.QueryInt("limit", defaultUserPageSize),
+		offset:      c.QueryInt("offset", 0),
+		role:        c.Query("role"),
+		status:      c.Query("status"),
+		group:       c.Query("group"),
+		namePrefix:  c.Query("name"),
+		emailPrefix: c.Query("email"),
+		deleted:     c.Query("deleted", "exclude"),
+	}
+	if query.limit < 1 || query.limit > maxUserPageSize {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxUserPageSize)
+	}
+	if query.offset < 0 {
+		return nil, errors.New("offset can't be negative")
+	}
+	if query.deleted != "exclude" && query.deleted != "include" && query.deleted != "only" {
+		return nil, errors.New("deleted must be exclude, include or only")
+	}
+
+	for _, param := range []struct {
+		name   string
+		target **time.Time
+	}{{"created_after", &query.createdAfter}, {"created_before", &query.createdBefore}} {
+		if value := c.Query(param.name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", param.name)
+			}
+			*param.target = &parsed
+		}
+	}
+
+	for param, value := range c.Queries() {
+		name, ok := strings.CutPrefix(param, userAttributeFilterPrefix)
+		if !ok {
+			continue
+		}
+		parsed, err := view.parseAttributeFilter(name, value)
+		if err != nil {
+			return nil, err
+		}
+		if query.attributes == nil {
+			query.attributes = models.Attributes{}
+		}
+		query.attributes[name] = parsed
+	}
+
+	sortParam := c.Query("sort", "id")
+	for _, field := range strings.Split(sortParam, ",") {
+		field = strings.TrimSpace(field)
+		sort := userSort{field: strings.TrimPrefix(field, "-"), descending: strings.HasPrefix(field, "-")}
+		if _, ok := userSortColumns[sort.field]; !ok {
+			return nil, fmt.Errorf("can't sort by %q", field)
+		}
+		query.sort = append(query.sort, sort)
+	}
+	if query.sort[len(query.sort)-1].field != "id" {
+		query.sort = append(query.sort, userSort{field: "id"})
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		if query.offset != 0 {
+			return nil, errors.New("use either cursor or offset")
+		}
+		decoded, err := decodeUserCursor(cursor)
+		if err != nil || decoded.Sort != sortParam || !decoded.fits(query.sort) {
+			return nil, errInvalidCursor
+		}
+		query.cursor = decoded
+	}
+	return query, nil
+}
+
+// escapeLike makes a user supplied string match literally in a LIKE pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// filter applies everything but the pagination, so the same query can be
+// counted.
+func (q *userListQuery) filter(db *gorm.DB) *gorm.DB {
+	switch q.deleted {
+	case "include":
+		db = db.Unscoped().Where("users.purged_at IS NULL")
+	case "only":
+		db = db.Unscoped().Where("users.deleted_at IS NOT NULL AND users.purged_at IS NULL")
+	}
+	if q.role != "" {
+		db = db.Where("users.role = ?", q.role)
+	}
+	if q.status != "" {
+		db = db.Where("users.status = ?", q.status)
+	}
+	if q.group != "" {
+		db = db.Where("users.id IN (?)", db.Session(&gorm.Session{NewDB: true}).
+			Model(&models.GroupMember{}).Select("user_id").Where("group_id = ?", q.group))
+	}
+	if q.namePrefix != "" {
+		db = db.Where("users.name ILIKE ?", escapeLike(q.namePrefix)+"%")
+	}
+	if q.emailPrefix != "" {
+		db = db.Where("users.email ILIKE ?", escapeLike(q.emailPrefix)+"%")
+	}
+	if q.createdAfter != nil {
+		db = db.Where("users.created_at >= ?", *q.createdAfter)
+	}
+	if q.createdBefore != nil {
+		db = db.Where("users.created_at < ?", *q.createdBefore)
+	}
+	if len(q.attributes) > 0 {
+		// containment is answered by the GIN index on attributes
+		containing, _ := json.Marshal(q.attributes)
+		db = db.Where("users.attributes @> ?::jsonb", string(containing))
+	}
+	return db
+}
+
+// order applies the sort.
+func (q *userListQuery) order(db *gorm.DB) *gorm.DB {
+	for _, sort := range q.sort {
+		direction := "ASC"
+		if sort.descending {
+			direction = "DESC"
+		}
+		db = db.Order(userSortColumns[sort.field] + " " + direction)
+	}
+	return db
+}
+
+// page applies the sort and either the cursor or the offset. One extra row is
+// fetched to know whether there is a next page.
+func (q *userListQuery) page(db *gorm.DB) *gorm.DB {
+	db = q.order(db)
+	if q.cursor != nil {
+		// (a > x) OR (a = x AND b > y) OR ..., with < for descending fields
+		var clauses []string
+		var args []any
+		for i, sort := range q.sort {
+			var parts []string
+			for j := 0; j < i; j++ {
+				parts = append(parts, userSortColumns[q.sort[j].field]+" = ?")
+				args = append(args, q.cursor.Values[j])
+			}
+			operator := ">"
+			if sort.descending {
+				operator = "<"
+			}
+			parts = append(parts, userSortColumns[sort.field]+" "+operator+" ?")
+			args = append(args, q.cursor.Values[i])
+			clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+		}
+		db = db.Where(strings.Join(clauses, " OR "), args...)
+	} else if q.offset > 0 {
+		db = db.Offset(q.offset)
+	}
+	return db.Limit(q.limit + 1)
+}
+
+// nextCursor makes the cursor for the page that starts after the user.
+func (q *userListQuery) nextCursor(c *fiber.Ctx, user models.User) string {
+	values := make([]any, len(q.sort))
+	for i, sort := range q.sort {
+		switch sort.field {
+		case "id":
+			values[i] = user.ID
+		case "name":
+			values[i] = user.Name
+		case "email":
+			values[i] = user.Email
+		case "role":
+			values[i] = user.Role
+		case "created_at":
+			values[i] = user.CreatedAt.Format(time.RFC3339Nano)
+		case "updated_at":
+			values[i] = user.UpdatedAt.Format(time.RFC3339Nano)
+		}
+	}
+	encoded, _ := json.Marshal(userCursor{Sort: c.Query("sort", "id"), Values: values})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeUserCursor(cursor string) (*userCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var decoded userCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+// fits checks that the cursor has a value of the right type for each sort
+// field and converts them to what the column holds. Cursors come from the
+// client, anything else would only fail in the database.
+func (cursor *userCursor) fits(sort []userSort) bool {
+	if len(cursor.Values) != len(sort) {
+		return false
+	}
+	for i, s := range sort {
+		switch s.field {
+		case "id":
+			// JSON numbers decode to float64
+			id, ok := cursor.Values[i].(float64)
+			if !ok || id < 0 || id >= math.MaxInt64 || id != math.Trunc(id) {
+				return false
+			}
+			cursor.Values[i] = uint(id)
+		case "created_at", "updated_at":
+			value, ok := cursor.Values[i].(string)
+			if !ok {
+				return false
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return false
+			}
+			cursor.Values[i] = parsed
+		default:
+			if _, ok := cursor.Values[i].(string); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"html"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+// userSearchDocument is the text full text search runs on, it has to match the
+// expression of the idx_users_search index.
+const userSearchDocument = "to_tsvector('simple', coalesce(users.name, '') || ' ' || coalesce(users.email, ''))"
+
+var searchTermSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// searchTerms splits the query into the words full text search and the
+// highlighting look for.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, term := range searchTermSeparators.Split(strings.ToLower(query), -1) {
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// prefixTSQuery matches every term as a prefix, so "jo sm" finds John Smith
+// while typing.
+func prefixTSQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term + ":*"
+	}
+	return strings.Join(parts, " & ")
+}
+
+// highlight escapes the text and wraps the parts of it that start with one of
+// the terms in <mark>.
+func highlight(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		for offset := 0; ; {
+			index := strings.Index(lower[offset:], term)
+			if index < 0 {
+				break
+			}
+			start := offset + index
+			// only match at the start of a word, like the prefix query
+			if previous, _ := utf8.DecodeLastRuneInString(lower[:start]); start == 0 || !isWordRune(previous) {
+				spans = append(spans, span{start, start + len(term)})
+			}
+			offset = start + len(term)
+		}
+	}
+	if len(spans) == 0 || len(lower) != len(text) {
+		return html.EscapeString(text)
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+	var builder strings.Builder
+	position := 0
+	for _, s := range spans {
+		if s.start < position {
+			if s.end <= position {
+				continue
+			}
+			s.start = position
+		}
+		builder.WriteString(html.EscapeString(text[position:s.start]))
+		builder.WriteString("<mark>" + html.EscapeString(text[s.start:s.end]) + "</mark>")
+		position = s.end
+	}
+	builder.WriteString(html.EscapeString(text[position:]))
+	return builder.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// SearchUsers godoc
+// @Summary Search users
+// @Description Search the users of the current organization by name and email. Words match as prefixes with full text search, and typos are tolerated through trigram similarity. Results are ranked best first.
+// @Tags users
+// @Produce json
+// @Param q query string true "Search text"
+// @Param limit query int false "Maximum number of results, 1 to 50" default(20)
+// @Param exclude_self query bool false "Leave out the logged in user, for picking someone to chat with"
+// @Success 200 {array} dto.UserSearchResult
+// @Failure 400 {object} object{error=string} "Missing search text or invalid limit"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/search [get]
+func SearchUsers(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		text := strings.TrimSpace(c.Query("q"))
+		terms := searchTerms(text)
+		if len(terms) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Search text can't be empty"})
+		}
+		limit := c.QueryInt("limit", defaultSearchLimit)
+		if limit < 1 || limit > maxSearchLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Limit must be between 1 and 50"})
+		}
+
+		tsQuery := prefixTSQuery(terms)
+		query := db.WithContext(c.UserContext()).Model(&models.User{}).
+			Select("users.*, ts_rank("+userSearchDocument+", to_tsquery('simple', ?)) + "+
+				"greatest(similarity(users.name, ?), similarity(users.email, ?)) AS rank", tsQuery, text, text).
+			Where(userSearchDocument+" @@ to_tsquery('simple', ?) OR users.name % ? OR users.email % ? OR users.email ILIKE ?",
+				tsQuery, text, text, escapeLike(text)+"%")
+		if c.QueryBool("exclude_self") {
+			query = query.Where("users.id <> ?", c.Locals("userID"))
+		}
+
+		var rows []struct {
+			models.User
+			Rank float64
+		}
+		if err := query.Order("rank DESC, users.id").Limit(limit).Find(&rows).Error; err != nil {
+			log.Printf("Error searching users: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		results := make([]dto.UserSearchResult, 0, len(rows))
+		for _, row := range rows {
+			results = append(results, dto.UserSearchResult{
+				User:           toUserResponse(row.User),
+				Rank:           row.Rank,
+				NameHighlight:  highlight(row.Name, terms),
+				EmailHighlight: highlight(row.Email, terms),
+			})
+		}
+		return c.JSON(results)
+	}
+}
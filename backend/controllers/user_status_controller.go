@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aotsurasak46/user-management/audit"
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// changeUserStatus sets the status of the user and records the change in
+// their status history. It runs in the transaction tx.
+func changeUserStatus(tx *gorm.DB, user *models.User, status string, until *time.Time, reason string, changedBy uint) error {
+	if err := tx.Model(user).Updates(map[string]any{
+		"status":          status,
+		"suspended_until": until,
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(&models.UserStatusChange{
+		UserID:    user.ID,
+		Status:    status,
+		Reason:    reason,
+		Until:     until,
+		ChangedBy: changedBy,
+	}).Error; err != nil {
+		return err
+	}
+	user.Status = status
+	user.SuspendedUntil = until
+	return nil
+}
+
+// SetUserStatus godoc
+// @Summary Suspend, ban or reactivate a user
+// @Description Change the status of a user to active, suspended or banned (requires users:write). A suspension ends at until, or when it is lifted if until is not set. Suspended and banned users can't log in or use their sessions and tokens, and their chat sockets are closed right away.
+// @Tags users
+// @Accept json
+// @Produce json
+// @param id path int true "User id"
+// @Param request body dto.UserStatusRequest true "New status"
+// @Success 200 {object} dto.UserResponse
+// @Failure 400 {object} object{error=string} "Invalid status, missing reason or until in the past"
+// @Failure 403 {object} object{error=string} "You can't change your own status"
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/status [put]
+func SetUserStatus(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.UserStatusRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		now := time.Now()
+		switch input.Status {
+		case models.UserStatusActive:
+			input.Until = nil
+		case models.UserStatusSuspended, models.UserStatusBanned:
+			if input.Reason == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Reason is required"})
+			}
+			if input.Status == models.UserStatusBanned && input.Until != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "A ban has no end, suspend the user instead"})
+			}
+			if input.Until != nil && !input.Until.After(now) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Until must be in the future"})
+			}
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Status must be active, suspended or banned"})
+		}
+
+		actorID := c.Locals("userID").(uint)
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if user.ID == actorID {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You can't change your own status"})
+		}
+
+		before := toUserResponse(user)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return changeUserStatus(tx, &user, input.Status, input.Until, input.Reason, actorID)
+		})
+		if err != nil {
+			log.Printf("Error updating user status in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		changes := audit.Diff(before, toUserResponse(user))
+		changes["reason"] = audit.Change{After: input.Reason}
+		audit.Record(db, c, audit.Event{
+			Action:     audit.ActionUserStatus,
+			TargetType: "user",
+			TargetID:   user.ID,
+			Changes:    changes,
+		})
+
+		if user.Blocked(now) {
+			disconnectUser(user.ID, "account "+user.Status)
+		}
+		return c.JSON(toUserResponse(user))
+	}
+}
+
+// GetUserStatusHistory godoc
+// @Summary Get the suspension history of a user
+// @Description List every status change of a user, newest first (requires users:write)
+// @Tags users
+// @Produce json
+// @param id path int true "User id"
+// @Success 200 {array} models.UserStatusChange
+// @Failure 404 {object} object{error=string} "User not found"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Security ApiKeyAuth
+// @Router /api/v1/users/:id/status/history [get]
+func GetUserStatusHistory(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var user models.User
+		if err := db.WithContext(c.UserContext()).First(&user, c.Params("id")).Error; err != nil {
+			log.Printf("Error finding user in database: %v", err)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		changes := []models.UserStatusChange{}
+		if err := db.Where("user_id = ?", user.ID).Order("created_at DESC, id DESC").Find(&changes).Error; err != nil {
+			log.Printf("Error getting user status history from database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(changes)
+	}
+}
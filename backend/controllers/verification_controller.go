@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aotsurasak46/user-management/dto"
+	"github.com/aotsurasak46/user-management/mailer"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// sendVerificationEmail mails the user a link proving they own email. Earlier
+// links for the user stop working.
+func sendVerificationEmail(db *gorm.DB, mail mailer.Mailer, user *models.User, email string) error {
+	token, err := utils.GenerateRandomToken(32)
+	if err != nil {
+		return err
+	}
+	ttl := utils.GetEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.EmailVerificationToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.EmailVerificationToken{
+			UserID:    user.ID,
+			Email:     email,
+			TokenHash: utils.HashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	link := utils.GetEnv("APP_URL", "http://localhost:5173") + "/verify-email?token=" + token
+	return mail.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Please confirm your email address by opening the link below. It expires in " + ttl.String() + ".\n\n" +
+			link,
+	})
+}
+
+// VerifyEmail godoc
+// @Summary Verify email
+// @Description Confirm the email address of an account using the token from the verification email. For an email change requested through /api/v1/me, this is when the new email replaces the old one.
+// @Tags authentication
+// @Accept json
+// @Produce json
+// @Param request body dto.VerifyEmailRequest true "Verification token"
+// @Success 200 {object} object{message=string} "Email verified"
+// @Failure 400 {object} object{error=string} "Invalid request body, or invalid or expired token"
+// @Failure 409 {object} object{error=string} "Email was taken by another account meanwhile"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/email/verify [post]
+func VerifyEmail(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.VerifyEmailRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Token == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Token can't be empty"})
+		}
+
+		errInvalidToken := errors.New("invalid or expired verification token")
+		errEmailTaken := errors.New("email already exists")
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var verification models.EmailVerificationToken
+			if err := tx.Where("token_hash = ?", utils.HashToken(input.Token)).First(&verification).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return errInvalidToken
+				}
+				return err
+			}
+			now := time.Now()
+			if verification.UsedAt != nil || now.After(verification.ExpiresAt) {
+				return errInvalidToken
+			}
+			result := tx.Model(&models.EmailVerificationToken{}).
+				Where("id = ? AND used_at IS NULL", verification.ID).
+				Update("used_at", now)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errInvalidToken
+			}
+			// an email change can race with another account taking the
+			// address after the link was sent
+			var users int64
+			if err := tx.Model(&models.User{}).
+				Where("lower(email) = lower(?) AND id <> ?", verification.Email, verification.UserID).
+				Count(&users).Error; err != nil {
+				return err
+			}
+			if users > 0 {
+				return errEmailTaken
+			}
+			return tx.Model(&models.User{}).Where("id = ?", verification.UserID).Updates(map[string]any{
+				"email":             verification.Email,
+				"email_verified":    true,
+				"email_verified_at": now,
+			}).Error
+		})
+		if err != nil {
+			if errors.Is(err, errInvalidToken) {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid or expired verification token"})
+			}
+			if errors.Is(err, errEmailTaken) {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Email already exists"})
+			}
+			log.Printf("Error verifying email: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(fiber.Map{"message": "Email verified successfully"})
+	}
+}
+
+// ResendVerificationEmail godoc
+// @Summary Resend verification email
+// @Description Send a new verification email. Requests for the same account within EMAIL_VERIFICATION_RESEND_INTERVAL send nothing. The response is the same whether or not the email is registered or throttled.
+// @Tags authentication
+// @Accept json
+// @Produce json
+// @Param request body dto.ResendVerificationRequest true "Account email"
+// @Success 200 {object} object{message=string} "Verification email sent if the account exists and is not verified"
+// @Failure 400 {object} object{error=string} "Invalid request body"
+// @Failure 500 {object} object{error=string} "Internal server error"
+// @Router /api/v1/email/resend [post]
+func ResendVerificationEmail(db *gorm.DB, mail mailer.Mailer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := new(dto.ResendVerificationRequest)
+		if err := c.BodyParser(input); err != nil {
+			log.Printf("Error parsing request body: %v", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+		if input.Email == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Email can't be empty"})
+		}
+		response := fiber.Map{"message": "If the account exists and is not verified, a verification email has been sent"}
+
+		var user models.User
+		if err := db.Where("email = ?", input.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.JSON(response)
+			}
+			log.Printf("Error finding user in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if user.EmailVerified {
+			return c.JSON(response)
+		}
+
+		interval := utils.GetEnvDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute)
+		var last models.EmailVerificationToken
+		err := db.Unscoped().Where("user_id = ?", user.ID).Order("created_at DESC").First(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error finding verification token in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if err == nil && time.Now().Before(last.CreatedAt.Add(interval)) {
+			// throttled silently, a 429 would tell that the account exists
+			return c.JSON(response)
+		}
+
+		if err := sendVerificationEmail(db, mail, &user, user.Email); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.JSON(response)
+	}
+}
@@ -6,6 +6,7 @@ import (
     "gorm.io/gorm"
 	"gorm.io/driver/postgres"
 	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/tenant"
 )
 
 var DB *gorm.DB
@@ -25,16 +26,135 @@ func ConnectDB() error {
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	err = db.AutoMigrate(&models.User{} ,&models.Message{})
+	err = db.AutoMigrate(&models.User{} ,&models.Message{}, &models.Session{}, &models.PasswordResetToken{}, &models.EmailVerificationToken{}, &models.RecoveryCode{}, &models.UserIdentity{}, &models.PersonalAccessToken{}, &models.LoginAttempt{}, &models.SigningKey{}, &models.Role{}, &models.Permission{}, &models.Organization{}, &models.Membership{}, &models.Group{}, &models.GroupMember{}, &models.UserStatusChange{}, &models.AuditEvent{}, &models.Invitation{}, &models.AttributeDefinition{}, &models.DataExport{})
 	if err != nil { 
 		return fmt.Errorf("failed to auto migrate database: %w", err)
 	}
+	if err := createSearchIndexes(db); err != nil {
+		return fmt.Errorf("failed to create search indexes: %w", err)
+	}
+	if err := protectAuditEvents(db); err != nil {
+		return fmt.Errorf("failed to protect audit events: %w", err)
+	}
+	if err := seedRoles(db); err != nil {
+		return fmt.Errorf("failed to seed roles: %w", err)
+	}
+	if err := seedDefaultOrganization(db); err != nil {
+		return fmt.Errorf("failed to seed default organization: %w", err)
+	}
+	if err := tenant.RegisterCallbacks(db); err != nil {
+		return fmt.Errorf("failed to register tenant callbacks: %w", err)
+	}
 	fmt.Println("Database migration completed!")
 	
     DB = db
 	return nil
 }
 
+// protectAuditEvents makes the audit_events table append-only by rejecting
+// updates, deletes and truncates in the database itself.
+func protectAuditEvents(db *gorm.DB) error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_events_no_change ON audit_events`,
+		`CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE FUNCTION audit_events_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events`,
+		`CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSearchIndexes backs the user search: a full text index on name and
+// email, and trigram indexes for the similarity match. The full text
+// expression has to stay the same as userSearchDocument in the controllers.
+func createSearchIndexes(db *gorm.DB) error {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		"CREATE INDEX IF NOT EXISTS idx_users_search ON users USING GIN (to_tsvector('simple', coalesce(users.name, '') || ' ' || coalesce(users.email, '')))",
+		"CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (name gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_users_email_trgm ON users USING GIN (email gin_trgm_ops)",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedRoles creates the permissions the code checks and the default roles.
+// Existing roles are left alone so changes made through the API are kept,
+// except that a permission added to the code is granted to the default roles
+// that list it.
+func seedRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		permissions := map[string]models.Permission{}
+		created := map[string]bool{}
+		for _, permission := range models.Permissions {
+			result := tx.Where(models.Permission{Name: permission.Name}).
+				Attrs(models.Permission{Description: permission.Description}).
+				FirstOrCreate(&permission)
+			if result.Error != nil {
+				return result.Error
+			}
+			permissions[permission.Name] = permission
+			if result.RowsAffected > 0 {
+				created[permission.Name] = true
+			}
+		}
+
+		for _, defaultRole := range models.DefaultRoles {
+			var role models.Role
+			result := tx.Where(models.Role{Name: defaultRole.Name}).
+				Attrs(models.Role{Description: defaultRole.Description}).
+				FirstOrCreate(&role)
+			if result.Error != nil {
+				return result.Error
+			}
+			var grant []models.Permission
+			for _, name := range defaultRole.Permissions {
+				if result.RowsAffected > 0 || created[name] {
+					grant = append(grant, permissions[name])
+				}
+			}
+			if len(grant) > 0 {
+				if err := tx.Model(&role).Association("Permissions").Append(grant); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+// seedDefaultOrganization creates the organization self registered users
+// join. When it is first created every existing user is moved into it, admins
+// as organization admins, so upgrading keeps everyone able to see each other.
+func seedDefaultOrganization(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		organization := models.Organization{Slug: models.DefaultOrganizationSlug}
+		result := tx.Where(organization).Attrs(models.Organization{Name: "Default"}).FirstOrCreate(&organization)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return tx.Exec(`
+			INSERT INTO memberships (organization_id, user_id, role, created_at, updated_at)
+			SELECT ?, id, CASE WHEN role = 'admin' THEN ? ELSE ? END, NOW(), NOW()
+			FROM users
+			WHERE deleted_at IS NULL`,
+			organization.ID, models.OrganizationRoleAdmin, models.OrganizationRoleMember).Error
+	})
+}
 
 func CloseDB() error {
 	sqlDB, err := DB.DB()
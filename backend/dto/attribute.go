@@ -0,0 +1,23 @@
+package dto
+
+type AttributeDefinitionCreateRequest struct {
+	Name        string   `json:"name"`
+	Label       string   `json:"label"`
+	Description string   `json:"description"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+	Required    bool     `json:"required"`
+	Unique      bool     `json:"unique"`
+	Visibility  string   `json:"visibility"`
+}
+
+// AttributeDefinitionUpdateRequest replaces the settings of an attribute. The
+// name and type can't change because the stored values depend on them.
+type AttributeDefinitionUpdateRequest struct {
+	Label       string   `json:"label"`
+	Description string   `json:"description"`
+	Options     []string `json:"options"`
+	Required    bool     `json:"required"`
+	Unique      bool     `json:"unique"`
+	Visibility  string   `json:"visibility"`
+}
@@ -0,0 +1,36 @@
+package dto
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type AuditEventResponse struct {
+	ID             uint            `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	ActorID        *uint           `json:"actor_id,omitempty"`
+	Action         string          `json:"action"`
+	TargetType     string          `json:"target_type,omitempty"`
+	TargetID       string          `json:"target_id,omitempty"`
+	Changes        json.RawMessage `json:"changes,omitempty" swaggertype:"object"`
+	IPAddress      string          `json:"ip_address,omitempty"`
+	RequestID      string          `json:"request_id,omitempty"`
+	OrganizationID *uint           `json:"organization_id,omitempty"`
+	PrevHash       string          `json:"prev_hash"`
+	Hash           string          `json:"hash"`
+}
+
+type AuditEventListResponse struct {
+	Data   []AuditEventResponse `json:"data"`
+	Total  int64                `json:"total"`
+	Limit  int                  `json:"limit"`
+	Offset int                  `json:"offset"`
+}
+
+// AuditVerifyResponse is the result of checking the hash chain. BrokenAt is
+// the first event that was changed, or follows a removed one.
+type AuditVerifyResponse struct {
+	Valid    bool  `json:"valid"`
+	Checked  int   `json:"checked"`
+	BrokenAt *uint `json:"broken_at,omitempty"`
+}
@@ -0,0 +1,34 @@
+package dto
+
+import (
+	"time"
+)
+
+// DataExportResponse is a data export of the logged in user. DownloadURL is
+// a signed link on the API server, set once the export is ready. It expires
+// after DATA_EXPORT_LINK_TTL, list the exports again for a fresh one.
+type DataExportResponse struct {
+	ID          uint       `json:"ID"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// DataExportMessage is a message in messages.json of a data export.
+type DataExportMessage struct {
+	ID        uint       `json:"ID"`
+	FromID    uint       `json:"from_id"`
+	ToID      uint       `json:"to_id"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// AccountDeletionRequest confirms the deletion of the logged in user with
+// their password.
+type AccountDeletionRequest struct {
+	Password string `json:"password"`
+}
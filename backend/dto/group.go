@@ -0,0 +1,24 @@
+package dto
+
+type GroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type GroupPermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+type GroupMemberAddRequest struct {
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type GroupResponse struct {
+	ID          uint     `json:"ID"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	// Members is only set when a single group is requested.
+	Members []MemberResponse `json:"members,omitempty"`
+}
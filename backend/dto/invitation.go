@@ -0,0 +1,42 @@
+package dto
+
+import (
+	"time"
+)
+
+type InvitationCreateRequest struct {
+	Email string `json:"email"`
+	// Role is the global role the invitee gets, user by default.
+	Role string `json:"role"`
+	// OrganizationRole is their role in the organization, member by default.
+	OrganizationRole string `json:"organization_role"`
+}
+
+type InvitationAcceptRequest struct {
+	Token    string `json:"token"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type InvitationResponse struct {
+	ID               uint       `json:"ID"`
+	CreatedAt        time.Time  `json:"created_at"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	OrganizationRole string     `json:"organization_role"`
+	Status           string     `json:"status"`
+	InvitedBy        uint       `json:"invited_by"`
+	SentAt           time.Time  `json:"sent_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	AcceptedAt       *time.Time `json:"accepted_at,omitempty"`
+	UserID           *uint      `json:"user_id,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+}
+
+// InvitationPreviewResponse is what the invitee sees before accepting.
+type InvitationPreviewResponse struct {
+	Email        string    `json:"email"`
+	Organization string    `json:"organization"`
+	Role         string    `json:"role"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
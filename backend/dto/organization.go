@@ -0,0 +1,39 @@
+package dto
+
+import (
+	"time"
+)
+
+type OrganizationCreateRequest struct {
+	Name string `json:"name"`
+}
+
+type OrganizationResponse struct {
+	ID   uint   `json:"ID"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	// Role is the role of the logged in user in the organization.
+	Role string `json:"role"`
+	// Active is set on the organization the session is working in.
+	Active bool `json:"active"`
+}
+
+// OrganizationJoinRequest accepts an invitation for an existing user.
+type OrganizationJoinRequest struct {
+	Token string `json:"token"`
+}
+
+type MemberAddRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type MemberUpdateRequest struct {
+	Role string `json:"role"`
+}
+
+type MemberResponse struct {
+	User     UserResponse `json:"user"`
+	Role     string       `json:"role"`
+	JoinedAt time.Time    `json:"joined_at"`
+}
@@ -0,0 +1,24 @@
+package dto
+
+// ProfileResponse is the logged in user. PendingEmail is the new email the
+// user asked for until they verify it.
+type ProfileResponse struct {
+	UserResponse
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+// ProfileUpdateRequest changes the name, email or public and private
+// attributes of the logged in user, fields that are left out are kept.
+// Attributes are merged like in UserUpdateRequest. Role is only there to
+// reject requests trying to change it.
+type ProfileUpdateRequest struct {
+	Name       *string        `json:"name"`
+	Email      *string        `json:"email"`
+	Attributes map[string]any `json:"attributes"`
+	Role       *string        `json:"role" swaggerignore:"true"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
@@ -0,0 +1,21 @@
+package dto
+
+type RoleCreateRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleUpdateRequest replaces the description and permissions of a role. Roles
+// can't be renamed because users refer to them by name.
+type RoleUpdateRequest struct {
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleResponse struct {
+	ID          uint     `json:"ID"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
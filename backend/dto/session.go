@@ -0,0 +1,15 @@
+package dto
+
+import (
+	"time"
+)
+
+type SessionResponse struct {
+	ID         uint      `json:"ID"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+}
@@ -0,0 +1,22 @@
+package dto
+
+import (
+	"time"
+)
+
+type PersonalAccessTokenCreateRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type PersonalAccessTokenResponse struct {
+	ID         uint       `json:"ID"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Token is only set in the response to creating the token.
+	Token string `json:"token,omitempty"`
+}
@@ -9,20 +9,91 @@ type UserCreateRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 	Role     string `json:"role"`
+	// SkipVerification marks the email as verified right away instead of
+	// sending a verification email.
+	SkipVerification bool           `json:"skip_verification"`
+	Attributes       map[string]any `json:"attributes"`
 }
 
+// UserUpdateRequest changes the fields that are set. Attributes are merged
+// into the current ones, null removes an attribute.
 type UserUpdateRequest struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Role  string `json:"role"`
+	Name       string         `json:"name"`
+	Email      string         `json:"email"`
+	Role       string         `json:"role"`
+	Attributes map[string]any `json:"attributes"`
 }
 
 type UserResponse struct {
-	ID        uint       `json:"ID"`
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	DeletedAt *time.Time `json:"deleted_at,omitempty"`
-	Name      string     `json:"name"`
-	Email     string     `json:"email"`
-	Role      string     `json:"role"`
+	ID               uint       `json:"ID"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`
+	Name             string     `json:"name"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role"`
+	EmailVerified    bool       `json:"email_verified"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	Status           string     `json:"status"`
+	SuspendedUntil   *time.Time `json:"suspended_until,omitempty"`
+	// AvatarURLs maps the thumbnail sizes in pixels to the URL of the
+	// avatar in that size, a path on the API server.
+	AvatarURLs map[string]string `json:"avatar_urls,omitempty"`
+	// Attributes are the custom attributes the caller may see.
+	Attributes map[string]any `json:"attributes,omitempty"`
+	// DeletionScheduledAt is when the account is deleted because the user
+	// asked for it.
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+}
+
+// UserStatusRequest changes the status of a user. Until only applies to a
+// suspension, without it the suspension lasts until it is lifted.
+type UserStatusRequest struct {
+	Status string     `json:"status"`
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+// UserListResponse is one page of users. NextCursor is set when there are more
+// users after this page, pass it back as the cursor query parameter.
+type UserListResponse struct {
+	Data       []UserResponse `json:"data"`
+	Total      int64          `json:"total"`
+	Limit      int            `json:"limit"`
+	Offset     int            `json:"offset,omitempty"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// UserSearchResult is a user matching a search. The highlights are HTML with
+// the matched fragments wrapped in <mark>, everything else escaped.
+type UserSearchResult struct {
+	User           UserResponse `json:"user"`
+	Rank           float64      `json:"rank"`
+	NameHighlight  string       `json:"name_highlight"`
+	EmailHighlight string       `json:"email_highlight"`
+}
+
+// UserImportRecord is one user of a bulk import. CSV files have the same
+// columns in a header row. Password is left empty when invites are sent.
+type UserImportRecord struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// UserImportRow is the outcome of one record, rows are numbered from 1
+// without the CSV header.
+type UserImportRow struct {
+	Row    int      `json:"row"`
+	Email  string   `json:"email"`
+	Errors []string `json:"errors,omitempty"`
+	UserID uint     `json:"user_id,omitempty"`
+}
+
+type UserImportResponse struct {
+	DryRun  bool            `json:"dry_run"`
+	Valid   bool            `json:"valid"`
+	Created int             `json:"created"`
+	Rows    []UserImportRow `json:"rows"`
 }
@@ -0,0 +1,136 @@
+// Package imaging checks uploaded pictures and scales them into square
+// thumbnails with the decoders of the standard library, JPEG, PNG and GIF.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format, use JPEG, PNG or GIF")
+	ErrInvalidImage      = errors.New("invalid image")
+	ErrTooLarge          = errors.New("image dimensions are too large")
+)
+
+// Format is how a thumbnail is encoded.
+type Format struct {
+	ContentType string
+	Extension   string
+}
+
+var (
+	JPEG = Format{ContentType: "image/jpeg", Extension: "jpg"}
+	PNG  = Format{ContentType: "image/png", Extension: "png"}
+)
+
+// Sniff returns the content type of data from its first bytes, whatever the
+// client claimed it to be.
+func Sniff(data []byte) (string, error) {
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return contentType, nil
+	default:
+		return "", ErrUnsupportedFormat
+	}
+}
+
+// Decode decodes data after checking that neither side is longer than
+// maxDimension, so a small file declaring a huge canvas is never expanded in
+// memory. Only the first frame of an animated GIF is kept.
+func Decode(data []byte, maxDimension int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return nil, ErrTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	return img, nil
+}
+
+// Square crops the centered square out of img.
+func Square(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	origin := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, origin, draw.Src)
+	return square
+}
+
+// Resize scales a square image to size by size pixels. Each target pixel is
+// the average of the source pixels it covers, which keeps downscaled
+// pictures smooth. Smaller sources are scaled up by repeating pixels.
+func Resize(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0, y1 := span(dy, side, size)
+		for dx := 0; dx < size; dx++ {
+			x0, x1 := span(dx, side, size)
+			var r, g, b, a, n uint32
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					pixel := row[x*4 : x*4+4]
+					r += uint32(pixel[0])
+					g += uint32(pixel[1])
+					b += uint32(pixel[2])
+					a += uint32(pixel[3])
+					n++
+				}
+			}
+			offset := dy*dst.Stride + dx*4
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// span returns the source pixels [from, to) under target pixel i, at least
+// one.
+func span(i, side, size int) (int, int) {
+	from := i * side / size
+	to := (i + 1) * side / size
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
+
+// FormatOf picks JPEG for opaque pictures and PNG for ones with transparency.
+func FormatOf(img *image.RGBA) Format {
+	if img.Opaque() {
+		return JPEG
+	}
+	return PNG
+}
+
+// Encode encodes img in format.
+func Encode(img *image.RGBA, format Format) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == JPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,320 @@
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Config controls which keys are generated and how often they rotate.
+type Config struct {
+	// Algorithm of new keys, RS256 or EdDSA.
+	Algorithm string
+	// RotateEvery is the age after which a new signing key is generated.
+	RotateEvery time.Duration
+	// Overlap is how long a replaced key keeps verifying tokens. It has to be
+	// longer than the lifetime of any token it signed.
+	Overlap time.Duration
+	// AcceptHS256 keeps accepting tokens signed with JWT_SECRET_KEY, for the
+	// tokens issued before the keyring was introduced. It is off by default
+	// and only meant for the refresh token lifetime after the upgrade.
+	AcceptHS256 bool
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		Algorithm:   utils.GetEnv("JWT_SIGNING_ALGORITHM", "RS256"),
+		RotateEvery: utils.GetEnvDuration("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+		Overlap:     utils.GetEnvDuration("JWT_KEY_OVERLAP", 24*time.Hour),
+		AcceptHS256: utils.GetEnvBool("JWT_ACCEPT_HS256", false),
+	}
+}
+
+type key struct {
+	id        string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+// Keyring signs tokens with the newest key and verifies them with any key
+// that hasn't expired. Keys live in the database so every replica uses the
+// same ones.
+type Keyring struct {
+	db     *gorm.DB
+	config Config
+
+	mutex      sync.RWMutex
+	keys       []key
+	reloadedAt time.Time
+}
+
+func New(db *gorm.DB, config Config) (*Keyring, error) {
+	if _, err := signingMethod(config.Algorithm); err != nil {
+		return nil, err
+	}
+	// checked up front so a fresh install fails with a config error instead of
+	// a failed encryption of the first key
+	if os.Getenv("ENCRYPTION_KEY") == "" {
+		return nil, fmt.Errorf("%w, it is required to encrypt the JWT signing keys", utils.ErrMissingEncryptionKey)
+	}
+	if config.AcceptHS256 {
+		if _, err := utils.HMACSecret(); err != nil {
+			return nil, fmt.Errorf("%w, it is required to accept HS256 tokens", err)
+		}
+	}
+	k := &Keyring{db: db, config: config}
+	if err := k.RotateIfDue(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWT signing algorithm %q", algorithm)
+	}
+}
+
+// reload reads the keys that can still verify tokens, newest first.
+func (k *Keyring) reload() error {
+	var rows []models.SigningKey
+	if err := k.db.Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("created_at DESC").
+		Find(&rows).Error; err != nil {
+		return err
+	}
+
+	keys := make([]key, 0, len(rows))
+	for _, row := range rows {
+		method, err := signingMethod(row.Algorithm)
+		if err != nil {
+			return err
+		}
+		private, err := decodePrivateKey(row.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to decode signing key %s: %w", row.KeyID, err)
+		}
+		keys = append(keys, key{
+			id:        row.KeyID,
+			method:    method,
+			private:   private,
+			createdAt: row.CreatedAt,
+			expiresAt: row.ExpiresAt,
+		})
+	}
+
+	k.mutex.Lock()
+	k.keys = keys
+	k.reloadedAt = time.Now()
+	k.mutex.Unlock()
+	return nil
+}
+
+// RotateIfDue generates a new signing key when there is none or the newest is
+// older than RotateEvery, and schedules the older keys to expire after the
+// overlap window. A table lock keeps replicas from rotating at the same time.
+func (k *Keyring) RotateIfDue() error {
+	err := k.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE signing_keys IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		var newest models.SigningKey
+		err := tx.Where("expires_at IS NULL").Order("created_at DESC").First(&newest).Error
+		if err == nil && time.Since(newest.CreatedAt) < k.config.RotateEvery {
+			return nil
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		row, err := generateKey(k.config.Algorithm)
+		if err != nil {
+			return err
+		}
+		expiresAt := time.Now().Add(k.config.Overlap)
+		if err := tx.Model(&models.SigningKey{}).
+			Where("expires_at IS NULL").
+			Update("expires_at", expiresAt).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(row).Error; err != nil {
+			return err
+		}
+		log.Printf("Rotated JWT signing key, new key id %s", row.KeyID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return k.reload()
+}
+
+// Run rotates keys on schedule and picks up keys rotated by other replicas
+// until ctx is cancelled.
+func (k *Keyring) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.RotateIfDue(); err != nil {
+				log.Printf("Error rotating JWT signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func generateKey(algorithm string) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported JWT signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := utils.Encrypt(base64.StdEncoding.EncodeToString(der))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt signing key: %w", err)
+	}
+	keyID, err := utils.GenerateRandomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SigningKey{
+		KeyID:      keyID,
+		Algorithm:  algorithm,
+		PrivateKey: encrypted,
+	}, nil
+}
+
+func decodePrivateKey(encrypted string) (crypto.Signer, error) {
+	encoded, err := utils.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key can't sign")
+	}
+	return signer, nil
+}
+
+// Sign signs the claims with the newest key and names it in the kid header.
+func (k *Keyring) Sign(claims jwt.MapClaims) (string, error) {
+	k.mutex.RLock()
+	if len(k.keys) == 0 {
+		k.mutex.RUnlock()
+		return "", errors.New("keyring has no signing key")
+	}
+	current := k.keys[0]
+	k.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(current.method, claims)
+	token.Header["kid"] = current.id
+	return token.SignedString(current.private)
+}
+
+// Keyfunc finds the public key for the kid of a token. Tokens without kid are
+// the HS256 tokens from before the keyring, never accepted with a weak
+// JWT_SECRET_KEY.
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if !k.config.AcceptHS256 {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		secret, err := utils.HMACSecret()
+		if err != nil {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return secret, nil
+	}
+
+	if found, ok := k.lookup(kid); ok {
+		if found.method.Alg() != token.Method.Alg() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return found.private.Public(), nil
+	}
+
+	// another replica may have rotated, but don't let unknown kids make
+	// every request hit the database
+	k.mutex.RLock()
+	recentlyReloaded := time.Since(k.reloadedAt) < 10*time.Second
+	k.mutex.RUnlock()
+	if !recentlyReloaded {
+		if err := k.reload(); err != nil {
+			return nil, err
+		}
+		if found, ok := k.lookup(kid); ok && found.method.Alg() == token.Method.Alg() {
+			return found.private.Public(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k *Keyring) lookup(kid string) (key, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	now := time.Now()
+	for _, candidate := range k.keys {
+		if candidate.id == kid && (candidate.expiresAt == nil || now.Before(*candidate.expiresAt)) {
+			return candidate, true
+		}
+	}
+	return key{}, false
+}
+
+func (k *Keyring) ValidMethods() []string {
+	methods := []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+	if k.config.AcceptHS256 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	return methods
+}
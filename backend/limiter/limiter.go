@@ -0,0 +1,111 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// Policy decides how failures on one kind of key are punished.
+type Policy struct {
+	// Window is how long a failure is remembered after the last one.
+	Window time.Duration
+	// After DelayAfter failures every further attempt has to wait BaseDelay,
+	// doubling with each failure up to MaxDelay.
+	DelayAfter int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// MaxFailures failures lock the key for LockoutDuration.
+	MaxFailures     int
+	LockoutDuration time.Duration
+}
+
+// Limiter throttles attempts for one kind of key, for example accounts.
+type Limiter struct {
+	store  Store
+	prefix string
+	policy Policy
+}
+
+func New(store Store, prefix string, policy Policy) *Limiter {
+	return &Limiter{store: store, prefix: prefix, policy: policy}
+}
+
+func (l *Limiter) key(id string) string {
+	return l.prefix + ":" + id
+}
+
+// Reserve counts an attempt of id before its outcome is known, so parallel
+// attempts can't all pass the check before the first failure is recorded. It
+// returns how long the caller has to wait instead, zero when the attempt was
+// counted and may go ahead. Attempts that don't fail are taken back with
+// Release or Reset.
+func (l *Limiter) Reserve(ctx context.Context, id string) (time.Duration, error) {
+	_, wait, err := l.store.Reserve(ctx, l.key(id), time.Now(), l.policy.Window, l.wait)
+	return wait, err
+}
+
+// wait returns how long id has to wait with the given attempts, zero when it
+// may try now.
+func (l *Limiter) wait(attempts Attempts, now time.Time) time.Duration {
+	if now.Before(attempts.LockedUntil) {
+		return attempts.LockedUntil.Sub(now)
+	}
+	if now.Sub(attempts.LastFailureAt) > l.policy.Window {
+		return 0
+	}
+	if l.policy.MaxFailures > 0 && attempts.Failures >= l.policy.MaxFailures {
+		// the attempts still in progress lock id if they fail
+		return max(l.delay(attempts.Failures), time.Second)
+	}
+	if attempts.Failures < l.policy.DelayAfter {
+		return 0
+	}
+	next := attempts.LastFailureAt.Add(l.delay(attempts.Failures))
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func (l *Limiter) delay(failures int) time.Duration {
+	delay := l.policy.BaseDelay
+	for i := l.policy.DelayAfter; i < failures && delay < l.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, l.policy.MaxDelay)
+}
+
+// Fail confirms that a reserved attempt failed and locks id once it reached
+// MaxFailures.
+func (l *Limiter) Fail(ctx context.Context, id string) error {
+	attempts, err := l.store.Get(ctx, l.key(id))
+	if err != nil {
+		return err
+	}
+	if l.policy.MaxFailures > 0 && attempts.Failures >= l.policy.MaxFailures {
+		return l.store.Lock(ctx, l.key(id), time.Now().Add(l.policy.LockoutDuration))
+	}
+	return nil
+}
+
+// Release takes back a reserved attempt that didn't fail.
+func (l *Limiter) Release(ctx context.Context, id string) error {
+	return l.store.Release(ctx, l.key(id))
+}
+
+// Reset forgets all failures and any lock of id.
+func (l *Limiter) Reset(ctx context.Context, id string) error {
+	return l.store.Reset(ctx, l.key(id))
+}
+
+// Locked reports until when id is locked, the zero time if it isn't.
+func (l *Limiter) Locked(ctx context.Context, id string) (time.Time, error) {
+	attempts, err := l.store.Get(ctx, l.key(id))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if time.Now().Before(attempts.LockedUntil) {
+		return attempts.LockedUntil, nil
+	}
+	return time.Time{}, nil
+}
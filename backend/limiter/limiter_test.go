@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReserveLimitsConcurrentAttempts(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		allowed int
+	}{
+		{"progressive delay", Policy{Window: time.Minute, DelayAfter: 3, BaseDelay: time.Second, MaxDelay: time.Minute}, 3},
+		{"lockout", Policy{Window: time.Minute, DelayAfter: 100, BaseDelay: time.Second, MaxDelay: time.Minute, MaxFailures: 10, LockoutDuration: time.Minute}, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := New(NewMemoryStore(), "account", test.policy)
+			ctx := context.Background()
+
+			var allowed atomic.Int32
+			var wg sync.WaitGroup
+			for range 1000 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					wait, err := l.Reserve(ctx, "bob@example.com")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if wait == 0 {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := int(allowed.Load()); got != test.allowed {
+				t.Fatalf("%d attempts got through, want %d", got, test.allowed)
+			}
+		})
+	}
+}
+
+func TestFailLocksAfterMaxFailures(t *testing.T) {
+	l := New(NewMemoryStore(), "account", Policy{Window: time.Minute, DelayAfter: 100, MaxFailures: 3, LockoutDuration: time.Minute})
+	ctx := context.Background()
+
+	for i := range 3 {
+		if wait, err := l.Reserve(ctx, "bob"); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: got %v %v, want it to go ahead", i, wait, err)
+		}
+		if err := l.Fail(ctx, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if until, err := l.Locked(ctx, "bob"); err != nil || until.IsZero() {
+		t.Fatalf("got %v %v, want bob locked", until, err)
+	}
+	if wait, err := l.Reserve(ctx, "bob"); err != nil || wait == 0 {
+		t.Fatalf("got %v %v, want a wait while locked", wait, err)
+	}
+}
+
+func TestReleaseTakesBackAnAttempt(t *testing.T) {
+	l := New(NewMemoryStore(), "ip", Policy{Window: time.Minute, DelayAfter: 100, MaxFailures: 2, LockoutDuration: time.Minute})
+	ctx := context.Background()
+
+	for i := range 5 {
+		if wait, err := l.Reserve(ctx, "10.0.0.1"); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: got %v %v, want it to go ahead", i, wait, err)
+		}
+		if err := l.Release(ctx, "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if until, err := l.Locked(ctx, "10.0.0.1"); err != nil || !until.IsZero() {
+		t.Fatalf("got %v %v, want the ip unlocked", until, err)
+	}
+}
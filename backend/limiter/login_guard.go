@@ -0,0 +1,131 @@
+package limiter
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aotsurasak46/user-management/utils"
+)
+
+// LoginGuard throttles failed logins both per account, against guessing one
+// user's password, and per client IP, against trying many accounts.
+type LoginGuard struct {
+	Account *Limiter
+	IP      *Limiter
+}
+
+// NewLoginGuardFromEnv builds the guard with the LOGIN_* policy settings.
+func NewLoginGuardFromEnv(store Store) *LoginGuard {
+	return &LoginGuard{
+		Account: New(store, "account", Policy{
+			Window:          utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+			DelayAfter:      3,
+			BaseDelay:       time.Second,
+			MaxDelay:        30 * time.Second,
+			MaxFailures:     utils.GetEnvInt("LOGIN_MAX_ACCOUNT_FAILURES", 10),
+			LockoutDuration: utils.GetEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		}),
+		IP: New(store, "ip", Policy{
+			Window:          utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+			DelayAfter:      10,
+			BaseDelay:       time.Second,
+			MaxDelay:        30 * time.Second,
+			MaxFailures:     utils.GetEnvInt("LOGIN_MAX_IP_FAILURES", 50),
+			LockoutDuration: utils.GetEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		}),
+	}
+}
+
+// pruner is a store that has to be told to forget old attempts.
+type pruner interface {
+	Prune(ctx context.Context, now time.Time, window time.Duration) error
+}
+
+// Run prunes the expired attempts of the store once every failure window
+// until ctx is done, so keys from rotating IPs or made up emails don't pile
+// up. It returns right away for stores that prune themselves.
+func (g *LoginGuard) Run(ctx context.Context) {
+	store, ok := g.Account.store.(pruner)
+	if !ok {
+		return
+	}
+	window := max(g.Account.policy.Window, g.IP.policy.Window)
+
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		if err := store.Prune(ctx, time.Now(), window); err != nil {
+			log.Printf("Error pruning login attempts: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// accountID normalizes the email so "Bob@x.com" and "bob@x.com" share a count.
+func accountID(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Reserve counts a login attempt against the account and the IP before the
+// credentials are checked. It returns how long the client has to wait before
+// trying this account again, zero when it may try now. Every reserved attempt
+// ends in Fail, Succeed or Release.
+func (g *LoginGuard) Reserve(ctx context.Context, email, ip string) (time.Duration, error) {
+	wait, err := g.Account.Reserve(ctx, accountID(email))
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	wait, err = g.IP.Reserve(ctx, ip)
+	if err == nil && wait == 0 {
+		return 0, nil
+	}
+	// the attempt isn't made, so it mustn't count against the account
+	if releaseErr := g.Account.Release(ctx, accountID(email)); releaseErr != nil {
+		return 0, releaseErr
+	}
+	return wait, err
+}
+
+// Fail confirms that a reserved attempt failed.
+func (g *LoginGuard) Fail(ctx context.Context, email, ip string) error {
+	if err := g.Account.Fail(ctx, accountID(email)); err != nil {
+		return err
+	}
+	return g.IP.Fail(ctx, ip)
+}
+
+// Succeed clears the failures of the account and takes back the attempt of
+// the IP. The IP keeps its other failures so one valid account can't be used
+// to reset the limit while guessing others.
+func (g *LoginGuard) Succeed(ctx context.Context, email, ip string) error {
+	if err := g.Account.Reset(ctx, accountID(email)); err != nil {
+		return err
+	}
+	return g.IP.Release(ctx, ip)
+}
+
+// Release takes back a reserved attempt that was neither a success nor a
+// failure, for example because of an internal error.
+func (g *LoginGuard) Release(ctx context.Context, email, ip string) error {
+	if err := g.Account.Release(ctx, accountID(email)); err != nil {
+		return err
+	}
+	return g.IP.Release(ctx, ip)
+}
+
+// Unlock lifts a lockout of the account, used by admins.
+func (g *LoginGuard) Unlock(ctx context.Context, email string) error {
+	return g.Account.Reset(ctx, accountID(email))
+}
+
+// LockedUntil reports until when the account is locked, the zero time if it
+// isn't.
+func (g *LoginGuard) LockedUntil(ctx context.Context, email string) (time.Time, error) {
+	return g.Account.Locked(ctx, accountID(email))
+}
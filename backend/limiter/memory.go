@@ -0,0 +1,94 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps attempts in process memory. Counts are lost on restart
+// and not shared between replicas.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	attempts map[string]*Attempts
+	writes   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: make(map[string]*Attempts)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Attempts, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if attempts, ok := s.attempts[key]; ok {
+		return *attempts, nil
+	}
+	return Attempts{}, nil
+}
+
+func (s *MemoryStore) Reserve(ctx context.Context, key string, now time.Time, window time.Duration, wait func(Attempts, time.Time) time.Duration) (Attempts, time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if attempts, ok := s.attempts[key]; ok {
+		if wait := wait(*attempts, now); wait > 0 {
+			return *attempts, wait, nil
+		}
+	}
+
+	s.writes++
+	if s.writes%1000 == 0 {
+		s.prune(now, window)
+	}
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = &Attempts{}
+		s.attempts[key] = attempts
+	}
+	if now.Sub(attempts.LastFailureAt) > window {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	return *attempts, 0, nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if attempts, ok := s.attempts[key]; ok && attempts.Failures > 0 {
+		attempts.Failures--
+	}
+	return nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = &Attempts{}
+		s.attempts[key] = attempts
+	}
+	attempts.Failures = 0
+	attempts.LockedUntil = until
+	return nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// prune drops keys whose failures and lock have both run out.
+func (s *MemoryStore) prune(now time.Time, window time.Duration) {
+	for key, attempts := range s.attempts {
+		if now.Sub(attempts.LastFailureAt) > window && now.After(attempts.LockedUntil) {
+			delete(s.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aotsurasak46/user-management/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PostgresStore keeps attempts in the login_attempts table so that all
+// backend replicas share them.
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func toAttempts(row models.LoginAttempt) Attempts {
+	attempts := Attempts{Failures: row.Failures, LastFailureAt: row.LastFailureAt}
+	if row.LockedUntil != nil {
+		attempts.LockedUntil = *row.LockedUntil
+	}
+	return attempts
+}
+
+func (s *PostgresStore) Get(ctx context.Context, key string) (Attempts, error) {
+	var row models.LoginAttempt
+	if err := s.db.WithContext(ctx).Where("key = ?", key).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Attempts{}, nil
+		}
+		return Attempts{}, err
+	}
+	return toAttempts(row), nil
+}
+
+// Reserve locks the row of the key for the check and the increment, so
+// concurrent reservations on different replicas wait for each other. A row
+// without failures is created first to have something to lock.
+func (s *PostgresStore) Reserve(ctx context.Context, key string, now time.Time, window time.Duration, wait func(Attempts, time.Time) time.Duration) (Attempts, time.Duration, error) {
+	var attempts Attempts
+	var delay time.Duration
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`
+			INSERT INTO login_attempts (key, failures, last_failure_at)
+			VALUES (?, 0, ?)
+			ON CONFLICT (key) DO NOTHING
+		`, key, now).Error; err != nil {
+			return err
+		}
+		var row models.LoginAttempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&row).Error; err != nil {
+			return err
+		}
+		attempts = toAttempts(row)
+		if delay = wait(attempts, now); delay > 0 {
+			return nil
+		}
+		if now.Sub(attempts.LastFailureAt) > window {
+			attempts.Failures = 0
+		}
+		attempts.Failures++
+		attempts.LastFailureAt = now
+		return tx.Model(&row).Updates(map[string]any{"failures": attempts.Failures, "last_failure_at": now}).Error
+	})
+	if err != nil {
+		return Attempts{}, 0, err
+	}
+	return attempts, delay, nil
+}
+
+func (s *PostgresStore) Release(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Exec(`
+		UPDATE login_attempts SET failures = failures - 1 WHERE key = ? AND failures > 0
+	`, key).Error
+}
+
+func (s *PostgresStore) Lock(ctx context.Context, key string, until time.Time) error {
+	return s.db.WithContext(ctx).Exec(`
+		INSERT INTO login_attempts (key, failures, last_failure_at, locked_until)
+		VALUES (?, 0, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = 0, locked_until = EXCLUDED.locked_until
+	`, key, time.Now(), until).Error
+}
+
+func (s *PostgresStore) Reset(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Where("key = ?", key).Delete(&models.LoginAttempt{}).Error
+}
+
+// Prune deletes the rows whose last failure is older than the window and
+// whose lock has run out. Unlike the memory store the table isn't pruned on
+// the way, so LoginGuard.Run calls this periodically.
+func (s *PostgresStore) Prune(ctx context.Context, now time.Time, window time.Duration) error {
+	return s.db.WithContext(ctx).
+		Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-window), now).
+		Delete(&models.LoginAttempt{}).Error
+}
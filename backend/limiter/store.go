@@ -0,0 +1,46 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Attempts is what a Store remembers about one key.
+type Attempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Store keeps failed attempt counts. Failures older than the window passed to
+// Reserve are forgotten.
+type Store interface {
+	Get(ctx context.Context, key string) (Attempts, error)
+	// Reserve calls wait with the attempts of the key and, when it returns
+	// zero, counts one more failure. Both happen atomically, so concurrent
+	// calls see each other's reservations.
+	Reserve(ctx context.Context, key string, now time.Time, window time.Duration, wait func(Attempts, time.Time) time.Duration) (Attempts, time.Duration, error)
+	// Release takes back one failure counted by Reserve.
+	Release(ctx context.Context, key string) error
+	// Lock blocks the key until the given time and clears its failures, so
+	// the key starts fresh once the lock runs out.
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// NewStoreFromEnv returns the store selected by LIMITER_STORE, "memory" for a
+// single backend or "postgres" (the default) to share counts across replicas.
+func NewStoreFromEnv(db *gorm.DB) (Store, error) {
+	switch driver := os.Getenv("LIMITER_STORE"); driver {
+	case "", "postgres":
+		return NewPostgresStore(db), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown LIMITER_STORE %q", driver)
+	}
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// OutboxMailer doesn't send anything. Each message is appended as one JSON
+// line to a file so local setups and tests can read what would have been
+// sent, or printed to the log when no file is configured.
+type OutboxMailer struct {
+	path  string
+	mutex sync.Mutex
+}
+
+type outboxEntry struct {
+	Message
+	SentAt time.Time `json:"sent_at"`
+}
+
+func NewOutboxMailer(path string) *OutboxMailer {
+	return &OutboxMailer{path: path}
+}
+
+func (m *OutboxMailer) Send(msg Message) error {
+	if m.path == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	line, err := json.Marshal(outboxEntry{Message: msg, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"gopkg.in/gomail.v2"
+)
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	dialer *gomail.Dialer
+	from   string
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		dialer: gomail.NewDialer(host, port, username, password),
+		from:   from,
+	}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	email := gomail.NewMessage()
+	email.SetHeader("From", m.from)
+	email.SetHeader("To", msg.To)
+	email.SetHeader("Subject", msg.Subject)
+	email.SetBody("text/plain", msg.Body)
+	return m.dialer.DialAndSend(email)
+}
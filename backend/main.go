@@ -10,9 +10,17 @@ import (
 
 	"github.com/aotsurasak46/user-management/controllers"
 	_ "github.com/aotsurasak46/user-management/docs"
+	"github.com/aotsurasak46/user-management/keyring"
+	"github.com/aotsurasak46/user-management/limiter"
+	"github.com/aotsurasak46/user-management/mailer"
 	"github.com/aotsurasak46/user-management/middleware"
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/oidc"
+	"github.com/aotsurasak46/user-management/storage"
+	"github.com/aotsurasak46/user-management/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/swagger"
 	"github.com/joho/godotenv"
 )
@@ -25,6 +33,7 @@ import (
 // @securityDefinitions.apikey ApiKeyAuth
 // @in header
 // @name Authorization
+// @description Use "Bearer <token>" with an access token JWT or a personal access token.
 
 // This project is a backend server for a user management system. It provides the following features:
 // - User authentication and authorization
@@ -44,36 +53,174 @@ func main() {
 		log.Fatalf("Could not connect to DB: %v", err)
 	}
 
+	kr, err := keyring.New(DB, keyring.ConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Could not load JWT signing keys: %v", err)
+	}
+	utils.SetTokenSigner(kr)
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	go kr.Run(backgroundCtx)
+
+	mail, err := mailer.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Could not create mailer: %v", err)
+	}
+
+	store, err := storage.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Could not create storage: %v", err)
+	}
+	go controllers.RunAutoPurge(backgroundCtx, DB, store)
+	go controllers.RunAccountDeletions(backgroundCtx, DB, store)
+	go controllers.RunDataExports(backgroundCtx, DB, store, mail)
+
+	providers := oidc.NewRegistryFromEnv()
+
+	limiterStore, err := limiter.NewStoreFromEnv(DB)
+	if err != nil {
+		log.Fatalf("Could not create limiter store: %v", err)
+	}
+	loginGuard := limiter.NewLoginGuardFromEnv(limiterStore)
+	go loginGuard.Run(backgroundCtx)
+
 	app := fiber.New()
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:5173,http://localhost",
 		AllowCredentials: true,
-		AllowMethods:     "GET,POST,PUT,DELETE",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Request-ID",
 	}))
+	app.Use(requestid.New())
 
 	app.Get("/swagger/*", swagger.HandlerDefault)
+	app.Get("/.well-known/jwks.json", controllers.GetJWKS(kr))
 
-	app.Use("/api/v1/users", middleware.Authen(DB))
+	app.Use("/api/v1/users", middleware.Authen(DB), middleware.Tenant(DB))
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello World")
 	})
 
-	app.Get("/ws/chat", middleware.WebSocketUpgradeAuth(DB), controllers.ChatSocketHandler(DB))
-	app.Get("/api/v1/messages/:userId", middleware.Authen(DB), controllers.GetChatHistory(DB))
-	app.Get("/api/v1/conversations", middleware.Authen(DB), controllers.GetConversations((DB)))
-
-	app.Post("/api/v1/login", controllers.LoginUser(DB))
-	app.Post("/api/v1/logout", controllers.LogoutUser())
-	app.Post("/api/v1/register", controllers.RegisterUser(DB))
+	app.Get("/ws/chat", middleware.WebSocketUpgradeAuth(DB), middleware.RequirePermission(DB, models.PermissionChatWrite), controllers.ChatSocketHandler(DB))
+	app.Get("/api/v1/messages/:userId", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionChatRead), controllers.GetChatHistory(DB))
+	app.Get("/api/v1/conversations", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionChatRead), controllers.GetConversations((DB)))
+
+	app.Post("/api/v1/login", controllers.LoginUser(DB, loginGuard))
+	app.Post("/api/v1/login/2fa", controllers.LoginTwoFactor(DB, loginGuard))
+	app.Get("/api/v1/oidc/providers", controllers.GetOIDCProviders(providers))
+	app.Get("/api/v1/oidc/:provider/login", controllers.OIDCLogin(providers))
+	app.Get("/api/v1/oidc/:provider/callback", controllers.OIDCCallback(DB, providers))
+	app.Post("/api/v1/logout", controllers.LogoutUser(DB))
+	app.Post("/api/v1/token/refresh", controllers.RefreshToken(DB))
+	app.Post("/api/v1/password/forgot", controllers.ForgotPassword(DB, mail))
+	app.Post("/api/v1/password/reset", controllers.ResetPassword(DB))
+	app.Post("/api/v1/email/verify", controllers.VerifyEmail(DB))
+	app.Post("/api/v1/email/resend", controllers.ResendVerificationEmail(DB, mail))
+	app.Post("/api/v1/register", controllers.RegisterUser(DB, mail))
 	app.Get("/api/v1/check-auth", middleware.Authen(DB), controllers.CheckAuth(DB))
 
-	app.Get("/api/v1/users", controllers.GetUsers(DB))
-	app.Get("/api/v1/users/:id", controllers.GetUserById(DB))
-	app.Post("/api/v1/users", middleware.AdminOnly(DB), controllers.CreateUser(DB))
-	app.Put("/api/v1/users/:id", middleware.AdminOnly(DB), controllers.UpdateUser(DB))
-	app.Delete("/api/v1/users/:id", middleware.AdminOnly(DB), controllers.DeleteUser(DB))
+	app.Get("/api/v1/me", middleware.Authen(DB), controllers.GetMe(DB))
+	app.Patch("/api/v1/me", middleware.Authen(DB), middleware.SessionOnly(), controllers.UpdateMe(DB, mail))
+	app.Post("/api/v1/me/password", middleware.Authen(DB), middleware.SessionOnly(), controllers.ChangePassword(DB))
+	app.Put("/api/v1/me/avatar", middleware.Authen(DB), middleware.SessionOnly(), controllers.UploadAvatar(DB, store))
+	app.Delete("/api/v1/me/avatar", middleware.Authen(DB), middleware.SessionOnly(), controllers.DeleteAvatar(DB, store))
+	app.Get("/api/v1/me/exports", middleware.Authen(DB), controllers.GetDataExports(DB))
+	app.Post("/api/v1/me/exports", middleware.Authen(DB), middleware.SessionOnly(), controllers.RequestDataExport(DB))
+	app.Post("/api/v1/me/deletion", middleware.Authen(DB), middleware.SessionOnly(), controllers.ScheduleAccountDeletion(DB, mail))
+	app.Delete("/api/v1/me/deletion", middleware.Authen(DB), middleware.SessionOnly(), controllers.CancelAccountDeletion(DB))
+	app.Get("/api/v1/avatars/:userId/:file", controllers.GetAvatar(store))
+	app.Get("/api/v1/exports/:id/download", controllers.DownloadDataExport(DB, store))
+
+	app.Get("/api/v1/sessions", middleware.Authen(DB), middleware.SessionOnly(), controllers.GetMySessions(DB))
+	app.Delete("/api/v1/sessions", middleware.Authen(DB), middleware.SessionOnly(), controllers.RevokeMySessions(DB))
+	app.Delete("/api/v1/sessions/:id", middleware.Authen(DB), middleware.SessionOnly(), controllers.RevokeMySession(DB))
+
+	app.Post("/api/v1/2fa/setup", middleware.Authen(DB), middleware.SessionOnly(), controllers.SetupTwoFactor(DB))
+	app.Post("/api/v1/2fa/confirm", middleware.Authen(DB), middleware.SessionOnly(), controllers.ConfirmTwoFactor(DB))
+	app.Post("/api/v1/2fa/disable", middleware.Authen(DB), middleware.SessionOnly(), controllers.DisableTwoFactor(DB))
+	app.Post("/api/v1/2fa/recovery-codes", middleware.Authen(DB), middleware.SessionOnly(), controllers.RegenerateRecoveryCodes(DB))
+
+	app.Get("/api/v1/tokens", middleware.Authen(DB), middleware.SessionOnly(), controllers.GetPersonalAccessTokens(DB))
+	app.Post("/api/v1/tokens", middleware.Authen(DB), middleware.SessionOnly(), controllers.CreatePersonalAccessToken(DB))
+	app.Delete("/api/v1/tokens/:id", middleware.Authen(DB), middleware.SessionOnly(), controllers.DeletePersonalAccessToken(DB))
+
+	app.Get("/api/v1/users", middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetUsers(DB))
+	app.Get("/api/v1/users/search", middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.SearchUsers(DB))
+	app.Get("/api/v1/users/export", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.ExportUsers(DB))
+	app.Get("/api/v1/users/deleted", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.GetDeletedUsers(DB))
+	app.Get("/api/v1/users/:id", middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetUserById(DB))
+	app.Post("/api/v1/users", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.CreateUser(DB, mail))
+	app.Post("/api/v1/users/import", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.ImportUsers(DB, mail))
+	app.Put("/api/v1/users/:id", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.UpdateUser(DB))
+	app.Delete("/api/v1/users/:id", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.DeleteUser(DB))
+	app.Post("/api/v1/users/:id/restore", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.RestoreUser(DB))
+	app.Delete("/api/v1/users/:id/purge", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.PurgeUser(DB, store))
+	app.Get("/api/v1/users/:id/sessions", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.GetUserSessions(DB))
+	app.Delete("/api/v1/users/:id/sessions", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.RevokeUserSessions(DB))
+	app.Delete("/api/v1/users/:id/sessions/:sessionId", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.RevokeUserSession(DB))
+	app.Put("/api/v1/users/:id/status", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.SetUserStatus(DB))
+	app.Get("/api/v1/users/:id/status/history", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.GetUserStatusHistory(DB))
+	app.Delete("/api/v1/users/:id/2fa", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.ResetUserTwoFactor(DB))
+	app.Delete("/api/v1/users/:id/lockout", middleware.RequirePermission(DB, models.PermissionUsersWrite), controllers.UnlockUser(DB, loginGuard))
+
+	app.Get("/api/v1/permissions", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionRolesManage), controllers.GetPermissions(DB))
+	app.Get("/api/v1/roles", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetRoles(DB))
+	app.Post("/api/v1/roles", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionRolesManage), controllers.CreateRole(DB))
+	app.Put("/api/v1/roles/:name", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionRolesManage), controllers.UpdateRole(DB))
+	app.Delete("/api/v1/roles/:name", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionRolesManage), controllers.DeleteRole(DB))
+
+	app.Get("/api/v1/attributes", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetAttributeDefinitions(DB))
+	app.Post("/api/v1/attributes", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionAttributesManage), controllers.CreateAttributeDefinition(DB))
+	app.Put("/api/v1/attributes/:name", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionAttributesManage), controllers.UpdateAttributeDefinition(DB))
+	app.Delete("/api/v1/attributes/:name", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionAttributesManage), controllers.DeleteAttributeDefinition(DB))
+
+	app.Use("/api/v1/groups", middleware.Authen(DB), middleware.Tenant(DB))
+	app.Get("/api/v1/groups", middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetGroups(DB))
+	app.Get("/api/v1/groups/:id", middleware.RequirePermission(DB, models.PermissionUsersRead), controllers.GetGroup(DB))
+	app.Post("/api/v1/groups", middleware.RequirePermission(DB, models.PermissionGroupsManage), controllers.CreateGroup(DB))
+	app.Put("/api/v1/groups/:id", middleware.GroupAdmin(DB), controllers.UpdateGroup(DB))
+	app.Delete("/api/v1/groups/:id", middleware.RequirePermission(DB, models.PermissionGroupsManage), controllers.DeleteGroup(DB))
+	app.Put("/api/v1/groups/:id/permissions", middleware.RequirePermission(DB, models.PermissionRolesManage), controllers.SetGroupPermissions(DB))
+	app.Post("/api/v1/groups/:id/members", middleware.GroupAdmin(DB), controllers.AddGroupMember(DB))
+	app.Delete("/api/v1/groups/:id/members/:userId", middleware.GroupAdmin(DB), controllers.RemoveGroupMember(DB))
+
+	app.Get("/api/v1/audit-events", middleware.Authen(DB), middleware.Tenant(DB), middleware.RequirePermission(DB, models.PermissionAuditRead), controllers.GetAuditEvents(DB))
+	app.Get("/api/v1/audit-events/export", middleware.Authen(DB), middleware.Tenant(DB), middleware.RequirePermission(DB, models.PermissionAuditRead), controllers.ExportAuditEvents(DB))
+	app.Get("/api/v1/audit-events/verify", middleware.Authen(DB), middleware.RequirePermission(DB, models.PermissionAuditRead), controllers.VerifyAuditEvents(DB))
+
+	app.Get("/api/v1/invitations/accept", controllers.GetInvitationByToken(DB))
+	app.Post("/api/v1/invitations/accept", controllers.AcceptInvitation(DB))
+	app.Use("/api/v1/invitations", middleware.Authen(DB), middleware.Tenant(DB))
+	app.Get("/api/v1/invitations", controllers.GetInvitations(DB))
+	app.Post("/api/v1/invitations", controllers.CreateInvitation(DB, mail))
+	app.Post("/api/v1/invitations/:id/resend", controllers.ResendInvitation(DB, mail))
+	app.Delete("/api/v1/invitations/:id", controllers.RevokeInvitation(DB))
+
+	app.Use("/scim/v2", middleware.Authen(DB), middleware.Tenant(DB), middleware.RequirePermission(DB, models.PermissionSCIMProvision))
+	app.Get("/scim/v2/ServiceProviderConfig", controllers.GetSCIMServiceProviderConfig())
+	app.Get("/scim/v2/ResourceTypes/:id?", controllers.GetSCIMResourceTypes())
+	app.Get("/scim/v2/Schemas/:id?", controllers.GetSCIMSchemas())
+	app.Get("/scim/v2/Users", controllers.GetSCIMUsers(DB))
+	app.Get("/scim/v2/Users/:id", controllers.GetSCIMUser(DB))
+	app.Post("/scim/v2/Users", controllers.CreateSCIMUser(DB))
+	app.Put("/scim/v2/Users/:id", controllers.ReplaceSCIMUser(DB))
+	app.Patch("/scim/v2/Users/:id", controllers.PatchSCIMUser(DB))
+	app.Delete("/scim/v2/Users/:id", controllers.DeleteSCIMUser(DB))
+	app.Get("/scim/v2/Groups", controllers.GetSCIMGroups(DB))
+	app.Get("/scim/v2/Groups/:id", controllers.GetSCIMGroup(DB))
+	app.Post("/scim/v2/Groups", controllers.CreateSCIMGroup(DB))
+	app.Put("/scim/v2/Groups/:id", controllers.ReplaceSCIMGroup(DB))
+	app.Patch("/scim/v2/Groups/:id", controllers.PatchSCIMGroup(DB))
+	app.Delete("/scim/v2/Groups/:id", controllers.DeleteSCIMGroup(DB))
+
+	app.Get("/api/v1/organizations", middleware.Authen(DB), controllers.GetMyOrganizations(DB))
+	app.Post("/api/v1/organizations", middleware.Authen(DB), middleware.SessionOnly(), middleware.RequirePermission(DB, models.PermissionOrganizationsCreate), controllers.CreateOrganization(DB))
+	app.Post("/api/v1/organizations/join", middleware.Authen(DB), middleware.SessionOnly(), controllers.JoinOrganization(DB))
+	app.Post("/api/v1/organizations/:id/switch", middleware.Authen(DB), middleware.SessionOnly(), middleware.OrganizationMember(DB), controllers.SwitchOrganization(DB))
+	app.Get("/api/v1/organizations/:id/members", middleware.Authen(DB), middleware.SessionOnly(), middleware.OrganizationMember(DB), controllers.GetOrganizationMembers(DB))
+	app.Post("/api/v1/organizations/:id/members", middleware.Authen(DB), middleware.SessionOnly(), middleware.OrganizationMember(DB), middleware.OrganizationAdmin(), controllers.AddOrganizationMember(DB, mail))
+	app.Put("/api/v1/organizations/:id/members/:userId", middleware.Authen(DB), middleware.SessionOnly(), middleware.OrganizationMember(DB), middleware.OrganizationAdmin(), controllers.UpdateOrganizationMember(DB))
+	app.Delete("/api/v1/organizations/:id/members/:userId", middleware.Authen(DB), middleware.SessionOnly(), middleware.OrganizationMember(DB), middleware.OrganizationAdmin(), controllers.RemoveOrganizationMember(DB))
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
@@ -86,6 +233,7 @@ func main() {
 		_, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		stopBackground()
 		if err := app.Shutdown(); err != nil {
 			log.Printf("Error shutting down server: %v", err)
 		}
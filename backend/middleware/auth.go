@@ -1,62 +1,233 @@
 package middleware
 
 import (
-	"fmt"
-	"os"
+	"log"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/utils"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"gorm.io/gorm"
 )
 
+// How the request was authenticated, stored in c.Locals("authMethod").
+const (
+	AuthMethodSession = "session"
+	AuthMethodToken   = "token"
+)
+
+// Authen accepts either an access token JWT or a personal access token, from
+// the "Authorization: Bearer" header or the jwt cookie.
 func Authen(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		cookie := c.Cookies("jwt")
-		if cookie == "" {
+		token := bearerToken(c)
+		if token == "" {
+			token = c.Cookies("jwt")
+		}
+		if token == "" {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Missing token"})
 		}
-		jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-		token, err := jwt.ParseWithClaims(cookie, &jwt.MapClaims{}, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
-			}
-			return []byte(jwtSecretKey), nil
-		})
+		if strings.HasPrefix(token, models.PersonalAccessTokenPrefix) {
+			return authenPersonalAccessToken(db, c, token)
+		}
 
-		if err != nil || !token.Valid {
+		claims, err := utils.ParseJWT(token)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
 		}
 
-		claims := token.Claims.(*jwt.MapClaims)
-		userID := uint((*claims)["user_id"].(float64))
+		userIDClaim, ok := claims["user_id"].(float64)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+		}
+		sessionIDClaim, ok := claims["sid"].(float64)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+		}
+		userID := uint(userIDClaim)
+		sessionID := uint(sessionIDClaim)
+
+		var session models.Session
+		if err := db.First(&session, sessionID).Error; err != nil || session.UserID != userID || !session.IsActive(time.Now()) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session has been revoked"})
+		}
 
 		var user models.User
 		if err := db.First(&user, userID).Error; err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
 		}
-		c.Locals("userID", uint(userID))
+		if user.Blocked(time.Now()) {
+			return RejectBlockedUser(c, &user)
+		}
+		c.Locals("userID", userID)
+		c.Locals("role", user.Role)
+		c.Locals("sessionID", sessionID)
+		c.Locals("organizationID", session.OrganizationID)
+		c.Locals("authMethod", AuthMethodSession)
 		return c.Next()
 	}
 }
 
-func AdminOnly(db *gorm.DB) fiber.Handler {
-	return func(c *fiber.Ctx) error {
+func bearerToken(c *fiber.Ctx) string {
+	header := c.Get(fiber.HeaderAuthorization)
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
 
-		userID := c.Locals("userID").(uint)
-		var user models.User
-		if err := db.First(&user, userID).Error; err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+func authenPersonalAccessToken(db *gorm.DB, c *fiber.Ctx, token string) error {
+	var accessToken models.PersonalAccessToken
+	if err := db.Where("token_hash = ?", utils.HashToken(token)).First(&accessToken).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+	now := time.Now()
+	if now.After(accessToken.ExpiresAt) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid or expired token"})
+	}
+
+	var user models.User
+	if err := db.First(&user, accessToken.UserID).Error; err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "User not found"})
+	}
+	if user.Blocked(now) {
+		return RejectBlockedUser(c, &user)
+	}
+
+	// a token used in a tight loop doesn't need a write per request
+	if accessToken.LastUsedAt == nil || now.Sub(*accessToken.LastUsedAt) > time.Minute {
+		if err := db.Model(&accessToken).Update("last_used_at", now).Error; err != nil {
+			log.Printf("Error updating token last used time: %v", err)
+		}
+	}
+
+	c.Locals("userID", accessToken.UserID)
+	c.Locals("role", user.Role)
+	c.Locals("organizationID", accessToken.OrganizationID)
+	c.Locals("authMethod", AuthMethodToken)
+	c.Locals("tokenScopes", accessToken.ScopeList())
+	return c.Next()
+}
+
+// RejectBlockedUser answers a request of a suspended or banned user.
+func RejectBlockedUser(c *fiber.Ctx, user *models.User) error {
+	if user.Status == models.UserStatusBanned {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Account is banned", "status": user.Status})
+	}
+	response := fiber.Map{"error": "Account is suspended", "status": user.Status}
+	if user.SuspendedUntil != nil {
+		response["until"] = user.SuspendedUntil
+	}
+	return c.Status(fiber.StatusForbidden).JSON(response)
+}
+
+// UserPermissions returns the names of the permissions of a user: the ones of
+// their role and, while they work in organizationID, the ones of their groups
+// in it.
+func UserPermissions(db *gorm.DB, userID uint, role string, organizationID *uint) ([]string, error) {
+	query := db.Table("permissions").
+		Where("permissions.id IN (?)", db.Table("role_permissions").
+			Select("role_permissions.permission_id").
+			Joins("JOIN roles ON roles.id = role_permissions.role_id").
+			Where("roles.name = ?", role))
+	if organizationID != nil {
+		query = query.Or("permissions.id IN (?)", db.Table("group_permissions").
+			Select("group_permissions.permission_id").
+			Joins("JOIN group_members ON group_members.group_id = group_permissions.group_id").
+			Joins(`JOIN "groups" ON "groups".id = group_members.group_id`).
+			Where(`group_members.user_id = ? AND "groups".organization_id = ?`, userID, *organizationID))
+	}
+	var names []string
+	err := query.Order("permissions.name").Pluck("permissions.name", &names).Error
+	return names, err
+}
+
+// requestPermissions returns the permissions of the user making the request.
+func requestPermissions(db *gorm.DB, c *fiber.Ctx) ([]string, error) {
+	role, _ := c.Locals("role").(string)
+	organizationID, _ := c.Locals("organizationID").(*uint)
+	return UserPermissions(db, c.Locals("userID").(uint), role, organizationID)
+}
+
+// HasPermission reports whether the user making the request has the
+// permission, for handlers that relax a check for privileged users.
+func HasPermission(db *gorm.DB, c *fiber.Ctx, permission string) (bool, error) {
+	if c.Locals("authMethod") == AuthMethodToken {
+		scopes, _ := c.Locals("tokenScopes").([]string)
+		if !slices.Contains(scopes, permission) {
+			return false, nil
+		}
+	}
+	permissions, err := requestPermissions(db, c)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(permissions, permission), nil
+}
+
+// HasPermissions reports whether the user making the request has every one
+// of the permissions, like HasPermission with a single lookup.
+func HasPermissions(db *gorm.DB, c *fiber.Ctx, permissions []string) (bool, error) {
+	if c.Locals("authMethod") == AuthMethodToken {
+		scopes, _ := c.Locals("tokenScopes").([]string)
+		for _, permission := range permissions {
+			if !slices.Contains(scopes, permission) {
+				return false, nil
+			}
+		}
+	}
+	held, err := requestPermissions(db, c)
+	if err != nil {
+		return false, err
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(held, permission) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RequirePermission lets the request through when the user has the
+// permission through their role or one of their groups. Requests
+// authenticated with a personal access token also need the permission among
+// the scopes of the token.
+func RequirePermission(db *gorm.DB, permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("authMethod") == AuthMethodToken {
+			scopes, _ := c.Locals("tokenScopes").([]string)
+			if !slices.Contains(scopes, permission) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Token is missing the " + permission + " scope"})
+			}
 		}
 
-		if user.Role != "admin" {
+		permissions, err := requestPermissions(db, c)
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if !slices.Contains(permissions, permission) {
 			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
 		}
 		return c.Next()
 	}
 }
 
+// SessionOnly rejects personal access tokens, for endpoints that manage the
+// account itself such as minting more tokens.
+func SessionOnly() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("authMethod") != AuthMethodSession {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "This endpoint requires a login session"})
+		}
+		return c.Next()
+	}
+}
+
 func WebSocketUpgradeAuth(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		if !websocket.IsWebSocketUpgrade(c) {
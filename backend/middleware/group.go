@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"log"
+
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GroupAdmin lets through the admins of the group of the :id route parameter
+// and users with the groups:manage permission. It runs after Tenant, so only
+// groups of the organization of the request count.
+func GroupAdmin(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		allowed, err := HasPermission(db, c, models.PermissionGroupsManage)
+		if err != nil {
+			log.Printf("Error loading permissions: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if allowed {
+			return c.Next()
+		}
+		// a token acting as group admin still needs to be scoped for it
+		if c.Locals("authMethod") == AuthMethodToken {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Token is missing the " + models.PermissionGroupsManage + " scope"})
+		}
+
+		var count int64
+		if err := db.WithContext(c.UserContext()).Model(&models.Group{}).
+			Joins("JOIN group_members ON group_members.group_id = \"groups\".id").
+			Where("\"groups\".id = ? AND group_members.user_id = ? AND group_members.role = ?", c.Params("id"), c.Locals("userID"), models.GroupRoleAdmin).
+			Count(&count).Error; err != nil {
+			log.Printf("Error finding group membership in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		if count == 0 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+
+	"github.com/aotsurasak46/user-management/models"
+	"github.com/aotsurasak46/user-management/tenant"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Tenant resolves the organization of the request from the session, or from
+// the personal access token, and limits the queries made with
+// c.UserContext() to it. It runs after Authen.
+//
+// A session whose organization the user has left falls back to their oldest
+// membership, a personal access token stops working.
+func Tenant(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uint)
+		organizationID, _ := c.Locals("organizationID").(*uint)
+
+		var membership models.Membership
+		err := gorm.ErrRecordNotFound
+		if organizationID != nil {
+			err = db.Where("organization_id = ? AND user_id = ?", *organizationID, userID).First(&membership).Error
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) && c.Locals("authMethod") == AuthMethodSession {
+			err = db.Where("user_id = ?", userID).Order("created_at").First(&membership).Error
+			if err == nil {
+				if err := db.Model(&models.Session{}).
+					Where("id = ?", c.Locals("sessionID")).
+					Update("organization_id", membership.OrganizationID).Error; err != nil {
+					log.Printf("Error switching session organization: %v", err)
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "You are not a member of any organization"})
+			}
+			log.Printf("Error finding membership in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		c.Locals("organizationID", &membership.OrganizationID)
+		c.Locals("organizationRole", membership.Role)
+		c.SetUserContext(tenant.WithOrganization(c.UserContext(), membership.OrganizationID))
+		return c.Next()
+	}
+}
+
+// OrganizationMember loads the membership of the user in the organization of
+// the :id route parameter into c.Locals("membership"), answering 404 to
+// users who aren't members so other organizations can't be discovered.
+func OrganizationMember(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var membership models.Membership
+		if err := db.Where("organization_id = ? AND user_id = ?", c.Params("id"), c.Locals("userID")).First(&membership).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Organization not found"})
+			}
+			log.Printf("Error finding membership in database: %v", err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		c.Locals("membership", membership)
+		return c.Next()
+	}
+}
+
+// OrganizationAdmin lets only admins of the organization through. It runs
+// after OrganizationMember.
+func OrganizationAdmin() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		membership, ok := c.Locals("membership").(models.Membership)
+		if !ok || membership.Role != models.OrganizationRoleAdmin {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Types of custom attribute values. Dates are "YYYY-MM-DD" strings, enums one
+// of the options of the definition.
+const (
+	AttributeTypeString  = "string"
+	AttributeTypeNumber  = "number"
+	AttributeTypeBoolean = "boolean"
+	AttributeTypeDate    = "date"
+	AttributeTypeEnum    = "enum"
+)
+
+// Visibility of custom attributes. Public ones are shown to everyone who can
+// see the user, private ones only to the user and to users with users:write,
+// admin ones only to the latter. Users can edit their own public and private
+// attributes.
+const (
+	AttributeVisibilityPublic  = "public"
+	AttributeVisibilityPrivate = "private"
+	AttributeVisibilityAdmin   = "admin"
+)
+
+// AttributeDefinition is a custom field of users, defined by admins. The
+// values live in User.Attributes under Name.
+type AttributeDefinition struct {
+	ID          uint       `json:"ID" gorm:"primaryKey"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Name        string     `json:"name" gorm:"uniqueIndex;not null"`
+	Label       string     `json:"label"`
+	Description string     `json:"description"`
+	Type        string     `json:"type" gorm:"not null"`
+	Options     StringList `json:"options,omitempty" gorm:"type:jsonb"`
+	// Required attributes have to be set when an admin creates a user and
+	// can't be removed afterwards. Users who existed before keep no value
+	// until one is set.
+	Required bool `json:"required" gorm:"not null;default:false"`
+	// Unique attributes are backed by a unique index on the value, see
+	// controllers.syncAttributeIndex.
+	Unique     bool   `json:"unique" gorm:"not null;default:false"`
+	Visibility string `json:"visibility" gorm:"not null;default:public"`
+}
+
+// Attributes are the custom attribute values of a user, stored as JSONB.
+type Attributes map[string]any
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(a)
+	return string(data), err
+}
+
+func (a *Attributes) Scan(value any) error {
+	data, err := jsonBytes(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, a)
+}
+
+func (Attributes) GormDataType() string {
+	return "jsonb"
+}
+
+// StringList is a list of strings stored as a JSONB array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(l)
+	return string(data), err
+}
+
+func (l *StringList) Scan(value any) error {
+	if value == nil {
+		*l = nil
+		return nil
+	}
+	data, err := jsonBytes(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, l)
+}
+
+func (StringList) GormDataType() string {
+	return "jsonb"
+}
+
+func jsonBytes(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return []byte("null"), nil
+	default:
+		return nil, errors.New("unsupported JSON value")
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent is an entry of the append-only audit log. Every event stores the
+// hash of the one before it, so changing or removing an event breaks the
+// chain from there on, see audit.Verify.
+type AuditEvent struct {
+	ID             uint      `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time `json:"created_at" gorm:"index"`
+	ActorID        *uint     `json:"actor_id,omitempty" gorm:"index"`
+	Action         string    `json:"action" gorm:"index;not null"`
+	TargetType     string    `json:"target_type,omitempty" gorm:"index:idx_audit_event_target"`
+	TargetID       string    `json:"target_id,omitempty" gorm:"index:idx_audit_event_target"`
+	IPAddress      string    `json:"ip_address,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	OrganizationID *uint     `json:"organization_id,omitempty"`
+	PrevHash       string    `json:"prev_hash"`
+	Hash           string    `json:"hash" gorm:"uniqueIndex;not null"`
+	// Changes is the JSON of the before and after values of the fields that
+	// changed. It is kept as text so the hashed bytes come back unchanged.
+	Changes string `json:"-" gorm:"type:text"`
+}
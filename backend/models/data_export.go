@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// Statuses of a data export. Pending exports wait for the worker, ready ones
+// can be downloaded until ExpiresAt, after which the file is removed.
+const (
+	DataExportStatusPending = "pending"
+	DataExportStatusRunning = "running"
+	DataExportStatusReady   = "ready"
+	DataExportStatusFailed  = "failed"
+	DataExportStatusExpired = "expired"
+)
+
+// DataExport is a copy of everything we hold about a user, asked for by the
+// user themselves. It is built in the background into a zip of JSON files,
+// stored under ObjectKey.
+type DataExport struct {
+	ID          uint       `json:"ID" gorm:"primaryKey"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	UserID      uint       `json:"user_id" gorm:"index;not null"`
+	User        User       `json:"-" gorm:"foreignKey:UserID"`
+	Status      string     `json:"status" gorm:"index;not null;default:pending"`
+	ObjectKey   string     `json:"-"`
+	Size        int64      `json:"size,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EmailVerificationToken is a single use token mailed to a user to prove they
+// own Email. Only the hash of the token is stored.
+type EmailVerificationToken struct {
+	gorm.Model
+	UserID    uint      `gorm:"index;not null"`
+	User      User      `gorm:"foreignKey:UserID"`
+	Email     string    `gorm:"not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+// Roles a user can have inside a group.
+const (
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+// Group is a named set of users of an organization, such as engineering or
+// support. Permissions granted to a group apply to all of its members while
+// they work in the organization of the group.
+type Group struct {
+	ID             uint         `json:"ID" gorm:"primaryKey"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+	OrganizationID uint         `json:"organization_id" gorm:"uniqueIndex:idx_group_organization_name;not null"`
+	Organization   Organization `json:"-" gorm:"foreignKey:OrganizationID;constraint:OnDelete:CASCADE"`
+	Name           string       `json:"name" gorm:"uniqueIndex:idx_group_organization_name;not null"`
+	Description    string       `json:"description"`
+	ExternalID     string       `json:"-" gorm:"index"`
+	Permissions    []Permission `json:"permissions" gorm:"many2many:group_permissions;constraint:OnDelete:CASCADE"`
+}
+
+type GroupMember struct {
+	ID        uint      `json:"ID" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	GroupID   uint      `json:"group_id" gorm:"uniqueIndex:idx_group_member_group_user;not null"`
+	Group     Group     `json:"-" gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_group_member_group_user;index;not null"`
+	User      User      `json:"-" gorm:"foreignKey:UserID"`
+	Role      string    `json:"role" gorm:"not null;default:member"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+)
+
+// Statuses of an invitation, derived from its timestamps.
+const (
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusRevoked  = "revoked"
+	InvitationStatusExpired  = "expired"
+)
+
+// Invitation asks someone to join an organization. An invitee without an
+// account opens the mailed link and chooses their own name and password, and
+// gets the preset roles. Existing users accept while logged in and only get
+// the organization role, Role is empty on their invitations. Only the hash of
+// the single use token is stored.
+type Invitation struct {
+	ID               uint         `json:"ID" gorm:"primaryKey"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+	OrganizationID   uint         `json:"organization_id" gorm:"index;not null"`
+	Organization     Organization `json:"-" gorm:"foreignKey:OrganizationID;constraint:OnDelete:CASCADE"`
+	Email            string       `json:"email" gorm:"index;not null"`
+	Role             string       `json:"role" gorm:"not null"`
+	OrganizationRole string       `json:"organization_role" gorm:"not null;default:member"`
+	TokenHash        string       `json:"-" gorm:"uniqueIndex;not null"`
+	InvitedBy        uint         `json:"invited_by"`
+	ExpiresAt        time.Time    `json:"expires_at" gorm:"not null"`
+	SentAt           time.Time    `json:"sent_at"`
+	AcceptedAt       *time.Time   `json:"accepted_at,omitempty"`
+	UserID           *uint        `json:"user_id,omitempty"`
+	RevokedAt        *time.Time   `json:"revoked_at,omitempty"`
+}
+
+// Status returns the status of the invitation at the given time.
+func (i *Invitation) Status(now time.Time) string {
+	switch {
+	case i.AcceptedAt != nil:
+		return InvitationStatusAccepted
+	case i.RevokedAt != nil:
+		return InvitationStatusRevoked
+	case !now.Before(i.ExpiresAt):
+		return InvitationStatusExpired
+	}
+	return InvitationStatusPending
+}
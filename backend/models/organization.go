@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultOrganizationSlug is the organization self registered users join.
+// Every user that existed before organizations were added was moved into it.
+const DefaultOrganizationSlug = "default"
+
+// Roles a member can have inside an organization. They are separate from the
+// global role in User.Role.
+const (
+	OrganizationRoleAdmin  = "admin"
+	OrganizationRoleMember = "member"
+)
+
+type Organization struct {
+	gorm.Model
+	Name string `json:"name" gorm:"not null"`
+	Slug string `json:"slug" gorm:"uniqueIndex;not null"`
+}
+
+// Membership puts a user in an organization. Users only see, and can only
+// chat with, members of their organizations.
+type Membership struct {
+	ID             uint         `json:"ID" gorm:"primaryKey"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+	OrganizationID uint         `json:"organization_id" gorm:"uniqueIndex:idx_membership_organization_user;not null"`
+	Organization   Organization `json:"-" gorm:"foreignKey:OrganizationID;constraint:OnDelete:CASCADE"`
+	UserID         uint         `json:"user_id" gorm:"uniqueIndex:idx_membership_organization_user;index;not null"`
+	User           User         `json:"-" gorm:"foreignKey:UserID"`
+	Role           string       `json:"role" gorm:"not null;default:member"`
+}
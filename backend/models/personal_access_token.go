@@ -0,0 +1,36 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token so Authen can
+// tell them apart from JWTs and secret scanners can recognise leaked ones.
+const PersonalAccessTokenPrefix = "umpat_"
+
+// PersonalAccessToken lets scripts and CI jobs call the API as a user without
+// a browser session. Only the hash of the token is stored.
+type PersonalAccessToken struct {
+	gorm.Model
+	UserID     uint       `json:"user_id" gorm:"index;not null"`
+	User       User       `json:"-" gorm:"foreignKey:UserID"`
+	Name       string     `json:"name" gorm:"not null"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex;not null"`
+	Scopes     string     `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// OrganizationID is the organization the token was created in, it works
+	// in that organization only.
+	OrganizationID *uint `json:"organization_id,omitempty"`
+}
+
+// ScopeList returns the scopes of the token, which are permission names.
+func (t *PersonalAccessToken) ScopeList() []string {
+	if t.Scopes == "" {
+		return nil
+	}
+	return strings.Split(t.Scopes, ",")
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode is a one time code that can replace a TOTP code when the user
+// lost their authenticator. Only the hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index;not null"`
+	User     User   `gorm:"foreignKey:UserID"`
+	CodeHash string `gorm:"not null"`
+	UsedAt   *time.Time
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+)
+
+// Permission names checked by middleware.RequirePermission. They double as the
+// scopes a personal access token can be limited to.
+const (
+	PermissionUsersRead           = "users:read"
+	PermissionUsersWrite          = "users:write"
+	PermissionChatRead            = "chat:read"
+	PermissionChatWrite           = "chat:write"
+	PermissionRolesManage         = "roles:manage"
+	PermissionGroupsManage        = "groups:manage"
+	PermissionAuditRead           = "audit:read"
+	PermissionSCIMProvision       = "scim:provision"
+	PermissionAttributesManage    = "attributes:manage"
+	PermissionOrganizationsCreate = "organizations:create"
+)
+
+// Permissions are seeded into the permissions table on startup. Only the code
+// can check a permission, so they can't be created through the API.
+var Permissions = []Permission{
+	{Name: PermissionUsersRead, Description: "View users"},
+	{Name: PermissionUsersWrite, Description: "Create, update and delete users and manage their sessions, two factor authentication and lockouts"},
+	{Name: PermissionChatRead, Description: "Read conversations and chat history"},
+	{Name: PermissionChatWrite, Description: "Send chat messages"},
+	{Name: PermissionRolesManage, Description: "Create, update and delete roles and grant permissions to groups"},
+	{Name: PermissionGroupsManage, Description: "Create and delete groups and manage the members of any group"},
+	{Name: PermissionAuditRead, Description: "View, export and verify the audit log"},
+	{Name: PermissionSCIMProvision, Description: "Provision users and groups through the SCIM 2.0 API"},
+	{Name: PermissionAttributesManage, Description: "Define the custom attributes of users"},
+	{Name: PermissionOrganizationsCreate, Description: "Create organizations, becoming their admin"},
+}
+
+// DefaultRole is a role created on first startup. Users get the "user" role
+// when they register.
+type DefaultRole struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+var DefaultRoles = []DefaultRole{
+	{
+		Name:        "user",
+		Description: "Regular user",
+		Permissions: []string{PermissionUsersRead, PermissionChatRead, PermissionChatWrite},
+	},
+	{
+		Name:        "admin",
+		Description: "Administrator with every permission",
+		Permissions: []string{PermissionUsersRead, PermissionUsersWrite, PermissionChatRead, PermissionChatWrite, PermissionRolesManage, PermissionGroupsManage, PermissionAuditRead, PermissionSCIMProvision, PermissionAttributesManage, PermissionOrganizationsCreate},
+	},
+}
+
+type Permission struct {
+	ID          uint   `json:"-" gorm:"primaryKey"`
+	Name        string `json:"name" gorm:"uniqueIndex;not null"`
+	Description string `json:"description"`
+}
+
+// Role is a named set of permissions. User.Role holds the name of the role.
+type Role struct {
+	ID          uint         `json:"ID" gorm:"primaryKey"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	Name        string       `json:"name" gorm:"uniqueIndex;not null"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions" gorm:"many2many:role_permissions;constraint:OnDelete:CASCADE"`
+}
+
+// PermissionNames returns the names of every permission the code checks.
+func PermissionNames() []string {
+	names := make([]string, len(Permissions))
+	for i, permission := range Permissions {
+		names[i] = permission.Name
+	}
+	return names
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session is a login of a user on one device. Every refresh of the access
+// token rotates RefreshTokenHash, so a refresh token is only ever valid once;
+// presenting a stale one revokes the whole session.
+type Session struct {
+	gorm.Model
+	UserID           uint       `json:"user_id" gorm:"index;not null"`
+	User             User       `json:"-" gorm:"foreignKey:UserID"`
+	FamilyID         string     `json:"-" gorm:"uniqueIndex;not null"`
+	RefreshTokenHash string     `json:"-" gorm:"not null"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	LastUsedAt       time.Time  `json:"last_used_at"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason    string     `json:"revoked_reason,omitempty"`
+	IPAddress        string     `json:"ip_address"`
+	UserAgent        string     `json:"user_agent"`
+	// OrganizationID is the organization the session is working in, see
+	// middleware.Tenant.
+	OrganizationID *uint `json:"organization_id,omitempty"`
+	// PreviousRefreshTokenHash is the refresh token replaced at RotatedAt.
+	// It is still accepted for a few seconds so concurrent refreshes don't
+	// look like reuse, see controllers.rotateSession.
+	PreviousRefreshTokenHash string     `json:"-"`
+	RotatedAt                *time.Time `json:"-"`
+}
+
+// IsActive reports whether the session can still be used at the given time.
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SigningKey is one asymmetric key of the JWT keyring. The newest key signs
+// new tokens, older keys keep verifying tokens until ExpiresAt.
+type SigningKey struct {
+	gorm.Model
+	KeyID     string `gorm:"uniqueIndex;not null"`
+	Algorithm string `gorm:"not null"`
+	// PrivateKey is the PKCS #8 DER key encrypted with ENCRYPTION_KEY.
+	PrivateKey string `gorm:"not null"`
+	ExpiresAt  *time.Time
+}
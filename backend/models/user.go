@@ -1,15 +1,43 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// User is an account. Deleting a user only sets DeletedAt so they can be
+// restored, their email is free for a new account meanwhile.
 type User struct {
 	gorm.Model
-	Name             string    `json:"name"`
-	Email            string    `gorm:"unique;not null" json:"email"`
-	Password         string    `json:"-"`
-	Role             string    `json:"role" gorm:"default:user"`
-	MessagesSent     []Message `gorm:"foreignKey:FromID"`
-	MessagesReceived []Message `gorm:"foreignKey:ToID"`
+	Name             string     `json:"name"`
+	Email            string     `gorm:"uniqueIndex:idx_users_email,where:deleted_at IS NULL;not null" json:"email"`
+	Password         string     `json:"-"`
+	Role             string     `json:"role" gorm:"default:user"`
+	EmailVerified    bool       `json:"email_verified" gorm:"not null;default:false"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at,omitempty"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled" gorm:"not null;default:false"`
+	TOTPSecret       string     `json:"-"`
+	TOTPLastStep     int64      `json:"-"`
+	Status           string     `json:"status" gorm:"not null;default:active;index"`
+	SuspendedUntil   *time.Time `json:"suspended_until,omitempty"`
+	// PurgedAt is set when a deleted user was purged but kept as an anonymous
+	// placeholder so the messages they exchanged still have an author.
+	PurgedAt *time.Time `json:"-"`
+	// ExternalID is the id of the user in the identity provider that
+	// provisions it through SCIM.
+	ExternalID string `json:"-" gorm:"index"`
+	// AvatarKey is the storage key of the uploaded avatar, each thumbnail
+	// size is stored next to it, see avatarObjectKey in the controllers.
+	AvatarKey string `json:"-"`
+	// Attributes holds the values of the custom attributes defined by
+	// admins. They are only shown through dto.UserResponse, which hides the
+	// ones the caller may not see.
+	Attributes Attributes `json:"-" gorm:"type:jsonb;not null;default:'{}';index:idx_users_attributes,type:gin"`
+	// DeletionScheduledAt is set when the user asked to delete their own
+	// account. Until then they can cancel, afterwards the account is deleted
+	// and anonymized.
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty" gorm:"index"`
+	MessagesSent        []Message  `gorm:"foreignKey:FromID"`
+	MessagesReceived    []Message  `gorm:"foreignKey:ToID"`
 }
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// UserIdentity links a user to their account at an OpenID Connect provider.
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `json:"user_id" gorm:"index;not null"`
+	User     User   `json:"-" gorm:"foreignKey:UserID"`
+	Provider string `json:"provider" gorm:"uniqueIndex:idx_identity_provider_subject;not null"`
+	Subject  string `json:"subject" gorm:"uniqueIndex:idx_identity_provider_subject;not null"`
+	Email    string `json:"email"`
+}
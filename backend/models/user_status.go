@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// Statuses of a user. A suspended user is locked out until SuspendedUntil, or
+// until an admin lifts the suspension when it has no end. A banned user is
+// locked out for good.
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusBanned    = "banned"
+)
+
+// Blocked reports whether the user is locked out at the given time.
+func (u *User) Blocked(now time.Time) bool {
+	switch u.Status {
+	case UserStatusBanned:
+		return true
+	case UserStatusSuspended:
+		return u.SuspendedUntil == nil || now.Before(*u.SuspendedUntil)
+	}
+	return false
+}
+
+// UserStatusChange records every change of the status of a user, which makes
+// up their suspension history.
+type UserStatusChange struct {
+	ID        uint       `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time  `json:"created_at"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	User      User       `json:"-" gorm:"foreignKey:UserID"`
+	Status    string     `json:"status" gorm:"not null"`
+	Reason    string     `json:"reason"`
+	Until     *time.Time `json:"until,omitempty"`
+	ChangedBy uint       `json:"changed_by"`
+}
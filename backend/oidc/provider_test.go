@@ -0,0 +1,260 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID = "client-1"
+	testCode     = "code-1"
+	testNonce    = "nonce-1"
+	testVerifier = "verifier-0123456789-0123456789-0123456789"
+)
+
+// mockIssuer is a local OpenID Connect issuer serving discovery, JWKS and a
+// token endpoint that checks the PKCE verifier and answers with idToken.
+type mockIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	idToken   func(issuer string) string
+	issuer    string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := m.issuer
+		if issuer == "" {
+			issuer = m.server.URL
+		}
+		json.NewEncoder(w).Encode(discoveryDocument{
+			Issuer:                issuer,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != testCode ||
+			r.Form.Get("client_id") != testClientID || CodeChallenge(r.Form.Get("code_verifier")) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(tokenResponse{IDToken: m.idToken(m.server.URL)})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Name:        "mock",
+		IssuerURL:   m.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/callback",
+	})
+}
+
+func (m *mockIssuer) sign(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims(issuer string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            issuer,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada",
+		"nonce":          testNonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+// authorize runs the first half of the flow and remembers the PKCE challenge
+// the provider sent, like the issuer does with the authorization request.
+func (m *mockIssuer) authorize(t *testing.T, provider *Provider) {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1", testNonce, CodeChallenge(testVerifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("nonce") != testNonce || query.Get("client_id") != testClientID {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	m.challenge = query.Get("code_challenge")
+}
+
+func TestExchangeAcceptsValidIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	m.idToken = func(issuer string) string {
+		claims := validClaims(issuer)
+		claims["email_verified"] = "true"
+		return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+	}
+	provider := m.provider()
+	m.authorize(t, provider)
+
+	claims, err := provider.Exchange(context.Background(), testCode, testVerifier, testNonce)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	want := Claims{Subject: "subject-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"}
+	if *claims != want {
+		t.Fatalf("got %+v, want %+v", *claims, want)
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		idToken func(m *mockIssuer, issuer string) string
+	}{
+		{"signed by another key", func(m *mockIssuer, issuer string) string {
+			return m.sign(t, jwt.SigningMethodRS256, otherKey, "key-1", validClaims(issuer))
+		}},
+		{"unknown key id", func(m *mockIssuer, issuer string) string {
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-2", validClaims(issuer))
+		}},
+		{"HS256 with the public key as secret", func(m *mockIssuer, issuer string) string {
+			return m.sign(t, jwt.SigningMethodHS256, m.key.N.Bytes(), "key-1", validClaims(issuer))
+		}},
+		{"unsigned", func(m *mockIssuer, issuer string) string {
+			return m.sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "key-1", validClaims(issuer))
+		}},
+		{"wrong nonce", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			claims["nonce"] = "nonce-2"
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"missing nonce", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			delete(claims, "nonce")
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"wrong audience", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			claims["aud"] = "client-2"
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"wrong issuer", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			claims["iss"] = "https://evil.example.com"
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"expired", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"no expiry", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			delete(claims, "exp")
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"no subject", func(m *mockIssuer, issuer string) string {
+			claims := validClaims(issuer)
+			delete(claims, "sub")
+			return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", claims)
+		}},
+		{"tampered payload", func(m *mockIssuer, issuer string) string {
+			parts := strings.Split(m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", validClaims(issuer)), ".")
+			claims := validClaims(issuer)
+			claims["sub"] = "subject-2"
+			payload, _ := json.Marshal(claims)
+			parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+			return strings.Join(parts, ".")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMockIssuer(t)
+			m.idToken = func(issuer string) string { return test.idToken(m, issuer) }
+			provider := m.provider()
+			m.authorize(t, provider)
+
+			if claims, err := provider.Exchange(context.Background(), testCode, testVerifier, testNonce); err == nil {
+				t.Fatalf("Exchange accepted the token: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	m := newMockIssuer(t)
+	m.idToken = func(issuer string) string {
+		return m.sign(t, jwt.SigningMethodRS256, m.key, "key-1", validClaims(issuer))
+	}
+	provider := m.provider()
+	m.authorize(t, provider)
+
+	if _, err := provider.Exchange(context.Background(), testCode, "another-verifier", testNonce); err == nil {
+		t.Fatal("Exchange succeeded with the wrong code verifier")
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	m := newMockIssuer(t)
+	m.issuer = "https://evil.example.com"
+	if _, err := m.provider().AuthCodeURL(context.Background(), "state-1", testNonce, CodeChallenge(testVerifier)); err == nil {
+		t.Fatal("discovery accepted a document for another issuer")
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// example of RFC 7636 appendix B
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package oidc
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Registry holds the configured providers by name.
+type Registry struct {
+	providers map[string]*Provider
+}
+
+func NewRegistry(providers ...*Provider) *Registry {
+	registry := &Registry{providers: make(map[string]*Provider)}
+	for _, provider := range providers {
+		registry.providers[provider.Name] = provider
+	}
+	return registry
+}
+
+// NewRegistryFromEnv reads the providers listed in OIDC_PROVIDERS, for example
+// "corp,google". Each one is configured by OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_REDIRECT_URL,
+// OIDC_<NAME>_SCOPES (space separated) and OIDC_<NAME>_ALLOW_SIGNUP.
+func NewRegistryFromEnv() *Registry {
+	var providers []*Provider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, NewProvider(Config{
+			Name:         name,
+			IssuerURL:    os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AllowSignup:  os.Getenv(prefix+"ALLOW_SIGNUP") != "false",
+		}))
+	}
+	return NewRegistry(providers...)
+}
+
+func (r *Registry) Get(name string) (*Provider, bool) {
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,474 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expression is a parsed filter, see RFC 7644 section 3.4.2.2.
+type Expression interface {
+	isExpression()
+}
+
+// Comparison compares an attribute with a value. Value is nil for the "pr"
+// (present) operator.
+type Comparison struct {
+	Attribute string
+	Operator  string
+	Value     any
+}
+
+// Logical combines two expressions with "and" or "or".
+type Logical struct {
+	Operator    string
+	Left, Right Expression
+}
+
+// Not negates an expression.
+type Not struct {
+	Expression Expression
+}
+
+func (Comparison) isExpression() {}
+func (Logical) isExpression()    {}
+func (Not) isExpression()        {}
+
+var comparisonOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// ParseFilter parses a filter like `userName eq "bjensen" and not (active eq
+// false)`. Attribute names are lower cased and stripped of the schema URN,
+// and the attributes inside a value path like emails[type eq "work"] become
+// emails.type.
+func ParseFilter(filter string) (Expression, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expression, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	return expression, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOpen
+	tokenClose
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// value of string and number tokens
+	value any
+}
+
+func tokenize(filter string) ([]token, error) {
+	var tokens []token
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")"})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{kind: tokenOpenBracket, text: "["})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{kind: tokenCloseBracket, text: "]"})
+			i++
+		case r == '"':
+			end := i + 1
+			for ; end < len(runes) && runes[end] != '"'; end++ {
+				if runes[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			text := string(runes[i : end+1])
+			var value string
+			if err := json.Unmarshal([]byte(text), &value); err != nil {
+				return nil, fmt.Errorf("invalid string %s", text)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text, value: value})
+			i = end + 1
+		case r == '-' || unicode.IsDigit(r):
+			end := i + 1
+			for end < len(runes) && strings.ContainsRune("0123456789.eE+-", runes[end]) {
+				end++
+			}
+			text := string(runes[i:end])
+			var value float64
+			if err := json.Unmarshal([]byte(text), &value); err != nil {
+				return nil, fmt.Errorf("invalid number %s", text)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value})
+			i = end
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()[]"`, runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens   []token
+	position int
+}
+
+func (p *parser) done() bool {
+	return p.position >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.tokens[p.position]
+}
+
+func (p *parser) next() (token, error) {
+	if p.done() {
+		return token{}, errors.New("unexpected end of filter")
+	}
+	t := p.tokens[p.position]
+	p.position++
+	return t, nil
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != kind {
+		return fmt.Errorf("expected %q but got %q", text, t.text)
+	}
+	return nil
+}
+
+// parseOr parses the expressions joined by "or". prefix is the attribute of
+// the value path the expression is in, if any.
+func (p *parser) parseOr(prefix string) (Expression, error) {
+	left, err := p.parseAnd(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.position++
+		right, err := p.parseAnd(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = Logical{Operator: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(prefix string) (Expression, error) {
+	left, err := p.parseUnary(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.position++
+		right, err := p.parseUnary(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = Logical{Operator: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(prefix string) (Expression, error) {
+	if p.peekKeyword("not") {
+		p.position++
+		if err := p.expect(tokenOpen, "("); err != nil {
+			return nil, err
+		}
+		expression, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return Not{Expression: expression}, nil
+	}
+	if p.peek().kind == tokenOpen {
+		p.position++
+		expression, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return expression, nil
+	}
+	return p.parseAttributeExpression(prefix)
+}
+
+func (p *parser) parseAttributeExpression(prefix string) (Expression, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("expected an attribute but got %q", t.text)
+	}
+	attribute := NormalizeAttribute(t.text)
+	if prefix != "" {
+		attribute = prefix + "." + attribute
+	}
+
+	// a value path, emails[type eq "work"]
+	if p.peek().kind == tokenOpenBracket {
+		if prefix != "" {
+			return nil, errors.New("value paths can't be nested")
+		}
+		p.position++
+		expression, err := p.parseOr(attribute)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		return expression, nil
+	}
+
+	operator, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(operator.text)
+	if operator.kind != tokenWord {
+		return nil, fmt.Errorf("expected an operator but got %q", operator.text)
+	}
+	if op == "pr" {
+		return Comparison{Attribute: attribute, Operator: op}, nil
+	}
+	if !comparisonOperators[op] {
+		return nil, fmt.Errorf("unknown operator %q", operator.text)
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch value.kind {
+	case tokenString, tokenNumber:
+		return Comparison{Attribute: attribute, Operator: op, Value: value.value}, nil
+	case tokenWord:
+		switch strings.ToLower(value.text) {
+		case "true":
+			return Comparison{Attribute: attribute, Operator: op, Value: true}, nil
+		case "false":
+			return Comparison{Attribute: attribute, Operator: op, Value: false}, nil
+		case "null":
+			return Comparison{Attribute: attribute, Operator: op, Value: nil}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q", value.text)
+}
+
+// NormalizeAttribute lower cases an attribute name and removes the schema
+// URN in front of it, "urn:ietf:params:scim:schemas:core:2.0:User:userName"
+// becomes "username".
+func NormalizeAttribute(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "urn:") {
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			name = name[i+1:]
+		}
+	}
+	return name
+}
+
+// InSchema reports whether an attribute name belongs to the schema. Names
+// without a schema URN belong to the core schema of the resource, so this
+// mostly tells apart the attributes of extensions that aren't supported.
+func InSchema(name string, schema string) bool {
+	name = strings.ToLower(name)
+	if !strings.HasPrefix(name, "urn:") {
+		return true
+	}
+	return strings.HasPrefix(name, strings.ToLower(schema)+":")
+}
+
+// AttributeType is how an attribute is compared.
+type AttributeType int
+
+const (
+	String AttributeType = iota
+	Boolean
+	DateTime
+)
+
+// Attribute maps a filterable attribute to SQL.
+type Attribute struct {
+	// Column is the SQL expression holding the value.
+	Column string
+	Type   AttributeType
+	// CaseExact strings are compared as they are, others ignoring case.
+	CaseExact bool
+	// Exists, when set, is a format with one %s the condition on Column is
+	// put into, for attributes that live in another table.
+	Exists string
+}
+
+// Compile turns the expression into a SQL condition and its arguments. Only
+// the attributes in the map can be filtered on.
+func Compile(expression Expression, attributes map[string]Attribute) (string, []any, error) {
+	switch e := expression.(type) {
+	case Logical:
+		left, leftArgs, err := Compile(e.Left, attributes)
+		if err != nil {
+			return "", nil, err
+		}
+		right, rightArgs, err := Compile(e.Right, attributes)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + left + " " + strings.ToUpper(e.Operator) + " " + right + ")", append(leftArgs, rightArgs...), nil
+	case Not:
+		condition, args, err := Compile(e.Expression, attributes)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + condition + ")", args, nil
+	case Comparison:
+		attribute, ok := attributes[e.Attribute]
+		if !ok {
+			return "", nil, fmt.Errorf("can't filter on %s", e.Attribute)
+		}
+		condition, args, err := compileComparison(e, attribute)
+		if err != nil {
+			return "", nil, err
+		}
+		if attribute.Exists != "" {
+			condition = fmt.Sprintf(attribute.Exists, condition)
+		}
+		return condition, args, nil
+	}
+	return "", nil, errors.New("invalid filter")
+}
+
+func compileComparison(e Comparison, attribute Attribute) (string, []any, error) {
+	column := attribute.Column
+	if e.Operator == "pr" {
+		if attribute.Type == String {
+			return "(" + column + " IS NOT NULL AND " + column + " <> '')", nil, nil
+		}
+		return column + " IS NOT NULL", nil, nil
+	}
+
+	switch attribute.Type {
+	case Boolean:
+		value, ok := e.Value.(bool)
+		if !ok {
+			return "", nil, fmt.Errorf("%s needs true or false", e.Attribute)
+		}
+		switch e.Operator {
+		case "eq":
+			return column + " = ?", []any{value}, nil
+		case "ne":
+			return column + " <> ?", []any{value}, nil
+		}
+		return "", nil, fmt.Errorf("%s can't be compared with %s", e.Attribute, e.Operator)
+
+	case DateTime:
+		text, ok := e.Value.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("%s needs a date time", e.Attribute)
+		}
+		value, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s needs an RFC 3339 date time", e.Attribute)
+		}
+		operator, ok := sqlOperators[e.Operator]
+		if !ok {
+			return "", nil, fmt.Errorf("%s can't be compared with %s", e.Attribute, e.Operator)
+		}
+		return column + " " + operator + " ?", []any{value}, nil
+	}
+
+	var value string
+	switch v := e.Value.(type) {
+	case string:
+		value = v
+	case float64:
+		value = fmt.Sprint(v)
+	case bool:
+		value = fmt.Sprint(v)
+	case nil:
+		if e.Operator == "eq" {
+			return "(" + column + " IS NULL OR " + column + " = '')", nil, nil
+		}
+		if e.Operator == "ne" {
+			return "(" + column + " IS NOT NULL AND " + column + " <> '')", nil, nil
+		}
+		return "", nil, fmt.Errorf("null can only be compared with eq or ne")
+	}
+	if !attribute.CaseExact {
+		column = "lower(" + column + ")"
+		value = strings.ToLower(value)
+	}
+	switch e.Operator {
+	case "co":
+		return column + ` LIKE ?`, []any{"%" + escapeLike(value) + "%"}, nil
+	case "sw":
+		return column + ` LIKE ?`, []any{escapeLike(value) + "%"}, nil
+	case "ew":
+		return column + ` LIKE ?`, []any{"%" + escapeLike(value)}, nil
+	case "ne":
+		return "(" + attribute.Column + " IS NULL OR " + column + " <> ?)", []any{value}, nil
+	}
+	return column + " " + sqlOperators[e.Operator] + " ?", []any{value}, nil
+}
+
+var sqlOperators = map[string]string{
+	"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<=",
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
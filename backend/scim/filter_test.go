@@ -0,0 +1,164 @@
+package scim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   Expression
+	}{
+		{`userName eq "bjensen"`, Comparison{Attribute: "username", Operator: "eq", Value: "bjensen"}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "J"`, Comparison{Attribute: "username", Operator: "sw", Value: "J"}},
+		{`title pr`, Comparison{Attribute: "title", Operator: "pr"}},
+		{`meta.lastModified gt "2011-05-13T04:42:34Z"`, Comparison{Attribute: "meta.lastmodified", Operator: "gt", Value: "2011-05-13T04:42:34Z"}},
+		{`displayName eq "say \"hi\""`, Comparison{Attribute: "displayname", Operator: "eq", Value: `say "hi"`}},
+		{`externalId eq null`, Comparison{Attribute: "externalid", Operator: "eq", Value: nil}},
+		{`count ge -1.5e2`, Comparison{Attribute: "count", Operator: "ge", Value: -150.0}},
+		{`userName EQ "x" AND active Eq TRUE`, Logical{
+			Operator: "and",
+			Left:     Comparison{Attribute: "username", Operator: "eq", Value: "x"},
+			Right:    Comparison{Attribute: "active", Operator: "eq", Value: true},
+		}},
+		{`userName eq "x" and not (active eq false)`, Logical{
+			Operator: "and",
+			Left:     Comparison{Attribute: "username", Operator: "eq", Value: "x"},
+			Right:    Not{Expression: Comparison{Attribute: "active", Operator: "eq", Value: false}},
+		}},
+		// and binds tighter than or
+		{`a eq 1 or b eq 2 and c eq 3`, Logical{
+			Operator: "or",
+			Left:     Comparison{Attribute: "a", Operator: "eq", Value: 1.0},
+			Right: Logical{
+				Operator: "and",
+				Left:     Comparison{Attribute: "b", Operator: "eq", Value: 2.0},
+				Right:    Comparison{Attribute: "c", Operator: "eq", Value: 3.0},
+			},
+		}},
+		{`(a eq 1 or b eq 2) and c pr`, Logical{
+			Operator: "and",
+			Left: Logical{
+				Operator: "or",
+				Left:     Comparison{Attribute: "a", Operator: "eq", Value: 1.0},
+				Right:    Comparison{Attribute: "b", Operator: "eq", Value: 2.0},
+			},
+			Right: Comparison{Attribute: "c", Operator: "pr"},
+		}},
+		{`emails[type eq "work" and value co "@example.com"]`, Logical{
+			Operator: "and",
+			Left:     Comparison{Attribute: "emails.type", Operator: "eq", Value: "work"},
+			Right:    Comparison{Attribute: "emails.value", Operator: "co", Value: "@example.com"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			got, err := ParseFilter(test.filter)
+			if err != nil {
+				t.Fatalf("ParseFilter failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterRejectsInvalidFilters(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName foo "x"`,
+		`userName eq "x`,
+		`userName eq bjensen`,
+		`userName eq "x" and`,
+		`userName eq "x")`,
+		`(userName eq "x"`,
+		`not active eq true`,
+		`"x" eq userName`,
+		`emails[type eq "work"`,
+		`emails[type[value eq "x"] eq "y"]`,
+		`count eq 1.2.3`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			if got, err := ParseFilter(filter); err == nil {
+				t.Fatalf("ParseFilter accepted the filter: %#v", got)
+			}
+		})
+	}
+}
+
+var testAttributes = map[string]Attribute{
+	"username":     {Column: "email"},
+	"externalid":   {Column: "external_id", CaseExact: true},
+	"active":       {Column: "active", Type: Boolean},
+	"meta.created": {Column: "created_at", Type: DateTime},
+	"groups":       {Column: "groups.name", Exists: "EXISTS (SELECT 1 FROM groups WHERE %s)"},
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		filter    string
+		condition string
+		args      []any
+	}{
+		{`userName eq "BJensen"`, "lower(email) = ?", []any{"bjensen"}},
+		{`externalId eq "AB"`, "external_id = ?", []any{"AB"}},
+		{`externalId gt 5`, "external_id > ?", []any{"5"}},
+		{`userName co "a_b%"`, "lower(email) LIKE ?", []any{`%a\_b\%%`}},
+		{`userName sw "J"`, "lower(email) LIKE ?", []any{"j%"}},
+		{`userName ew "@example.com"`, "lower(email) LIKE ?", []any{"%@example.com"}},
+		{`userName ne "x"`, "(email IS NULL OR lower(email) <> ?)", []any{"x"}},
+		{`userName pr`, "(email IS NOT NULL AND email <> '')", nil},
+		{`userName eq null`, "(email IS NULL OR email = '')", nil},
+		{`userName ne null`, "(email IS NOT NULL AND email <> '')", nil},
+		{`active pr`, "active IS NOT NULL", nil},
+		{`active eq true`, "active = ?", []any{true}},
+		{`active ne false`, "active <> ?", []any{false}},
+		{`meta.created ge "2024-01-02T03:04:05Z"`, "created_at >= ?", []any{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}},
+		{`userName eq "a" and not (active eq false)`, "(lower(email) = ? AND NOT (active = ?))", []any{"a", false}},
+		{`userName eq "a" or externalId eq "b"`, "(lower(email) = ? OR external_id = ?)", []any{"a", "b"}},
+		{`groups eq "Admins"`, "EXISTS (SELECT 1 FROM groups WHERE lower(groups.name) = ?)", []any{"admins"}},
+	}
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			expression, err := ParseFilter(test.filter)
+			if err != nil {
+				t.Fatalf("ParseFilter failed: %v", err)
+			}
+			condition, args, err := Compile(expression, testAttributes)
+			if err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+			if condition != test.condition || !reflect.DeepEqual(args, test.args) {
+				t.Fatalf("got %q %#v, want %q %#v", condition, args, test.condition, test.args)
+			}
+		})
+	}
+}
+
+func TestCompileRejectsInvalidComparisons(t *testing.T) {
+	for _, filter := range []string{
+		`title eq "x"`,
+		`userName eq "x" and title pr`,
+		`active eq "yes"`,
+		`active gt true`,
+		`meta.created eq "yesterday"`,
+		`meta.created eq 5`,
+		`meta.created co "2024"`,
+		`userName co null`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			expression, err := ParseFilter(filter)
+			if err != nil {
+				t.Fatalf("ParseFilter failed: %v", err)
+			}
+			if condition, _, err := Compile(expression, testAttributes); err == nil {
+				t.Fatalf("Compile accepted the filter: %q", condition)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package scim
+
+// SchemaAttribute describes an attribute of a resource, RFC 7643 section 7.
+type SchemaAttribute struct {
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	MultiValued   bool              `json:"multiValued"`
+	Description   string            `json:"description,omitempty"`
+	Required      bool              `json:"required"`
+	CaseExact     bool              `json:"caseExact"`
+	Mutability    string            `json:"mutability"`
+	Returned      string            `json:"returned"`
+	Uniqueness    string            `json:"uniqueness"`
+	SubAttributes []SchemaAttribute `json:"subAttributes,omitempty"`
+}
+
+type Schema struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Attributes  []SchemaAttribute `json:"attributes"`
+	Meta        *Meta             `json:"meta,omitempty"`
+}
+
+type ResourceType struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Endpoint    string   `json:"endpoint"`
+	Description string   `json:"description"`
+	Schema      string   `json:"schema"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type Supported struct {
+	Supported bool `json:"supported"`
+}
+
+type FilterSupported struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type BulkSupported struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type AuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 Supported              `json:"patch"`
+	Bulk                  BulkSupported          `json:"bulk"`
+	Filter                FilterSupported        `json:"filter"`
+	ChangePassword        Supported              `json:"changePassword"`
+	Sort                  Supported              `json:"sort"`
+	ETag                  Supported              `json:"etag"`
+	AuthenticationSchemes []AuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  *Meta                  `json:"meta,omitempty"`
+}
+
+func attribute(name, kind string, options ...func(*SchemaAttribute)) SchemaAttribute {
+	a := SchemaAttribute{Name: name, Type: kind, Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+	for _, option := range options {
+		option(&a)
+	}
+	return a
+}
+
+func required(a *SchemaAttribute)    { a.Required = true }
+func multiValued(a *SchemaAttribute) { a.MultiValued = true }
+func caseExact(a *SchemaAttribute)   { a.CaseExact = true }
+func readOnly(a *SchemaAttribute)    { a.Mutability = "readOnly" }
+func writeOnly(a *SchemaAttribute)   { a.Mutability = "writeOnly"; a.Returned = "never" }
+func unique(a *SchemaAttribute)      { a.Uniqueness = "server" }
+
+func subAttributes(attributes ...SchemaAttribute) func(*SchemaAttribute) {
+	return func(a *SchemaAttribute) { a.SubAttributes = attributes }
+}
+
+// UserSchema describes the attributes of the core User schema that are
+// supported.
+var UserSchema = Schema{
+	Schemas:     []string{SchemaSchema},
+	ID:          SchemaUser,
+	Name:        "User",
+	Description: "User Account",
+	Attributes: []SchemaAttribute{
+		attribute("userName", "string", required, unique, func(a *SchemaAttribute) {
+			a.Description = "Email address the user logs in with"
+		}),
+		attribute("name", "complex", subAttributes(
+			attribute("formatted", "string"),
+			attribute("familyName", "string"),
+			attribute("givenName", "string"),
+		)),
+		attribute("displayName", "string"),
+		attribute("emails", "complex", multiValued, subAttributes(
+			attribute("value", "string"),
+			attribute("type", "string"),
+			attribute("primary", "boolean"),
+		)),
+		attribute("active", "boolean", func(a *SchemaAttribute) {
+			a.Description = "False when the user is suspended or banned"
+		}),
+		attribute("password", "string", writeOnly),
+		attribute("groups", "complex", multiValued, readOnly, subAttributes(
+			attribute("value", "string", readOnly),
+			attribute("$ref", "reference", readOnly),
+			attribute("display", "string", readOnly),
+		)),
+	},
+}
+
+// GroupSchema describes the attributes of the core Group schema.
+var GroupSchema = Schema{
+	Schemas:     []string{SchemaSchema},
+	ID:          SchemaGroup,
+	Name:        "Group",
+	Description: "Group",
+	Attributes: []SchemaAttribute{
+		attribute("displayName", "string", required, unique),
+		attribute("members", "complex", multiValued, subAttributes(
+			attribute("value", "string", caseExact),
+			attribute("$ref", "reference", readOnly),
+			attribute("display", "string", readOnly),
+		)),
+	},
+}
+
+// ResourceTypes are the resources served, with their endpoints.
+var ResourceTypes = []ResourceType{
+	{
+		Schemas:     []string{SchemaResourceType},
+		ID:          "User",
+		Name:        "User",
+		Endpoint:    "/Users",
+		Description: "User Account",
+		Schema:      SchemaUser,
+	},
+	{
+		Schemas:     []string{SchemaResourceType},
+		ID:          "Group",
+		Name:        "Group",
+		Endpoint:    "/Groups",
+		Description: "Group",
+		Schema:      SchemaGroup,
+	},
+}
@@ -0,0 +1,82 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want Path
+	}{
+		{"userName", Path{Attribute: "username"}},
+		{"urn:ietf:params:scim:schemas:core:2.0:User:name.givenName", Path{Attribute: "name", SubAttribute: "givenname"}},
+		{`emails[type eq "work"].value`, Path{
+			Attribute:    "emails",
+			Filter:       Comparison{Attribute: "type", Operator: "eq", Value: "work"},
+			SubAttribute: "value",
+		}},
+		{`members[value eq "12"]`, Path{
+			Attribute: "members",
+			Filter:    Comparison{Attribute: "value", Operator: "eq", Value: "12"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := ParsePath(test.path)
+			if err != nil {
+				t.Fatalf("ParsePath failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePathRejectsInvalidPaths(t *testing.T) {
+	for _, path := range []string{
+		"",
+		" ",
+		`emails[type eq "work"`,
+		`emails]type eq "work"[`,
+		`emails[type eq]`,
+		`emails[type eq "work"]value`,
+		`emails[type eq "work"].`,
+	} {
+		t.Run(path, func(t *testing.T) {
+			if got, err := ParsePath(path); err == nil {
+				t.Fatalf("ParsePath accepted the path: %#v", got)
+			}
+		})
+	}
+}
+
+func TestBoolAcceptsStrings(t *testing.T) {
+	tests := []struct {
+		json string
+		want Bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`"True"`, true},
+		{`"FALSE"`, false},
+	}
+	for _, test := range tests {
+		var got Bool
+		if err := json.Unmarshal([]byte(test.json), &got); err != nil {
+			t.Fatalf("%s: %v", test.json, err)
+		}
+		if got != test.want {
+			t.Fatalf("%s: got %v, want %v", test.json, got, test.want)
+		}
+	}
+	for _, invalid := range []string{`"yes"`, `1`, `null`} {
+		var got Bool
+		if err := json.Unmarshal([]byte(invalid), &got); err == nil {
+			t.Fatalf("%s was accepted as %v", invalid, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package tenant limits database queries to the organization of a request.
+//
+// middleware.Tenant puts the organization into the request context, and any
+// query run with that context through db.WithContext only sees the users who
+// are members of it, its groups, its invitations and its audit events. Audit
+// events recorded outside of any organization, like logins, belong to the
+// organizations of their actor or target user. The filter is added by GORM
+// callbacks so controllers can't forget it.
+package tenant
+
+import (
+	"context"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type contextKey struct{}
+
+// WithOrganization returns a context whose queries are limited to the
+// organization.
+func WithOrganization(ctx context.Context, organizationID uint) context.Context {
+	return context.WithValue(ctx, contextKey{}, organizationID)
+}
+
+// OrganizationID returns the organization the context is limited to.
+func OrganizationID(ctx context.Context) (uint, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	organizationID, ok := ctx.Value(contextKey{}).(uint)
+	return organizationID, ok
+}
+
+// scopes are the filters added to the tables that belong to an organization.
+// Every ? is the organization.
+var scopes = map[string]string{
+	"users":       "users.id IN (SELECT user_id FROM memberships WHERE organization_id = ?)",
+	"groups":      `"groups".organization_id = ?`,
+	"invitations": "invitations.organization_id = ?",
+	"audit_events": `(audit_events.organization_id = ? OR audit_events.organization_id IS NULL AND (
+		audit_events.actor_id IN (SELECT user_id FROM memberships WHERE organization_id = ?) OR
+		audit_events.target_type = 'user' AND audit_events.target_id IN (SELECT CAST(user_id AS text) FROM memberships WHERE organization_id = ?)))`,
+}
+
+// RegisterCallbacks adds the tenant filter to queries, row scans, updates and
+// deletes of the tables in scopes.
+func RegisterCallbacks(db *gorm.DB) error {
+	if err := db.Callback().Query().Before("gorm:query").Register("tenant:query", scope); err != nil {
+		return err
+	}
+	if err := db.Callback().Row().Before("gorm:row").Register("tenant:row", scope); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register("tenant:update", scope); err != nil {
+		return err
+	}
+	return db.Callback().Delete().Before("gorm:delete").Register("tenant:delete", scope)
+}
+
+func scope(db *gorm.DB) {
+	organizationID, ok := OrganizationID(db.Statement.Context)
+	if !ok {
+		return
+	}
+	table := db.Statement.Table
+	if db.Statement.Schema != nil {
+		table = db.Statement.Schema.Table
+	}
+	filter, ok := scopes[table]
+	if !ok {
+		return
+	}
+	vars := make([]interface{}, strings.Count(filter, "?"))
+	for i := range vars {
+		vars[i] = organizationID
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Expr{SQL: filter, Vars: vars},
+	}})
+}
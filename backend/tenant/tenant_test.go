@@ -0,0 +1,63 @@
+package tenant
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aotsurasak46/user-management/models"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dryRunDB builds statements without a database to run them on.
+func dryRunDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCallbacks(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestAuditEventsScope(t *testing.T) {
+	db := dryRunDB(t)
+	ctx := WithOrganization(context.Background(), 7)
+
+	var events []models.AuditEvent
+	stmt := db.WithContext(ctx).Where("action = ?", "auth.login").Find(&events).Statement
+	sql := strings.Join(strings.Fields(stmt.SQL.String()), " ")
+
+	// a login is recorded without an organization, it has to be listed
+	// through the memberships of its actor
+	for _, want := range []string{
+		"audit_events.organization_id = $2 OR audit_events.organization_id IS NULL",
+		"audit_events.actor_id IN (SELECT user_id FROM memberships WHERE organization_id = $3)",
+		"audit_events.target_id IN (SELECT CAST(user_id AS text) FROM memberships WHERE organization_id = $4)",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("%s\ndoesn't contain %s", sql, want)
+		}
+	}
+	if !strings.Contains(sql, "WHERE action = $1 AND (") {
+		t.Fatalf("the tenant filter isn't combined in parentheses: %s", sql)
+	}
+	for _, v := range stmt.Vars[1:] {
+		if v != uint(7) {
+			t.Fatalf("got vars %v, want the organization for every placeholder", stmt.Vars)
+		}
+	}
+}
+
+func TestScopeSkipsQueriesWithoutOrganization(t *testing.T) {
+	db := dryRunDB(t)
+
+	var events []models.AuditEvent
+	stmt := db.WithContext(context.Background()).Find(&events).Statement
+	if sql := stmt.SQL.String(); strings.Contains(sql, "WHERE") {
+		t.Fatalf("got %s, want no filter", sql)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -8,27 +9,96 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func GenerateJWT(userID uint) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["user_id"] = userID
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+// AccessTokenTTL is how long an access token stays valid. It is kept short
+// because access tokens are only checked against the session on each request,
+// the refresh token is what keeps a user logged in.
+func AccessTokenTTL() time.Duration {
+	return GetEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
 
-	jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
-	return token.SignedString([]byte(jwtSecretKey))
+// RefreshTokenTTL is how long a session can be kept alive by refreshing.
+func RefreshTokenTTL() time.Duration {
+	return GetEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
 }
 
-func ParseJWT(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
+// TokenSigner signs the JWTs we issue and finds the key to verify them.
+// main installs the keyring with SetTokenSigner, until then tokens are signed
+// with the shared JWT_SECRET_KEY.
+type TokenSigner interface {
+	Sign(claims jwt.MapClaims) (string, error)
+	Keyfunc(token *jwt.Token) (interface{}, error)
+	ValidMethods() []string
+}
+
+var tokenSigner TokenSigner = HMACSigner{}
+
+func SetTokenSigner(signer TokenSigner) {
+	tokenSigner = signer
+}
+
+// MinSecretKeyLength is the shortest JWT_SECRET_KEY HS256 tokens are signed
+// or verified with. An empty key would let anyone sign tokens.
+const MinSecretKeyLength = 32
+
+var ErrWeakSecretKey = errors.New("JWT_SECRET_KEY is shorter than 32 bytes")
+
+// HMACSecret returns JWT_SECRET_KEY, or ErrWeakSecretKey when it is too short
+// to be used.
+func HMACSecret() ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET_KEY")
+	if len(secret) < MinSecretKeyLength {
+		return nil, ErrWeakSecretKey
+	}
+	return []byte(secret), nil
+}
+
+// HMACSigner signs with HS256 and the JWT_SECRET_KEY secret.
+type HMACSigner struct{}
+
+func (HMACSigner) Sign(claims jwt.MapClaims) (string, error) {
+	secret, err := HMACSecret()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(secret)
+}
+
+func (HMACSigner) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	secret, err := HMACSecret()
+	if err != nil {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return secret, nil
+}
+
+func (HMACSigner) ValidMethods() []string {
+	return []string{jwt.SigningMethodHS256.Alg()}
+}
+
+func GenerateJWT(userID uint, sessionID uint) (string, error) {
+	now := time.Now()
+	return tokenSigner.Sign(jwt.MapClaims{
+		"user_id": userID,
+		"sid":     sessionID,
+		"iat":     now.Unix(),
+		"exp":     now.Add(AccessTokenTTL()).Unix(),
 	})
+}
 
-	if err != nil || !token.Valid {
+func ParseJWT(tokenString string) (jwt.MapClaims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(tokenSigner.ValidMethods()))
+	token, err := parser.Parse(tokenString, tokenSigner.Keyfunc)
+
+	if err != nil {
 		return nil, err
 	}
+	if !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
+	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
@@ -57,3 +127,56 @@ func GetUserIDFromJWT(c *fiber.Ctx) (uint, error) {
 	}
 	return uint(userIDFloat), nil
 }
+
+// GenerateChallengeJWT issues a short lived token proving that the password
+// step of a two factor login succeeded. It carries no session, so Authen never
+// accepts it as an access token.
+func GenerateChallengeJWT(userID uint) (string, error) {
+	return tokenSigner.Sign(jwt.MapClaims{
+		"user_id": userID,
+		"purpose": "2fa",
+		"exp":     time.Now().Add(GetEnvDuration("TWO_FACTOR_CHALLENGE_TTL", 5*time.Minute)).Unix(),
+	})
+}
+
+// ParseChallengeJWT returns the user a challenge token was issued for.
+func ParseChallengeJWT(tokenString string) (uint, error) {
+	claims, err := ParseJWT(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != "2fa" {
+		return 0, jwt.ErrTokenInvalidClaims
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("user_id is not a valid number")
+	}
+	return uint(userID), nil
+}
+
+// GenerateDataExportJWT signs the download link of a data export. Like the
+// challenge token it carries no session, so it only works for that download.
+func GenerateDataExportJWT(exportID uint, ttl time.Duration) (string, error) {
+	return tokenSigner.Sign(jwt.MapClaims{
+		"export_id": exportID,
+		"purpose":   "data_export",
+		"exp":       time.Now().Add(ttl).Unix(),
+	})
+}
+
+// ParseDataExportJWT returns the data export a download token was issued for.
+func ParseDataExportJWT(tokenString string) (uint, error) {
+	claims, err := ParseJWT(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	if purpose, _ := claims["purpose"].(string); purpose != "data_export" {
+		return 0, jwt.ErrTokenInvalidClaims
+	}
+	exportID, ok := claims["export_id"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("export_id is not a valid number")
+	}
+	return uint(exportID), nil
+}
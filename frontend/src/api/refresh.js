@@ -0,0 +1,44 @@
+import axios from 'axios'
+
+const BASE_URL = import.meta.env.VITE_API_BASE_URL
+
+let refreshing = null
+
+// A refresh token is only valid once, so every refresh goes through here:
+// callers in this tab share one request, and other tabs wait for it through a
+// Web Lock so they send the cookie it rotated rather than the stale one.
+export function refreshAccessToken() {
+  if (!refreshing) {
+    const refresh = () => axios.post(`${BASE_URL}/api/v1/token/refresh`, {}, { withCredentials: true })
+    const request = navigator.locks ? navigator.locks.request('token-refresh', refresh) : refresh()
+    refreshing = request.finally(() => {
+      refreshing = null
+    })
+  }
+  return refreshing
+}
+
+// Access tokens are short lived, so when a request comes back 401 we exchange
+// the refresh token cookie for a new access token once and retry the request.
+export function setupTokenRefresh() {
+  axios.interceptors.response.use(
+    (response) => response,
+    async (error) => {
+      const original = error.config
+      const status = error.response?.status
+      const isAuthEndpoint = original?.url?.includes('/api/v1/token/refresh') || original?.url?.includes('/api/v1/login')
+
+      if (status !== 401 || !original || original._retried || isAuthEndpoint) {
+        return Promise.reject(error)
+      }
+      original._retried = true
+
+      try {
+        await refreshAccessToken()
+      } catch (refreshError) {
+        return Promise.reject(error)
+      }
+      return axios(original)
+    },
+  )
+}
@@ -6,6 +6,9 @@ import 'vue3-toastify/dist/index.css'
 import App from './App.vue'
 import router from './router'
 import PrimeVue from 'primevue/config';
+import { setupTokenRefresh } from './api/refresh'
+
+setupTokenRefresh()
 
 const app = createApp(App)
 
@@ -2,6 +2,7 @@ import { ref, computed } from 'vue'
 import { defineStore } from 'pinia'
 import { useUserAccountStore } from './userAccount'
 import axios from 'axios'
+import { refreshAccessToken } from '@/api/refresh'
 
 const WS_URL = import.meta.env.VITE_WS_URL 
 const BASE_URL = import.meta.env.VITE_API_BASE_URL 
@@ -24,8 +25,13 @@ export const useChatStore = defineStore('chat', {
             return;
         }
         console.log(`Reconnecting... Attempt ${this.reconnectAttempts}`);
-        setTimeout(() => {
+        setTimeout(async () => {
             this.reconnectAttempts++;
+            try {
+                // the access token cookie may have expired while the socket was open
+                await refreshAccessToken();
+            } catch (err) {
+            }
             this.connect();
         }, 2000); 
     },
@@ -63,6 +69,15 @@ export const useChatStore = defineStore('chat', {
                     }
                     return;
                 }
+
+                if (payload.type === 'error') {
+                    const index = this.chatMessages.findIndex(msg => msg.tempId === payload.data?.tempId);
+                    if (index !== -1) {
+                        this.chatMessages[index].status = 'failed'
+                    }
+                    console.error('Message rejected:', payload.data?.error);
+                    return;
+                }
     
                 const data = payload.data;
                 if (
@@ -175,6 +190,15 @@ export const useChatStore = defineStore('chat', {
         }
     },
 
+    // searchUsers finds people to start a new chat with
+    async searchUsers(query) {
+        const response = await axios.get(`${BASE_URL}/api/v1/users/search`, {
+            params: { q: query, exclude_self: true, limit: 10 },
+            withCredentials: true,
+        })
+        return response.data
+    },
+
     setSelectedChatUser(user) {
         this.selectedChatUser = user
     },
@@ -8,15 +8,25 @@ const BASE_URL = import.meta.env.VITE_API_BASE_URL
 export const useUserStore = defineStore('user', {
   state: () => ({
     users: [],
+    roles: [],
     selectedUser: {},
   }),
   actions:{
     async loadUsers() {
       try {
-        const response = await axios.get(`${BASE_URL}/api/v1/users` ,{
-          withCredentials: true,
-        })
-        this.users = response.data
+        // the list view filters and sorts on the client, so follow the
+        // cursor until every page is loaded
+        const users = []
+        let cursor = ''
+        do {
+          const response = await axios.get(`${BASE_URL}/api/v1/users`, {
+            params: { limit: 200, cursor: cursor || undefined },
+            withCredentials: true,
+          })
+          users.push(...response.data.data)
+          cursor = response.data.next_cursor
+        } while (cursor)
+        this.users = users
       }catch(error){
         console.log('error', error)
         let errorMessage = 'Something went wrong. Please try again.'
@@ -26,6 +36,16 @@ export const useUserStore = defineStore('user', {
         throw new Error(errorMessage)
       }
     },
+    async loadRoles() {
+      try {
+        const response = await axios.get(`${BASE_URL}/api/v1/roles`, {
+          withCredentials: true,
+        })
+        this.roles = response.data
+      } catch (error) {
+        console.log('error', error)
+      }
+    },
     async loadUser(id) {
       try {
         const response = await axios.get(`${BASE_URL}/api/v1/users/${id}`,{
@@ -9,6 +9,10 @@ export const useUserAccountStore = defineStore('userAccount', {
     user: null,
   }),
 
+  getters: {
+    can: (state) => (permission) => !!state.user?.permissions?.includes(permission),
+  },
+
   actions: {
     async login(email, password) {
       try {
@@ -20,6 +24,8 @@ export const useUserAccountStore = defineStore('userAccount', {
         })
         this.isAuthenticated = true
         this.user = response.data
+        // check-auth also returns the permissions of the role
+        await this.checkAuth()
         return true
 
       } catch (error) {